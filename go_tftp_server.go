@@ -10,13 +10,38 @@ Purpose:	TFTP server is used to server the tftp clients.
 package main
 
 import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"container/heap"
 	"container/list"
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
 	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
+	"hash/crc32"
+	"io"
+	"io/fs"
+	"math"
 	"net"
+	"net/http"
 	"os"
+	"os/signal"
+	"path"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 )
 
@@ -27,6 +52,7 @@ const (
 	DATA  uint16 = 3
 	ACK   uint16 = 4
 	ERROR uint16 = 5
+	OACK  uint16 = 6
 
 	//errors
 	UNKNOWNERROR    uint16 = 0
@@ -37,343 +63,4111 @@ const (
 	UNKNOWNID       uint16 = 5
 	FILEEXISTS      uint16 = 6
 	USERNOTFOUND    uint16 = 7
+	OPTIONNEGFAILED uint16 = 8 //option negotiation failed (RFC 2347)
 
-	FILEBLOCKSIZE uint16 = 512
-	TIMEOUT              = 2
+	FILEBLOCKSIZE   uint16 = 512
+	MINBLKSIZE      int    = 8 //blksize option range (RFC 2348)
+	MAXBLKSIZE      int    = 65464
+	TIMEOUT                = 2
+	MINRATELIMIT    int    = 1024                   //slowest rate client can ask with ratelimit option, in bytes per second
+	MAXPREALLOC     int64  = 16 << 20               //biggest buffer allocated in advance for upload announcing tsize
+	UPSTREAMBACKOFF        = 500 * time.Millisecond //first pause before fetch from upstream is tried again
+	WEBHOOKRETRIES         = 3                      //times failed POST of -write-webhook-url is tried again
+	WEBHOOKBACKOFF         = time.Second            //first pause before POST is tried again
 
 	//error message
-	FILENOTFOUNDMSG string = "File not found"
-	FILEEXISTSMSG   string = "File already exist"
+	FILENOTFOUNDMSG  string = "File not found"
+	FILEEXISTSMSG    string = "File already exist"
+	SERVERBUSYMSG    string = "Server busy, try again later"
+	FUTUREACKMSG     string = "ACK received for block not sent yet"
+	FUTUREDATAMSG    string = "DATA received for block after expected block"
+	WRONGPASSWORDMSG string = "Wrong password"
+	READONLYMSG      string = "Server is read-only"
+	STALEFILEMSG     string = "Stored file is newer"
+	CANCELLEDMSG     string = "Transfer cancelled by server"
+	VIRTUALFILEMSG   string = "Virtual file can not be written"
+	SHUTDOWNMSG      string = "Server shutting down"
+	READQUOTAMSG     string = "Read quota of file exhausted"
+	UNKNOWNTIDMSG    string = "Unknown transfer ID"
+	FILENAMEMSG      string = "File name not allowed"
+	DEADLINEMSG      string = "Transfer deadline exceeded"
+	TSIZEOVERMSG     string = "Data received beyond tsize"
+	TSIZEUNDERMSG    string = "Upload shorter than tsize"
+	MAXFILESMSG      string = "Maximum number of files reached"
+	OPTIONNEGMSG     string = "Option negotiation failed"
+	UPLOADQUOTAMSG   string = "Upload quota of client exceeded"
+
+	DEFAULTCONTENTTYPE string = "application/octet-stream"
+)
+
+// request structure
+type RequestData struct {
+	OPcode     uint16            //opcode
+	FileName   string            // requested file name
+	Mode       string            // Operating mode. We are handling only octet mode
+	ClientAddr *net.UDPAddr      //client address
+	Options    map[string]string // options requested by client (RFC 2347). Names are in lower case
+	Mux        *PortMux          // listening socket multiplexer with -single-port. Nil if transfer has its own socket
+	ReceivedAt time.Time         // time when request was received on listening socket
+}
+
+// stored file
+type FileEntry struct {
+	Blocks     *list.List   // data blocks of file
+	Size       int          // file size in bytes
+	CreatedAt  time.Time    // time when file was stored
+	ModTime    time.Time    // modification time given by client with mtime option. Same as CreatedAt if not given
+	UploadedAt time.Time    // time of Server clock when file was stored by upload. Zero if preloaded, fetched or restored
+	LastReadAt time.Time    // time when file was read last time. Zero if never read
+	Reads      atomic.Int64 // number of completed reads
+	Pinned     bool         // file is never removed automatically (ex. by -one-shot). Protected by FileMapLock
+	MaxReads   int64        // number of reads allowed by maxreads option (unlimited if 0)
+	ReadSlots  atomic.Int64 // reads started and not failed. Counted only if MaxReads is set
+	Readers    int          // reads in progress. Counted only with -max-readers-per-file. Protected by FileMapLock
+	Claimed    bool         // read of -one-shot file is in progress so other reads do not get it. Protected by FileMapLock
+
+	Protected    bool              // file can be read only with password given at upload by pw option
+	PasswordHash [sha256.Size]byte // hash of password
+
+	ContentHash [sha256.Size]byte // hash of file data. Set only with -dedup
+	ContentType string            // content type given by client with contenttype option
+}
+
+// file data shared by files of identical content
+type SharedContent struct {
+	Blocks *list.List // data blocks
+	Refs   int        // number of files having this content
+}
+
+// Shared file data mapped by hash of content. Used only with -dedup. Protected by FileMapLock.
+var Contents = make(map[[sha256.Size]byte]*SharedContent)
+
+// information of stored file returned by Server.ListFiles
+type FileInfo struct {
+	Name       string    `json:"name"`
+	Size       int       `json:"size"`
+	Blocks     int       `json:"blocks"`
+	ModTime    time.Time `json:"mod_time"`
+	LastReadAt time.Time `json:"last_read_at"`
+	Reads      int64     `json:"reads"`
+	Pinned     bool      `json:"pinned"`
+	MaxReads   int64     `json:"max_reads"` // 0 if unlimited
+}
+
+// snapshot of transfer in progress reported by admin endpoint "/transfers"
+type TransferInfo struct {
+	ID        int64     `json:"id"`
+	FileName  string    `json:"file_name"`
+	Direction string    `json:"direction"` // "read" or "write"
+	Client    string    `json:"client"`
+	Bytes     int64     `json:"bytes"` // file data transferred so far
+	Block     int64     `json:"block"` // last block acknowledged
+	StartedAt time.Time `json:"started_at"`
+}
+
+// runtime configuration reported by admin endpoint "/capabilities"
+type Capabilities struct {
+	Options            []string `json:"options"`             // options accepted by server
+	Modes              []string `json:"modes"`               // transfer modes implemented by server
+	UnknownMode        string   `json:"unknown_mode"`        // "reject" or "octet"
+	NetasciiConversion bool     `json:"netascii_conversion"` // netascii is served as octet
+	MinBlksize         int      `json:"min_blksize"`         // effective blksize range after clamping
+	MaxBlksize         int      `json:"max_blksize"`
+	MaxWindowsize      int      `json:"max_windowsize"`
+	RateLimitBps       int      `json:"rate_limit_bps"` // 0 if unlimited
+	ReadOnly           bool     `json:"read_only"`
+	MaxRequestSize     int      `json:"max_request_size"`
+	MaxOptions         int      `json:"max_options"`
+	MaxOptionsLength   int      `json:"max_options_length"`
+	Workers            int      `json:"workers"`    // per listening address
+	ResumeTTL          string   `json:"resume_ttl"` // "0s" if resume is disabled
+	OneShot            bool     `json:"one_shot"`
+	Dedup              bool     `json:"dedup"`
+	Upstream           string   `json:"upstream"`
+	SinglePort         bool     `json:"single_port"` // transfers use listening port
+}
+
+// transfer in progress registered in Server. Bytes and Block are updated by handler while others are fixed.
+type TransferStatus struct {
+	Info  TransferInfo
+	Bytes atomic.Int64
+	Block atomic.Int64
+
+	Ctx    context.Context // context of transfer. It is cancelled to stop transfer
+	Cancel context.CancelFunc
+}
+
+//Map containing file name and its list of blocks. This is small part of file system implementation.
+// It maps file name to its data blocks
+var FileMap = make(map[string]*FileEntry)
+
+// Lock protecting FileMap. Transfers and the admin endpoint run in their own goroutines.
+var FileMapLock sync.RWMutex
+
+// Files loaded from the preload directory mapped to hash of their content.
+// Used on reload to find out which files were changed or removed.
+var PreloadedFiles = make(map[string][sha256.Size]byte)
+
+// server statistics
+var Stats struct {
+	ActiveTransfers atomic.Int64 // transfers in progress
+	Reads           atomic.Int64 // completed read transfers
+	Writes          atomic.Int64 // completed write transfers
+	Errors          atomic.Int64 // failed transfers
+	Quarantined     atomic.Int64 // packets on listening socket which are not valid TFTP packets
+
+	FirstByteNanos atomic.Int64 // sum of time from read request to first OACK or DATA packet
+	FirstByteCount atomic.Int64 // number of reads added to FirstByteNanos
+}
+
+// position reached by failed read transfer. Same client can continue from it using "resume" option.
+type ReadCheckpoint struct {
+	File   *FileEntry // file being read. Checkpoint is not valid once file is replaced
+	Offset int64      // bytes acknowledged by client
+	Time   time.Time  // time of failure
+}
+
+// Checkpoints of failed reads. It maps client IP and file name to checkpoint.
+var Checkpoints = make(map[string]ReadCheckpoint)
+var CheckpointLock sync.Mutex
+
+// bytes uploaded by client IP in current quota window
+type UploadUsage struct {
+	WindowStart time.Time // time of first upload of window
+	Bytes       int64     // bytes received in window
+}
+
+// Upload usage of clients for -upload-quota. It maps client IP to usage.
+var UploadUsages = make(map[string]UploadUsage)
+var UploadUsageLock sync.Mutex
+
+// rule serving different file to clients of a subnet. Given as name=subnet:target
+type SubnetAlias struct {
+	Name   string     // requested file name
+	Subnet *net.IPNet // client subnet
+	Target string     // file served to clients of subnet
+}
+
+// list of subnet aliases. It is command line option which can be given many times.
+type SubnetAliases []SubnetAlias
+
+func (Aliases *SubnetAliases) String() string {
+	return fmt.Sprint(*Aliases)
+}
+
+func (Aliases *SubnetAliases) Set(Value string) error {
+
+	Name, Rest, ok1 := strings.Cut(Value, "=")
+	Subnet, Target, ok2 := strings.Cut(Rest, ":")
+	if !ok1 || !ok2 || Name == "" || Target == "" {
+		return errors.New("alias must be name=subnet:target")
+	}
+	_, IPNet, err := net.ParseCIDR(Subnet)
+	if err != nil {
+		return err
+	}
+	*Aliases = append(*Aliases, SubnetAlias{Name: Name, Subnet: IPNet, Target: Target})
+	return nil
+}
+
+/**
+* @brief : Function to resolve requested file name by aliases. First alias matching name and
+*          client subnet is used. Name is not changed if no alias matches.
+* @param : Name : requested file name
+* @param : Client : client address
+ */
+
+func (Aliases SubnetAliases) Resolve(Name string, Client net.Addr) string {
+
+	ClientAddr, ok := Client.(*net.UDPAddr)
+	if !ok {
+		return Name
+	}
+	for _, Alias := range Aliases {
+		if Alias.Name == Name && Alias.Subnet.Contains(ClientAddr.IP) {
+			return Alias.Target
+		}
+	}
+	return Name
+}
+
+var Aliases SubnetAliases
+
+// transfer modes of RFC 1350. Other modes are handled as set by -unknown-mode
+var RFCModes = []string{"octet", "netascii", "mail"}
+
+// transfer modes implemented by server. Reported to clients by capabilities.
+// netascii and mail are accepted but data is sent as it is stored
+var TransferModes = []string{"octet"}
+
+// command line options
+var (
+	PreloadDir             = flag.String("preload-dir", "", "directory whose files are loaded into memory at startup")
+	AdminAddr              = flag.String("admin-addr", "", "address of admin HTTP endpoint (disabled if empty)")
+	Workers                = flag.Int("workers", 64, "number of workers serving requests of each listening address")
+	QueueTimeout           = flag.Duration("queue-timeout", time.Second, "time to wait for free worker before replying server busy")
+	OneShot                = flag.Bool("one-shot", false, "remove file after it is read completely once")
+	AutoGunzip             = flag.Bool("auto-gunzip", false, "serve decompressed content of file.gz when file is requested but not present")
+	MaxUptime              = flag.Duration("max-uptime", 0, "server stops gracefully after running this long (disabled if 0)")
+	StatsInterval          = flag.Duration("stats-interval", 0, "interval of statistics log line (disabled if 0)")
+	ResumeTTL              = flag.Duration("resume-ttl", 0, "time for which failed read can be resumed with resume option (disabled if 0)")
+	RateLimitBps           = flag.Int("rate-limit-bps", 0, "maximum speed of each transfer in bytes per second (unlimited if 0)")
+	UnknownMode            = flag.String("unknown-mode", "octet", "handling of unknown transfer mode: reject (illegal operation error) or octet")
+	TransferPortRange      = flag.String("transfer-port-range", "", "local port range of transfer sockets as low-high (any free port if empty)")
+	UploadClientPrefix     = flag.Bool("upload-client-prefix", false, "store uploaded file with client IP prefixed to its name")
+	HTTPGateway            = flag.Bool("http-gateway", false, "serve file content on GET /files/{name} of admin address")
+	ReadOnly               = flag.Bool("read-only", false, "reject write requests. Files can be given only by -preload-dir")
+	Dedup                  = flag.Bool("dedup", false, "store identical file content only once")
+	MinBlksize             = flag.Int("min-blksize", 0, "smaller blksize requested by client is raised to this value")
+	MaxRequestSize         = flag.Int("max-request-size", 1500, "biggest request (file name, mode and options) read from listening socket")
+	MaxOptions             = flag.Int("max-options", 16, "maximum number of options in request")
+	MaxOptionsLength       = flag.Int("max-options-length", 512, "maximum total length in bytes of options in request")
+	Banner                 = flag.String("banner", "text", "startup line format: text or json ({\"addr\":\"ip:port\"} line with bound address)")
+	MaxUnfragmentedBlksize = flag.Int("max-unfragmented-blksize", 1468, "bigger blksize requested by client is lowered to this value to avoid IP fragmentation (disabled if 0)")
+	Upstream               = flag.String("upstream", "", "address of TFTP server from which files missing locally are fetched and kept (disabled if empty)")
+	SnapshotFile           = flag.String("snapshot-file", "", "file where stored files are saved on stop and loaded from at start (disabled if empty)")
+	UpstreamBlksize        = flag.Int("upstream-blksize", 1468, "blksize requested from -upstream server")
+	ShutdownWrites         = flag.String("shutdown-writes", "wait", "uploads in progress at stop: wait (till completed), abort (error to client) or commit (store data received so far)")
+	VirtualWrites          = flag.String("virtual-writes", "reject", "write of virtual file name: reject (access violation error) or shadow (stored file is served in place of virtual one)")
+	DebugNegotiation       = flag.Bool("debug-negotiation", false, "log options requested by client, how each was accepted and effective transfer parameters")
+	MaxFiles               = flag.Int("max-files", 0, "maximum number of stored files. Upload of new file name is rejected when reached (unlimited if 0)")
+	InterPacketDelay       = flag.Duration("inter-packet-delay", 0, "minimum time between consecutive DATA packets of one read window for clients dropping fast packets (disabled if 0)")
+	SinglePort             = flag.Bool("single-port", false, "run transfers from listening port instead of new port per transfer (for NAT and firewalls)")
+	MinFileAge             = flag.Duration("min-file-age", 0, "file stored less than this time ago is not served yet, as if not present (disabled if 0)")
+	MaxWindowsize          = flag.Int("max-windowsize", 16, "biggest windowsize accepted for read and write requests")
+	FilenamePattern        = flag.String("filename-pattern", "", "regular expression file names of requests must match. Others get access violation error (all allowed if empty)")
+	KeepAliveInterval      = flag.Duration("keepalive-interval", 0, "interval of OACK sent again while file is fetched from -upstream or produced, so client does not time out (disabled if 0)")
+	MirrorDir              = flag.String("mirror-dir", "", "directory where each completed upload is also written in background (disabled if empty)")
+	SlowLogThreshold       = flag.Duration("slow-log-threshold", 0, "log only transfers taking longer than this, as warning with duration and blocks (all transfers logged if 0)")
+	UpstreamRetries        = flag.Int("upstream-retries", 0, "times whole fetch from -upstream is tried again after timeout or transient error, with doubling pause from 500ms")
+	MaxReadersPerFile      = flag.Int("max-readers-per-file", 0, "maximum number of concurrent reads of one file. Excess reads get server busy error (unlimited if 0)")
+	UploadQuota            = flag.Int64("upload-quota", 0, "maximum bytes one client IP can upload within -quota-window. Upload going over it gets disk full error (unlimited if 0)")
+	QuotaWindow            = flag.Duration("quota-window", time.Hour, "time window of -upload-quota. Usage of client starts from zero when its window ends")
+	CapabilitiesFile       = flag.String("capabilities-file", "", "name of virtual file whose read returns capabilities (options, transfer modes, limits) as JSON (disabled if empty)")
+	WriteWebhookURL        = flag.String("write-webhook-url", "", "URL to which JSON with file name, size, client and sha256 of each completed upload is POSTed in background (disabled if empty)")
+	ReadWebhookURL         = flag.String("read-webhook-url", "", "URL to which JSON with file name, client and bytes of each completed read is POSTed in background (disabled if empty)")
+	StrictNegotiation      = flag.Bool("strict-negotiation", false, "request with invalid value of supported option gets option negotiation failed error (code 8) instead of option being ignored")
+	DSCP                   = flag.Int("dscp", 0, "DSCP value [0:63] set in IP header of transfer packets")
 )
 
-// request structure
-type RequestData struct {
-	OPcode     uint16       //opcode
-	FileName   string       // requested file name
-	Mode       string       // Operating mode. We are handling only octet mode
-	ClientAddr *net.UDPAddr //client address
+// reason of rejecting packet received on listening socket. Error text is Reason only as it is sent
+// back to client in error packet.
+type ParseError struct {
+	Offset int    // byte offset of packet where problem was found
+	Reason string // ex. "Malformed request"
+	Raw    string // packet bytes in hex
+}
+
+func (Err *ParseError) Error() string {
+	return Err.Reason
+}
+
+/**
+* @brief : Function to create parse error of packet.
+* @param : Pkt : received packet
+* @param : Offset : byte offset of problem
+* @param : Reason : description of problem
+ */
+
+func NewParseError(Pkt []byte, Offset int, Reason string) *ParseError {
+
+	return &ParseError{Offset: Offset, Reason: Reason, Raw: hex.EncodeToString(Pkt)}
+}
+
+/**
+* @brief : Fucntion to Parse Request received from client.
+* @param : buf: Raw data of request.
+* @param : ReqLen: request length
+* @param : ReqData: result of parsing
+* @return : *ParseError if packet is not valid TFTP packet
+ */
+func ParseRequest(buf []byte, ReqLen uint16, ReqData *RequestData) error {
+
+	if int(ReqLen) > len(buf) {
+		ReqLen = uint16(len(buf))
+	}
+	Pkt := buf[:ReqLen]
+	if ReqLen < 2 {
+		return NewParseError(Pkt, int(ReqLen), "Packet too short")
+	}
+	ReqData.OPcode = binary.BigEndian.Uint16(buf[0:2]) //opcode
+	if ReqData.OPcode == 0 || ReqData.OPcode > ERROR {
+		return NewParseError(Pkt, 0, "Illegal opcode")
+	}
+	if ReqData.OPcode != RRQ && ReqData.OPcode != WRQ { //other packets have no file name and mode
+		return nil
+	}
+	pos := strings.IndexByte(string(buf[2:ReqLen]), 0x00)
+	switch { //file name and mode must be null terminated
+	case pos < 0:
+		return NewParseError(Pkt, int(ReqLen), "Malformed request")
+	case int(ReqLen) < pos+4: //no mode after file name
+		return NewParseError(Pkt, pos+3, "Malformed request")
+	case buf[ReqLen-1] != 0x00:
+		return NewParseError(Pkt, int(ReqLen)-1, "Malformed request")
+	}
+	ReqData.FileName = string(buf[2 : pos+2]) // extracting file name
+	Fields := strings.Split(string(buf[pos+3:ReqLen-1]), "\x00")
+	ReqData.Mode = Fields[0] // extracting operating mode.
+
+	//limiting options so abusive request can not make huge options map
+	OptionsStart := pos + 3 + len(ReqData.Mode) + 1
+	if len(Fields)-1 > 2**MaxOptions {
+		return NewParseError(Pkt, OptionsStart, "Too many options")
+	}
+	if OptionsLen := int(ReqLen) - OptionsStart; OptionsLen > *MaxOptionsLength {
+		return NewParseError(Pkt, OptionsStart, "Options too long")
+	}
+	ReqData.Options = make(map[string]string) // extracting options. They come as name and value pairs after mode
+	for i := 1; i+1 < len(Fields); i = i + 2 {
+		ReqData.Options[strings.ToLower(Fields[i])] = Fields[i+1]
+	}
+	return nil
+}
+
+/**
+* @brief : Function to handle transfer mode of request. Mode not defined by RFC 1350 is rejected
+*          or coerced to octet as set by -unknown-mode.
+* @param : ReqData: parsed read/write request
+ */
+
+func ApplyModePolicy(ReqData *RequestData) error {
+
+	ReqData.Mode = strings.ToLower(ReqData.Mode) //mode is case insensitive
+	if slices.Contains(RFCModes, ReqData.Mode) {
+		return nil
+	}
+	if *UnknownMode == "reject" {
+		return errors.New("Unknown transfer mode")
+	}
+	fmt.Println("\n==== Unknown mode [", ReqData.Mode, "] served as octet")
+	ReqData.Mode = "octet"
+	return nil
+}
+
+// server limits applied to options requested by client. Taken from command line by FlagNegotiationConfig
+type NegotiationConfig struct {
+	MinBlksize             int // smaller blksize is raised to this value
+	MaxUnfragmentedBlksize int // bigger blksize is lowered to this value (not applied if 0)
+	MaxWindowsize          int // biggest windowsize of transfer
+	RateLimitBps           int // server rate limit in bytes per second (unlimited if 0)
+}
+
+// result of option negotiation of transfer
+type NegotiatedOptions struct {
+	Blksize    int               // size of DATA block
+	Timeout    time.Duration     // retransmission timeout. Not negotiable, always TIMEOUT seconds
+	Windowsize int               // blocks sent before ACK is expected
+	Tsize      int64             // size of uploaded file given by client (-1 if not given)
+	RateLimit  int               // bytes per second (unlimited if 0)
+	Deadline   time.Duration     // longest time transfer may take (unlimited if 0)
+	Compress   string            // compression of read data on wire ("gzip"). Empty if data is sent as stored
+	Accepted   map[string]string // options sent to client in OACK. Also holds options without own field (ex. pw, mtime)
+	Malformed  []string          // names of options understood by server but ignored for invalid value
+}
+
+/**
+* @brief : Function to get negotiation limits given on command line.
+ */
+
+func FlagNegotiationConfig() NegotiationConfig {
+
+	return NegotiationConfig{
+		MinBlksize:             *MinBlksize,
+		MaxUnfragmentedBlksize: *MaxUnfragmentedBlksize,
+		MaxWindowsize:          *MaxWindowsize,
+		RateLimitBps:           *RateLimitBps,
+	}
+}
+
+/**
+* @brief : Function to decide which of the requested options are accepted by server.
+*          Returns values used by transfer and OACK packet of accepted options, or nil if
+*          no option is accepted and transfer starts without OACK. Options depending on
+*          file (stat, resume) are added by read handler which builds OACK again.
+* @param : ReqData: Request iformation
+* @param : Config : server limits
+ */
+
+func Negotiate(ReqData *RequestData, Config NegotiationConfig) (NegotiatedOptions, []byte) {
+
+	Negotiated := NegotiatedOptions{
+		Blksize:    int(FILEBLOCKSIZE),
+		Timeout:    TIMEOUT * time.Second,
+		Windowsize: 1,
+		Tsize:      -1,
+		RateLimit:  max(Config.RateLimitBps, 0),
+		Accepted:   make(map[string]string),
+	}
+	Accepted := Negotiated.Accepted
+
+	//blksize (RFC 2348). Block size smaller than configured minimum is raised to minimum
+	//so clients can not force huge number of round trips with tiny blocks.
+	if Value, ok := ReqData.Options["blksize"]; ok {
+		BlockSize, err := strconv.Atoi(Value)
+		if err == nil && BlockSize >= MINBLKSIZE {
+			if BlockSize > MAXBLKSIZE {
+				BlockSize = MAXBLKSIZE
+			}
+			if Config.MaxUnfragmentedBlksize > 0 && BlockSize > Config.MaxUnfragmentedBlksize { //DATA packet fits in one datagram
+				BlockSize = Config.MaxUnfragmentedBlksize
+			}
+			if BlockSize < Config.MinBlksize {
+				BlockSize = Config.MinBlksize
+			}
+			Negotiated.Blksize = BlockSize
+			Accepted["blksize"] = strconv.Itoa(BlockSize)
+		} else {
+			Negotiated.Malformed = append(Negotiated.Malformed, "blksize")
+		}
+	}
+
+	//windowsize (RFC 7440). Server may reply smaller window size than requested. Reads send window
+	//of blocks before waiting for ACK and uploads are acknowledged once per window.
+	if Value, ok := ReqData.Options["windowsize"]; ok {
+		WindowSize, err := strconv.Atoi(Value)
+		if err == nil && WindowSize >= 1 && WindowSize <= 65535 {
+			Negotiated.Windowsize = min(WindowSize, max(Config.MaxWindowsize, 1))
+			Accepted["windowsize"] = strconv.Itoa(Negotiated.Windowsize)
+		} else {
+			Negotiated.Malformed = append(Negotiated.Malformed, "windowsize")
+		}
+	}
+
+	//ratelimit (bytes per second). Client can ask for slower transfer than server limit but not faster.
+	//Tiny rate is raised to minimum so client can not hold worker for hours.
+	if Value, ok := ReqData.Options["ratelimit"]; ok {
+		Rate, err := strconv.Atoi(Value)
+		if err == nil && Rate > 0 {
+			if Rate < MINRATELIMIT {
+				Rate = MINRATELIMIT
+			}
+			if Config.RateLimitBps > 0 && Rate > Config.RateLimitBps {
+				Rate = Config.RateLimitBps
+			}
+			Negotiated.RateLimit = Rate
+			Accepted["ratelimit"] = strconv.Itoa(Rate)
+		} else {
+			Negotiated.Malformed = append(Negotiated.Malformed, "ratelimit")
+		}
+	}
+
+	//deadline (seconds). Transfer not completed within this time is aborted with error
+	if Value, ok := ReqData.Options["deadline"]; ok {
+		Seconds, err := strconv.Atoi(Value)
+		if err == nil && Seconds > 0 {
+			Negotiated.Deadline = time.Duration(Seconds) * time.Second
+			Accepted["deadline"] = strconv.Itoa(Seconds)
+		} else {
+			Negotiated.Malformed = append(Negotiated.Malformed, "deadline")
+		}
+	}
+
+	//compress. Client decompresses data of read. Only clients asking for it get compressed data
+	if Value, ok := ReqData.Options["compress"]; ok && ReqData.OPcode == RRQ {
+		if strings.ToLower(Value) == "gzip" {
+			Negotiated.Compress = "gzip"
+			Accepted["compress"] = "gzip"
+		} else {
+			Negotiated.Malformed = append(Negotiated.Malformed, "compress")
+		}
+	}
+
+	if ReqData.OPcode == WRQ { //options describing uploaded file
+		if _, ok := ReqData.Options["pw"]; ok { //file will be protected by password
+			Accepted["pw"] = "1"
+		}
+		if _, ok := ReqData.Options["pinned"]; ok { //file will not be removed automatically
+			Accepted["pinned"] = "1"
+		}
+		//mtime (unix seconds). Stored file of same name is overwritten only if it is older than uploaded one
+		if Value, ok := ReqData.Options["mtime"]; ok {
+			if _, err := strconv.ParseInt(Value, 10, 64); err == nil {
+				Accepted["mtime"] = Value
+			} else {
+				Negotiated.Malformed = append(Negotiated.Malformed, "mtime")
+			}
+		}
+		//maxreads. File can be read completely only this many times
+		if Value, ok := ReqData.Options["maxreads"]; ok {
+			if Count, err := strconv.ParseInt(Value, 10, 64); err == nil && Count > 0 {
+				Accepted["maxreads"] = Value
+			} else {
+				Negotiated.Malformed = append(Negotiated.Malformed, "maxreads")
+			}
+		}
+		//tsize (RFC 2349). Size of uploaded file given by client tells whether short block is really last block
+		if Value, ok := ReqData.Options["tsize"]; ok {
+			if Size, err := strconv.ParseInt(Value, 10, 64); err == nil && Size >= 0 {
+				Negotiated.Tsize = Size
+				Accepted["tsize"] = Value
+			} else {
+				Negotiated.Malformed = append(Negotiated.Malformed, "tsize")
+			}
+		}
+		//content type is kept with file and reported by stat option and HTTP gateway
+		if Value, ok := ReqData.Options["contenttype"]; ok {
+			Accepted["contenttype"] = Value
+		}
+	}
+	if len(Accepted) == 0 {
+		return Negotiated, nil
+	}
+	return Negotiated, MakeOACKPacket(Accepted)
+}
+
+/**
+* @brief : Function to log option negotiation of transfer for debugging of client interop.
+*          Each requested option is logged with value accepted in OACK and reason if
+*          value was changed or option was ignored.
+* @param : ReqData : Request iformation
+* @param : Negotiated : result of negotiation
+ */
+
+func LogNegotiation(ReqData *RequestData, Negotiated NegotiatedOptions) {
+
+	Names := make([]string, 0, len(ReqData.Options))
+	for Name := range ReqData.Options {
+		Names = append(Names, Name)
+	}
+	sort.Strings(Names)
+	fmt.Println("\n==== Negotiation for :[", ReqData.FileName, "] client :[", ReqData.ClientAddr, "] mode :[", ReqData.Mode, "]")
+	for _, Name := range Names {
+		Requested := ReqData.Options[Name]
+		Accepted, ok := Negotiated.Accepted[Name]
+		Reason := "accepted"
+		switch {
+		case !ok && slices.Contains(Negotiated.Malformed, Name):
+			Reason = "ignored (invalid value)"
+		case !ok:
+			Reason = "ignored (not supported)"
+		case Accepted == Requested:
+		case Name == "blksize" && Accepted == strconv.Itoa(*MinBlksize):
+			Reason = "raised to -min-blksize"
+		case Name == "blksize" && Accepted == strconv.Itoa(*MaxUnfragmentedBlksize):
+			Reason = "lowered to -max-unfragmented-blksize"
+		case Name == "blksize":
+			Reason = "lowered to maximum blksize"
+		case Name == "windowsize":
+			Reason = "lowered to -max-windowsize"
+		case Name == "ratelimit" && Accepted == strconv.Itoa(MINRATELIMIT):
+			Reason = "raised to minimum ratelimit"
+		case Name == "ratelimit":
+			Reason = "lowered to -rate-limit-bps"
+		default:
+			Reason = "answered by server"
+		}
+		if Name == "pw" { //password must not get in log
+			Requested = "<redacted>"
+		}
+		fmt.Printf("     option %s : requested %q accepted %q : %s\n", Name, Requested, Accepted, Reason)
+	}
+	Rate := "unlimited"
+	if Negotiated.RateLimit > 0 {
+		Rate = strconv.Itoa(Negotiated.RateLimit)
+	}
+	fmt.Println("     effective blksize :", Negotiated.Blksize, "timeout :", Negotiated.Timeout, "windowsize :", Negotiated.Windowsize, "ratelimit :", Rate)
+}
+
+/**
+* @brief : Function to get block size of transfer from accepted options.
+* @param : Options : accepted options
+ */
+
+func NegotiatedBlockSize(Options map[string]string) int {
+
+	if BlockSize, err := strconv.Atoi(Options["blksize"]); err == nil {
+		return BlockSize
+	}
+	return int(FILEBLOCKSIZE)
+}
+
+/**
+* @brief : Function to get context of transfer limited by deadline option. Returned function
+*          releases context and must be called when transfer ends.
+* @param : Ctx : context of transfer
+ */
+
+func (Negotiated NegotiatedOptions) WithDeadline(Ctx context.Context) (context.Context, context.CancelFunc) {
+
+	if Negotiated.Deadline > 0 {
+		return context.WithTimeout(Ctx, Negotiated.Deadline)
+	}
+	return Ctx, func() {}
+}
+
+/**
+* @brief : Function to get rate limiter of transfer. Returns nil if transfer is not limited.
+ */
+
+func (Negotiated NegotiatedOptions) RateLimiter() *RateLimiter {
+
+	if Negotiated.RateLimit <= 0 {
+		return nil
+	}
+	return &RateLimiter{Rate: Negotiated.RateLimit, Start: time.Now()}
+}
+
+// paces transfer so it does not go faster than given bytes per second
+type RateLimiter struct {
+	Rate  int       // bytes per second
+	Start time.Time // start of transfer
+	Bytes int64     // bytes transferred since start
+}
+
+/**
+* @brief : Function to wait until given bytes can be transferred without going over rate.
+*          Returns at once when transfer is cancelled or its deadline is over, so cancel is
+*          reported by next receive of transfer.
+* @param : Ctx : context of transfer
+* @param : Bytes : bytes to transfer
+ */
+
+func (Limiter *RateLimiter) Wait(Ctx context.Context, Bytes int) {
+
+	if Limiter == nil {
+		return
+	}
+	Limiter.Bytes = Limiter.Bytes + int64(Bytes)
+	Due := Limiter.Start.Add(time.Duration(Limiter.Bytes * int64(time.Second) / int64(Limiter.Rate)))
+	Timer := time.NewTimer(time.Until(Due))
+	defer Timer.Stop()
+	select {
+	case <-Timer.C:
+	case <-Ctx.Done():
+	}
+}
+
+/**
+* @brief : Function to get metadata of file reported by "stat" option. Client requesting
+*          "stat" option gets these values in OACK followed by empty DATA packet instead of file data.
+* @param : File : stored file
+ */
+
+func FileMetadata(File *FileEntry) map[string]string {
+
+	CRC := crc32.NewIEEE()
+	for e := File.Blocks.Front(); e != nil; e = e.Next() {
+		CRC.Write(e.Value.([]byte))
+	}
+	ContentType := File.ContentType
+	if ContentType == "" {
+		ContentType = DEFAULTCONTENTTYPE
+	}
+	return map[string]string{
+		"contenttype": ContentType,
+		"stat":        "1",
+		"size":        strconv.Itoa(File.Size),
+		"crc32":       fmt.Sprintf("%08x", CRC.Sum32()),
+		"mtime":       strconv.FormatInt(File.ModTime.Unix(), 10),
+		"reads":       strconv.FormatInt(File.Reads.Load(), 10),
+	}
+}
+
+/**
+* @brief : Function to send Error packet to client
+* @param : ErrNo : Error Number
+* @param : ErrStr : Error string associated with that error number
+* @param : conn : client connection
+ */
+
+func SendErrorPacket(ErrNo uint16, ErrStr string, Conn net.Conn) {
+
+	fmt.Println("\n==== Error packet ===== ", ErrStr)
+	_, err := Conn.Write(MakeErrorPacket(ErrNo, ErrStr)) //writing Error packet to client
+	if err != nil {
+		fmt.Println("Error: ", err)
+		return
+	}
+}
+
+/**
+* @brief : Function to send Error packet to client from not connected socket (ex. listening socket)
+* @param : ErrNo : Error Number
+* @param : ErrStr : Error string associated with that error number
+* @param : conn : socket to send from
+* @param : Addr : client address
+ */
+
+func SendErrorPacketTo(ErrNo uint16, ErrStr string, Conn net.PacketConn, Addr net.Addr) {
+
+	fmt.Println("\n==== Error packet ===== ", ErrStr)
+	_, err := Conn.WriteTo(MakeErrorPacket(ErrNo, ErrStr), Addr) //writing Error packet to client
+	if err != nil {
+		fmt.Println("Error: ", err)
+		return
+	}
+}
+
+/**
+* @brief : Function to build Error packet
+* @param : ErrNo : Error Number
+* @param : ErrStr : Error string associated with that error number
+ */
+
+func MakeErrorPacket(ErrNo uint16, ErrStr string) []byte {
+
+	var ErrPkt []byte = make([]byte, 5+len(ErrStr))
+	offset := 0
+	binary.BigEndian.PutUint16(ErrPkt[offset:], ERROR) //setting OPCODE as ERROR
+	offset = offset + 2
+	binary.BigEndian.PutUint16(ErrPkt[offset:], ErrNo) //setting Error no
+	offset = offset + 2
+	copy(ErrPkt[offset:], ErrStr) //setting error string
+	offset = offset + len(ErrStr)
+	ErrPkt[offset] = 0x00
+	return ErrPkt
+}
+
+/**
+* @brief : Function to open connection of transfer of a request. With -single-port it is
+*          connection multiplexed on listening socket, else new socket of its own. With -single-port
+*          client having transfer in progress (ex. dallying) gets busy error from listening socket.
+* @param : ReqData : Request iformation
+ */
+
+func OpenTransferConn(ReqData *RequestData) (net.Conn, error) {
+
+	if ReqData.Mux != nil {
+		Conn, err := ReqData.Mux.Open(ReqData.ClientAddr)
+		if err != nil { //client is told instead of retrying until timeout
+			SendErrorPacketTo(UNKNOWNERROR, SERVERBUSYMSG, ReqData.Mux.Conn, ReqData.ClientAddr)
+			return nil, err
+		}
+		return Conn, nil
+	}
+	Conn, err := NewTransferConn(ReqData.ClientAddr)
+	if err != nil { //nil socket must not be returned as non nil interface
+		return nil, err
+	}
+	return Conn, nil
+}
+
+/**
+* @brief : Function to create socket for transfer of a request.
+*          after intial request we will use different local port(TID) to do further data
+*          transfer so creating new address with different port and connecting to client.
+* @param : ClientAddr : client address
+ */
+
+func NewTransferConn(ClientAddr *net.UDPAddr) (*net.UDPConn, error) {
+
+	if TransferPortLow == 0 { //any free port
+		return DialTransferConn(ClientAddr, 0)
+	}
+	//trying ports of range one by one. Start is moved for each transfer so busy ports are not tried first always
+	Count := TransferPortHigh - TransferPortLow + 1
+	Start := int(NextTransferPort.Add(1))
+	for i := 0; i < Count; i++ {
+		Port := TransferPortLow + (Start+i)%Count
+		Conn, err := DialTransferConn(ClientAddr, Port)
+		if errors.Is(err, syscall.EADDRINUSE) {
+			continue
+		}
+		return Conn, err
+	}
+	return nil, fmt.Errorf("no free port in transfer port range %d-%d", TransferPortLow, TransferPortHigh)
+}
+
+/**
+* @brief : Function to create socket bound to given local port and connected to client.
+* @param : ClientAddr : client address
+* @param : Port : local port. Any free port is used if 0
+ */
+
+func DialTransferConn(ClientAddr *net.UDPAddr, Port int) (*net.UDPConn, error) {
+
+	Dialer := net.Dialer{LocalAddr: &net.UDPAddr{Port: Port}}
+	if *DSCP > 0 && TOSSupported { //marking outgoing packets with DSCP value
+		Dialer.Control = func(Network string, Address string, RawConn syscall.RawConn) error {
+			return SetSocketTOS(Network, RawConn, *DSCP<<2)
+		}
+	}
+	Conn, err := Dialer.Dial("udp", ClientAddr.String())
+	if err != nil {
+		return nil, err
+	}
+	return Conn.(*net.UDPConn), nil
+}
+
+/**
+* @brief : Function to parse port range given as "low-high".
+* @param : Value : port range
+ */
+
+func ParsePortRange(Value string) (int, int, error) {
+
+	LowStr, HighStr, ok := strings.Cut(Value, "-")
+	if !ok {
+		return 0, 0, errors.New("port range must be given as low-high")
+	}
+	Low, err := strconv.Atoi(LowStr)
+	if err != nil {
+		return 0, 0, err
+	}
+	High, err := strconv.Atoi(HighStr)
+	if err != nil {
+		return 0, 0, err
+	}
+	if Low < 1 || High > 65535 || Low > High {
+		return 0, 0, errors.New("port range must be within [1:65535] and low must not be more than high")
+	}
+	return Low, High, nil
+}
+
+// transfers of -single-port mode sharing one listening socket. Packets from client of transfer
+// in progress are routed to it by client address and all its packets are sent from listening port.
+type PortMux struct {
+	Conn    net.PacketConn
+	Lock    sync.Mutex
+	Clients map[string]*MuxConn // transfer in progress by client address
+}
+
+func NewPortMux(Conn net.PacketConn) *PortMux {
+
+	return &PortMux{Conn: Conn, Clients: make(map[string]*MuxConn)}
+}
+
+/**
+* @brief : Function to register transfer of client. Client can have only one transfer at a time
+*          as its packets are told apart only by its address.
+* @param : ClientAddr : client address
+ */
+
+func (Mux *PortMux) Open(ClientAddr *net.UDPAddr) (*MuxConn, error) {
+
+	Mux.Lock.Lock()
+	defer Mux.Lock.Unlock()
+	if _, Busy := Mux.Clients[ClientAddr.String()]; Busy {
+		return nil, errors.New("transfer of client already in progress")
+	}
+	Conn := &MuxConn{Mux: Mux, Addr: ClientAddr, Packets: make(chan []byte, 16), Wake: make(chan struct{}), Closed: make(chan struct{})}
+	Mux.Clients[ClientAddr.String()] = Conn
+	return Conn, nil
+}
+
+/**
+* @brief : Function to route DATA, ACK or ERROR packet received on listening socket to transfer
+*          of its client. Returns false if client has no transfer in progress. Packet is dropped
+*          if transfer does not read fast enough, same as with its own socket.
+* @param : ClientAddr : client address
+* @param : Pkt : received packet. It is copied
+ */
+
+func (Mux *PortMux) Deliver(ClientAddr *net.UDPAddr, Pkt []byte) bool {
+
+	Mux.Lock.Lock()
+	Conn, ok := Mux.Clients[ClientAddr.String()]
+	Mux.Lock.Unlock()
+	if !ok {
+		return false
+	}
+	select {
+	case Conn.Packets <- append([]byte(nil), Pkt...):
+	default:
+	}
+	return true
+}
+
+// connection of one transfer on listening socket of -single-port mode
+type MuxConn struct {
+	Mux     *PortMux
+	Addr    *net.UDPAddr
+	Packets chan []byte // packets of client routed by PortMux
+
+	Lock     sync.Mutex
+	Deadline time.Time     // read deadline. No deadline if zero
+	Wake     chan struct{} // closed when deadline changes so blocked Read picks new one
+	Closed   chan struct{}
+	Once     sync.Once
+}
+
+func (Conn *MuxConn) Read(Buf []byte) (int, error) {
+
+	for {
+		Conn.Lock.Lock()
+		Deadline, Wake := Conn.Deadline, Conn.Wake
+		Conn.Lock.Unlock()
+		Wait := time.Duration(math.MaxInt64) //no deadline
+		if !Deadline.IsZero() {
+			Wait = time.Until(Deadline)
+			if Wait <= 0 {
+				return 0, os.ErrDeadlineExceeded
+			}
+		}
+		Timer := time.NewTimer(Wait)
+		select {
+		case Pkt := <-Conn.Packets:
+			Timer.Stop()
+			return copy(Buf, Pkt), nil
+		case <-Timer.C:
+			return 0, os.ErrDeadlineExceeded
+		case <-Conn.Closed:
+			Timer.Stop()
+			return 0, net.ErrClosed
+		case <-Wake: //deadline changed
+			Timer.Stop()
+		}
+	}
+}
+
+func (Conn *MuxConn) Write(Pkt []byte) (int, error) {
+
+	return Conn.Mux.Conn.WriteTo(Pkt, Conn.Addr)
+}
+
+func (Conn *MuxConn) Close() error {
+
+	Conn.Once.Do(func() {
+		Conn.Mux.Lock.Lock()
+		delete(Conn.Mux.Clients, Conn.Addr.String())
+		Conn.Mux.Lock.Unlock()
+		close(Conn.Closed)
+	})
+	return nil
+}
+
+func (Conn *MuxConn) SetReadDeadline(Deadline time.Time) error {
+
+	Conn.Lock.Lock()
+	Conn.Deadline = Deadline
+	close(Conn.Wake)
+	Conn.Wake = make(chan struct{})
+	Conn.Lock.Unlock()
+	return nil
+}
+
+func (Conn *MuxConn) SetDeadline(Deadline time.Time) error { return Conn.SetReadDeadline(Deadline) }
+func (Conn *MuxConn) SetWriteDeadline(time.Time) error     { return nil }
+func (Conn *MuxConn) LocalAddr() net.Addr                  { return Conn.Mux.Conn.LocalAddr() }
+func (Conn *MuxConn) RemoteAddr() net.Addr                 { return Conn.Addr }
+
+// compiled -filename-pattern. Nil if all names are allowed
+var FilenameRegexp *regexp.Regexp
+
+// local port range of transfer sockets given by -transfer-port-range. Any free port is used if 0
+var TransferPortLow, TransferPortHigh int
+var NextTransferPort atomic.Int64
+
+/**
+* @brief : Function to create packet exchange of a transfer
+* @param : Srv : server giving clock for timeouts
+* @param : Ctx : context. Transfer is cancelled when it is cancelled
+* @param : Conn : transfer socket connected to client
+* @param : RecvSize : biggest packet expected from client
+* @param : Timeout : time to wait for answer before sending packet again
+ */
+
+func (Srv *Server) NewTransfer(Ctx context.Context, Conn net.Conn, RecvSize int, Timeout time.Duration) *Transfer {
+
+	context.AfterFunc(Ctx, func() { //waking up Receive waiting for client
+		Conn.SetReadDeadline(time.Now())
+	})
+	return &Transfer{Srv: Srv, Ctx: Ctx, Conn: Conn, RecvBuf: make([]byte, RecvSize), Timeout: Timeout, StartedAt: Srv.Now()}
+}
+
+// lock-step packet exchange of transfer shared by read and write requests. Each packet (or
+// window of packets) sent is answered by client. Last packets are sent again if answer does
+// not arrive in time.
+type Transfer struct {
+	Srv     *Server
+	Ctx     context.Context
+	Conn    net.Conn
+	LastPkt []byte   // last packet sent. It is resent on timeout
+	Window  [][]byte // packets of window sent before LastPkt. They are resent with it on timeout
+	RecvBuf []byte
+	Retries int // number of times LastPkt is resent
+
+	Gap       time.Duration // minimum gap between packets of one window (-inter-packet-delay of read). No gap if 0
+	WrittenAt time.Time     // time when last packet was written. Used for Gap
+
+	Retransmits int           // number of packets resent during whole transfer
+	Timeout     time.Duration // wait for answer before LastPkt is resent
+	StartedAt   time.Time     // time when transfer started
+	SentAt      time.Time     // time when LastPkt was sent first time
+}
+
+var ErrTransferTimeout = errors.New("no answer from client")
+var ErrClientError = errors.New("error received from client")
+var ErrTransferCancelled = errors.New("transfer cancelled")
+var ErrTransferDeadline = errors.New("transfer deadline exceeded")
+
+/**
+* @brief : Function to send packet to client and remember it for resending
+* @param : Pkt : packet to send
+ */
+
+func (T *Transfer) Send(Pkt []byte) error {
+
+	T.LastPkt, T.Window = Pkt, nil
+	T.Retries = 0
+	T.SentAt = T.Srv.Now()
+	return T.Write(Pkt, false)
+}
+
+/**
+* @brief : Function to send window of packets to client and remember them for resending.
+*          Client answers last packet of window.
+* @param : Pkts : packets to send
+ */
+
+func (T *Transfer) SendWindow(Pkts [][]byte) error {
+
+	T.LastPkt, T.Window = Pkts[len(Pkts)-1], Pkts[:len(Pkts)-1]
+	T.Retries = 0
+	T.SentAt = T.Srv.Now()
+	for i, Pkt := range Pkts {
+		if err := T.Write(Pkt, i > 0); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+/**
+* @brief : Function to write packet, keeping Gap after previous packet for packets inside window.
+*          Packet is not written if transfer is cancelled meanwhile, cancel is reported by next receive.
+* @param : Pkt : packet to write
+* @param : Spaced : true if packet follows another one of same window
+ */
+
+func (T *Transfer) Write(Pkt []byte, Spaced bool) error {
+
+	if Spaced && T.Gap > 0 {
+		Timer := time.NewTimer(time.Until(T.WrittenAt.Add(T.Gap)))
+		defer Timer.Stop()
+		select {
+		case <-Timer.C:
+		case <-T.Ctx.Done():
+			return nil
+		}
+	}
+	_, err := T.Conn.Write(Pkt)
+	T.WrittenAt = time.Now()
+	return err
+}
+
+/**
+* @brief : Function to change packet sent again on timeout without sending it now (ex. ACK of
+*          block in middle of window which is sent only if rest of window does not arrive).
+* @param : Pkt : packet to send on timeout
+ */
+
+func (T *Transfer) Defer(Pkt []byte) {
+
+	T.LastPkt, T.Window = Pkt, nil
+	T.Retries = 0
+	T.SentAt = T.Srv.Now()
+}
+
+/**
+* @brief : Function to describe packet expected from client as answer to last packet sent.
+ */
+
+func (T *Transfer) Awaited() string {
+
+	if len(T.LastPkt) < 2 {
+		return "none"
+	}
+	switch binary.BigEndian.Uint16(T.LastPkt) {
+	case OACK:
+		return "answer to OACK"
+	case DATA:
+		return "ACK of block " + strconv.Itoa(int(binary.BigEndian.Uint16(T.LastPkt[2:])))
+	case ACK:
+		return "DATA block " + strconv.Itoa(int(binary.BigEndian.Uint16(T.LastPkt[2:])+1))
+	}
+	return "none"
+}
+
+/**
+* @brief : Function to end transfer which is cancelled or whose deadline is over. Client is
+*          sent error telling why. Returns nil if transfer can go on.
+ */
+
+func (T *Transfer) Stopped() error {
+
+	if errors.Is(T.Ctx.Err(), context.DeadlineExceeded) { //time given by deadline option is over
+		SendErrorPacket(UNKNOWNERROR, DEADLINEMSG, T.Conn)
+		return ErrTransferDeadline
+	}
+	if T.Ctx.Err() != nil { //transfer cancelled by admin
+		SendErrorPacket(UNKNOWNERROR, CANCELLEDMSG, T.Conn)
+		return ErrTransferCancelled
+	}
+	return nil
+}
+
+/**
+* @brief : Function to receive next packet from client. Last packet sent (with rest of its
+*          window) is sent again on timeout for 3 times before giving up.
+ */
+
+func (T *Transfer) Receive() ([]byte, error) {
+
+	TempErrors := 0
+	for {
+		if err := T.Stopped(); err != nil {
+			return nil, err
+		}
+		ByteRead, err := T.ReadTimeout(T.Timeout)
+		if err != nil && IsTemporary(err) && TempErrors < 3 { //transient condition of busy system. EAGAIN also reports Timeout() so it is checked first
+			TempErrors = TempErrors + 1
+			time.Sleep(10 * time.Millisecond)
+			continue
+		}
+		if err != nil {
+			TimeoutErr, Status := err.(net.Error)
+			if Status && TimeoutErr.Timeout() && T.Ctx.Err() != nil { //read is interrupted by cancel
+				continue
+			}
+			if Status && TimeoutErr.Timeout() { //if timeout occured then try again to read
+				if T.Retries >= 3 { // if retry count is reached to limit then return
+					//silent time close to elapsed time means client never answered, shorter one means link broke during transfer
+					Now := T.Srv.Now()
+					fmt.Println("\n==== TIMEOUT in Reading from client :[", T.Conn.RemoteAddr(), "] awaiting :", T.Awaited(), "retries :", T.Retries,
+						"timeout :", T.Timeout, "silent for :", Now.Sub(T.SentAt).Round(time.Millisecond), "elapsed :", Now.Sub(T.StartedAt).Round(time.Millisecond))
+					return nil, ErrTransferTimeout
+				}
+				T.Retries = T.Retries + 1
+				T.Retransmits = T.Retransmits + len(T.Window) + 1
+				for i, Pkt := range T.Window { //whole window is sent again as client answers only its last packet
+					if err = T.Write(Pkt, i > 0); err != nil {
+						return nil, err
+					}
+				}
+				if err = T.Write(T.LastPkt, len(T.Window) > 0); err != nil { //sending packet again may be it get lost.
+					return nil, err
+				}
+				continue
+			}
+			if IsUnreachable(err) { //ICMP unreachable received so client is gone. No need to wait for it
+				fmt.Println("\n==== Client unreachable :[", T.Conn.RemoteAddr(), "]")
+				return nil, err
+			}
+			//if other error occured then send error message and discard this request
+			SendErrorPacket(UNKNOWNERROR, "Error not able to receive packet at server from client", T.Conn)
+			return nil, err
+		}
+		if ByteRead < 4 { //packet without opcode and block number is ignored
+			continue
+		}
+		if binary.BigEndian.Uint16(T.RecvBuf) == ERROR { // if opcode is error then stop this request and discard it
+			fmt.Println("Error received from client")
+			return nil, ErrClientError
+		}
+		return T.RecvBuf[:ByteRead], nil
+	}
+}
+
+/**
+* @brief : Function to read packet from client waiting at most Timeout by server clock. Socket
+*          deadline is compared with real time by OS, so with injected clock socket has no
+*          deadline and wait is ended by moving deadline to now when timer of clock fires.
+* @param : Timeout : longest wait
+ */
+
+func (T *Transfer) ReadTimeout(Timeout time.Duration) (int, error) {
+
+	if T.Srv.Clock == nil {
+		T.Conn.SetReadDeadline(time.Now().Add(Timeout))
+		return T.Conn.Read(T.RecvBuf)
+	}
+	T.Conn.SetReadDeadline(time.Time{})
+	Done := make(chan struct{})
+	Stopped := make(chan struct{})
+	go func() {
+		defer close(Stopped)
+		select {
+		case <-T.Srv.Clock.After(Timeout):
+			T.Conn.SetReadDeadline(time.Now())
+		case <-T.Ctx.Done(): //cancel arriving before deadline was cleared is not lost
+			T.Conn.SetReadDeadline(time.Now())
+		case <-Done:
+		}
+	}()
+	ByteRead, err := T.Conn.Read(T.RecvBuf)
+	close(Done)
+	<-Stopped //late timer must not cut next read short
+	return ByteRead, err
+}
+
+/**
+* @brief : Function to stay ready for one timeout period after final ACK of read transfer.
+*          Duplicate ACK of block before last one means client may not have final block
+*          so last packet is sent again. Other packets are ignored.
+* @param : Prior : block number before final block
+ */
+
+func (T *Transfer) Dally(Prior uint16) {
+
+	Deadline := T.Srv.Now().Add(T.Timeout)
+	for T.Ctx.Err() == nil {
+		Remaining := Deadline.Sub(T.Srv.Now())
+		if Remaining <= 0 {
+			return
+		}
+		ByteRead, err := T.ReadTimeout(Remaining)
+		if err != nil {
+			if IsTemporary(err) {
+				continue
+			}
+			return
+		}
+		if ByteRead >= 4 && binary.BigEndian.Uint16(T.RecvBuf) == ACK && binary.BigEndian.Uint16(T.RecvBuf[2:]) == Prior {
+			T.Retransmits = T.Retransmits + 1
+			T.Write(T.LastPkt, false)
+		}
+	}
+}
+
+/**
+* @brief : Function to check error of connected socket is caused by ICMP port/host unreachable
+*          received from client side.
+* @param : err : socket error
+ */
+
+func IsUnreachable(err error) bool {
+
+	return errors.Is(err, syscall.ECONNREFUSED) || errors.Is(err, syscall.EHOSTUNREACH) || errors.Is(err, syscall.ENETUNREACH)
+}
+
+/**
+* @brief : Function to check error of socket is transient so operation can be tried again.
+* @param : err : socket error
+ */
+
+func IsTemporary(err error) bool {
+
+	return errors.Is(err, syscall.EAGAIN) || errors.Is(err, syscall.EINTR) || errors.Is(err, syscall.ENOBUFS) || errors.Is(err, syscall.ENOMEM)
+}
+
+/**
+* @brief : Function to map error of storage producing file content to TFTP error code.
+*          Error message is OS error text so client sees what failed.
+* @param : err : storage error
+ */
+
+func StorageErrorCode(err error) uint16 {
+
+	switch {
+	case errors.Is(err, syscall.ENOSPC):
+		return DISKFULL
+	case errors.Is(err, fs.ErrPermission):
+		return ACCESSVIOLATION
+	case errors.Is(err, fs.ErrNotExist):
+		return FILENOTFOUND
+	}
+	return UNKNOWNERROR
+}
+
+/**
+* @brief : Function to run transfer till its end. Handle is called with each packet received
+*          and gives packet to send in answer (nil for none), whether transfer is finished and
+*          error stopping the transfer. Handle sends error packet to client itself if needed.
+* @param : First : first packet sent to client
+* @param : Handle : direction specific handling of received packets
+ */
+
+func (T *Transfer) Run(First []byte, Handle func(Pkt []byte) ([]byte, bool, error)) error {
+
+	if err := T.Send(First); err != nil {
+		return err
+	}
+	for {
+		Pkt, err := T.Receive()
+		if err != nil {
+			return err
+		}
+		Next, Done, err := Handle(Pkt)
+		if err != nil {
+			return err
+		}
+		if Next != nil {
+			if err = T.Send(Next); err != nil {
+				return err
+			}
+		}
+		if Done {
+			return nil
+		}
+	}
+}
+
+/**
+* @brief : Function to decode DATA packet received from client into block number and data.
+*          Returned data refers to Pkt and it is not copied. Bytes after block size are padding
+*          of client and they are ignored, same as socket receiving into block size buffer does.
+* @param : Pkt : received packet
+* @param : BlockSize : negotiated block size
+ */
+
+func DecodeDataPacket(Pkt []byte, BlockSize int) (uint16, []byte, error) {
+
+	if len(Pkt) < 4 {
+		return 0, nil, errors.New("Packet too short")
+	}
+	if binary.BigEndian.Uint16(Pkt) != DATA {
+		return 0, nil, errors.New("Expected DATA packet")
+	}
+	return binary.BigEndian.Uint16(Pkt[2:]), Pkt[4:min(len(Pkt), BlockSize+4)], nil
+}
+
+/**
+* @brief : Function to decode ACK packet received from client into block number. Packet of
+*          other opcode or shorter than 4 bytes is not ACK. Trailing bytes (padding) are ignored.
+* @param : Pkt : received packet
+ */
+
+func DecodeACKPacket(Pkt []byte) (uint16, bool) {
+
+	if len(Pkt) < 4 || binary.BigEndian.Uint16(Pkt) != ACK {
+		return 0, false
+	}
+	return binary.BigEndian.Uint16(Pkt[2:]), true
+}
+
+/**
+* @brief : Function to build ACK packet
+* @param : BlockNo : Block number to acknoledge
+ */
+
+func MakeACKPacket(BlockNo uint16) []byte {
+
+	ACKPkt := make([]byte, 4)
+	binary.BigEndian.PutUint16(ACKPkt, ACK)         //setting OPCODE as ACK
+	binary.BigEndian.PutUint16(ACKPkt[2:], BlockNo) // setting BLOCK number Acknoledged
+	return ACKPkt
+}
+
+/**
+* @brief : Function to build OACK packet
+* @param : Options : accepted options with its values
+ */
+
+func MakeOACKPacket(Options map[string]string) []byte {
+
+	OACKPkt := make([]byte, 2)
+	binary.BigEndian.PutUint16(OACKPkt, OACK) //setting OPCODE as OACK
+	for Name, Value := range Options {        // setting option name and value as null terminated strings
+		OACKPkt = append(OACKPkt, Name...)
+		OACKPkt = append(OACKPkt, 0x00)
+		OACKPkt = append(OACKPkt, Value...)
+		OACKPkt = append(OACKPkt, 0x00)
+	}
+	return OACKPkt
+}
+
+/**
+* @brief : Function to handle Write Request. This will write data to main mamory not on disk.
+* @param : ReqData: Request iformation
+ */
+
+func (Srv *Server) HandleWriteRequest(ReqData *RequestData) {
+
+	var ACKNo uint16
+	var FileBlocklist *list.List
+	ACKNo = 0 //block number expected next is ACKNo
+	Completed := false
+
+	Stats.ActiveTransfers.Add(1)
+	defer func() { //updating statistics at end of request handling
+		Stats.ActiveTransfers.Add(-1)
+		if Completed {
+			Stats.Writes.Add(1)
+		} else {
+			Stats.Errors.Add(1)
+		}
+	}()
+
+	NewConn, err := OpenTransferConn(ReqData)
+	if err != nil {
+		fmt.Println("Error: ", err)
+		return
+	}
+	defer NewConn.Close() //defering connection close to end of request handling.
+	Status := Srv.StartTransfer(ReqData, "write")
+	defer Srv.EndTransfer(Status)
+
+	FileBlocklist = list.New()
+	Negotiated, First := Negotiate(ReqData, FlagNegotiationConfig())
+	if *StrictNegotiation && len(Negotiated.Malformed) > 0 { //strict client is told instead of option being ignored
+		SendErrorPacket(OPTIONNEGFAILED, OPTIONNEGMSG+": "+strings.Join(Negotiated.Malformed, ", "), NewConn)
+		return
+	}
+	Options := Negotiated.Accepted
+	_, Pinned := Options["pinned"]
+	var ModTime time.Time
+	if Value, ok := Options["mtime"]; ok { //value is already validated
+		Seconds, _ := strconv.ParseInt(Value, 10, 64)
+		ModTime = time.Unix(Seconds, 0)
+	}
+	MaxReads, _ := strconv.ParseInt(Options["maxreads"], 10, 64) //unlimited if not accepted
+	TransferSize := Negotiated.Tsize
+	ReceivedBytes := int64(0)
+	var Arena []byte //blocks of upload with tsize are kept in one buffer allocated in advance
+	if TransferSize > 0 {
+		Arena = make([]byte, 0, min(TransferSize, MAXPREALLOC))
+	}
+	Truncated := -1 //length of last short block ignored as truncated
+	ContentType := Options["contenttype"]
+	StoredName := ReqData.FileName //name of file in FileMap. Client is not told about rewritten name
+	if Srv.RewriteWriteName != nil {
+		StoredName = Srv.RewriteWriteName(ReqData.FileName, ReqData.ClientAddr)
+	}
+	if _, Virtual := Srv.VirtualFiles.Load(ReqData.FileName); Virtual && *VirtualWrites == "reject" { //virtual file has no stored content to replace
+		SendErrorPacket(ACCESSVIOLATION, VIRTUALFILEMSG, NewConn)
+		return
+	}
+	FileMapLock.RLock()
+	Stored, Exists := FileMap[StoredName]
+	FileMapLock.RUnlock()
+	if Exists { //checking file already exists. if yes send error message
+		if ErrNo, ErrMsg := OverwriteError(Stored, ModTime, ReqData.Options); ErrMsg != "" {
+			SendErrorPacket(ErrNo, ErrMsg, NewConn)
+			return
+		}
+	} else if FileLimitReached() { //overwriting existing file does not add new name
+		SendErrorPacket(DISKFULL, MAXFILESMSG, NewConn)
+		return
+	}
+	ClientIP := ReqData.ClientAddr.IP.String()
+	if *UploadQuota > 0 { //upload announced by tsize must fit in quota left
+		if Left := UploadQuotaLeft(ClientIP, Srv.Now()); Left <= 0 || TransferSize > Left {
+			SendErrorPacket(DISKFULL, UPLOADQUOTAMSG, NewConn)
+			return
+		}
+	}
+	LogTransfer("\n==== Write Started for :[", ReqData.FileName, "] stored as :[", StoredName, "]")
+	if First == nil { // OACK is sent in place of first ACK if any option is accepted
+		First = MakeACKPacket(ACKNo)
+	}
+	if *DebugNegotiation {
+		LogNegotiation(ReqData, Negotiated)
+	}
+
+	ACKNo = ACKNo + 1
+	BlockSize := Negotiated.Blksize
+	WindowSize := Negotiated.Windowsize
+	InWindow := 0    //blocks received in current window
+	Rewound := false //ACK of last block received in order is already sent for gap in window
+	Limiter := Negotiated.RateLimiter()
+	Ctx, CancelDeadline := Negotiated.WithDeadline(Status.Ctx)
+	defer CancelDeadline()
+	Transfer := Srv.NewTransfer(Ctx, NewConn, BlockSize+4, Negotiated.Timeout)
+
+	//consuming data blocks received from client
+	err = Transfer.Run(First, func(Pkt []byte) ([]byte, bool, error) {
+		BlockNo, Payload, err := DecodeDataPacket(Pkt, BlockSize)
+		if err != nil {
+			SendErrorPacket(ILLEGALOP, err.Error(), NewConn)
+			return nil, false, err
+		}
+		if BlockNo == ACKNo-1 { //our ACK is lost and client sent same block again
+			return MakeACKPacket(BlockNo), false, nil
+		}
+		//block after the expected one means client skipped data. Block numbers wrap around
+		//so block is in future if it is less than half of number space ahead.
+		if BlockNo-ACKNo > 0 && BlockNo-ACKNo < 0x8000 {
+			if WindowSize > 1 { //block of window is lost. Client sends window again from block after ACK
+				if Rewound {
+					return nil, false, nil
+				}
+				Rewound, InWindow = true, 0
+				return MakeACKPacket(ACKNo - 1), false, nil
+			}
+			fmt.Println("==== Out of order Data Packet received from client ")
+			SendErrorPacket(ILLEGALOP, FUTUREDATAMSG, NewConn)
+			return nil, false, errors.New(FUTUREDATAMSG)
+		}
+		if BlockNo != ACKNo { //older duplicate block is already acknowledged
+			return nil, false, nil
+		}
+		//file can not be bigger than size announced by tsize. Upload is not stored
+		if TransferSize >= 0 && ReceivedBytes+int64(len(Payload)) > TransferSize {
+			SendErrorPacket(ILLEGALOP, TSIZEOVERMSG, NewConn)
+			return nil, false, errors.New(TSIZEOVERMSG)
+		}
+		//short block before end of file given by tsize is truncated (ex. lost IP fragment). It is not
+		//acknowledged so client sends it again when previous ACK is resent on timeout. Same short
+		//block received again means file is really shorter than tsize so upload is not stored.
+		if len(Payload) < BlockSize && TransferSize >= 0 && ReceivedBytes+int64(len(Payload)) < TransferSize {
+			if Truncated == len(Payload) {
+				SendErrorPacket(ILLEGALOP, TSIZEUNDERMSG, NewConn)
+				return nil, false, errors.New(TSIZEUNDERMSG)
+			}
+			Truncated = len(Payload)
+			fmt.Println("\n==== Warning: truncated DATA block", BlockNo, "(possible IP fragmentation) from client :[", ReqData.ClientAddr, "]")
+			return nil, false, nil
+		}
+		Truncated = -1
+		if *UploadQuota > 0 && !ChargeUploadQuota(ClientIP, int64(len(Payload)), Srv.Now()) { //upload is not stored
+			SendErrorPacket(DISKFULL, UPLOADQUOTAMSG, NewConn)
+			return nil, false, errors.New(UPLOADQUOTAMSG)
+		}
+		ReceivedBytes = ReceivedBytes + int64(len(Payload))
+		//add received block to list of block of given file. Empty last block is also stored so
+		//empty file is single empty block same as file made by BlocksFromBytes
+		if len(Arena)+len(Payload) <= cap(Arena) {
+			Arena = append(Arena, Payload...)
+			FileBlocklist.PushBack(Arena[len(Arena)-len(Payload) : len(Arena) : len(Arena)])
+		} else {
+			FileBlocklist.PushBack(append([]byte(nil), Payload...))
+		}
+		Limiter.Wait(Ctx, len(Payload)) //client sends next block after ACK so delaying ACK slows down upload
+		if err := Transfer.Stopped(); err != nil {
+			return nil, false, err
+		}
+		ACKNo = ACKNo + 1
+		Status.Bytes.Add(int64(len(Payload)))
+		Status.Block.Store(int64(BlockNo))
+		Rewound, InWindow = false, InWindow+1
+		Last := len(Payload) < BlockSize    //short packet is last packet
+		if !Last && InWindow < WindowSize { //only last block of window is acknowledged
+			Transfer.Defer(MakeACKPacket(BlockNo))
+			return nil, false, nil
+		}
+		InWindow = 0
+		return MakeACKPacket(BlockNo), Last, nil
+	})
+	if err != nil {
+		if FileBlocklist.Len() == 0 { //client never sent DATA after request was acknowledged. Name stays free
+			fmt.Println("\n==== Write abandoned before first DATA :[", StoredName, "] client :[", ReqData.ClientAddr, "]")
+			return
+		}
+		//upload cancelled by stop of server is stored with data received so far if asked by -shutdown-writes
+		if !errors.Is(err, ErrTransferCancelled) || !Srv.Stopping.Load() || *ShutdownWrites != "commit" {
+			return
+		}
+		fmt.Println("\n==== Storing partial upload on shutdown :[", StoredName, "]")
+	}
+	//adding file blocks list to file map. Adding it here so file will be only
+	//visible after it is stored in map
+	FileMapLock.Lock()
+	if Stored, Exists := FileMap[StoredName]; Exists { //file may be stored by other upload during transfer
+		if _, ErrMsg := OverwriteError(Stored, ModTime, ReqData.Options); ErrMsg != "" {
+			FileMapLock.Unlock()
+			fmt.Println("\n==== Write discarded for :[", StoredName, "]", ErrMsg)
+			return
+		}
+	} else if *MaxFiles > 0 && len(FileMap) >= *MaxFiles { //other uploads filled the limit during transfer
+		FileMapLock.Unlock()
+		fmt.Println("\n==== Write discarded for :[", StoredName, "]", MAXFILESMSG)
+		return
+	}
+	File := NewFileEntry(FileBlocklist)
+	if Password, ok := ReqData.Options["pw"]; ok {
+		File.PasswordHash = sha256.Sum256([]byte(Password))
+		File.Protected = true
+	}
+	if !ModTime.IsZero() {
+		File.ModTime = ModTime
+	}
+	File.ContentType = ContentType
+	File.Pinned = Pinned
+	File.MaxReads = MaxReads
+	File.UploadedAt = Srv.Now()
+	StoreFile(StoredName, File)
+	FileMapLock.Unlock()
+	LogCompleted(Status, "\n==== Write Completed for :[", StoredName, "] options :", Options, "retransmits :", Transfer.Retransmits)
+	Completed = true
+	if Srv.OnWriteComplete != nil {
+		Srv.OnWriteComplete(TransferSummary{FileName: StoredName, Client: ReqData.ClientAddr, Options: Options, Size: File.Size, File: File, Retransmits: Transfer.Retransmits})
+	}
+	if Srv.Mirror != nil && err == nil { //partial upload stored on shutdown is not mirrored
+		Srv.MirrorUpload(StoredName, File)
+	}
+	return
+}
+
+/**
+* @brief : Function to prefix uploaded file name with client IP so uploads of same name
+*          from different clients do not collide. ex. "data" from 10.0.0.5 is stored as "10.0.0.5-data"
+* @param : Name : file name requested by client
+* @param : Client : client address
+ */
+
+func ClientPrefixedName(Name string, Client net.Addr) string {
+
+	if UDPAddr, ok := Client.(*net.UDPAddr); ok {
+		return UDPAddr.IP.String() + "-" + Name
+	}
+	return Name
+}
+
+/**
+* @brief : Function to check whether stored file can be overwritten by upload. It gives error
+*          number and message if it can not. Only upload with mtime option newer than stored file
+*          can overwrite it. File uploaded with pw option can be overwritten only with same pw.
+* @param : Stored : stored file of same name
+* @param : ModTime : modification time given by mtime option. Zero if not given
+* @param : Options : options requested by uploading client
+ */
+
+func OverwriteError(Stored *FileEntry, ModTime time.Time, Options map[string]string) (uint16, string) {
+
+	if Stored.Protected { //protection can not be removed or changed without password
+		Password, ok := Options["pw"]
+		Hash := sha256.Sum256([]byte(Password))
+		if !ok || subtle.ConstantTimeCompare(Hash[:], Stored.PasswordHash[:]) != 1 {
+			return ACCESSVIOLATION, WRONGPASSWORDMSG
+		}
+	}
+	if ModTime.IsZero() {
+		return FILEEXISTS, FILEEXISTSMSG
+	}
+	if !ModTime.After(Stored.ModTime) {
+		return FILEEXISTS, STALEFILEMSG
+	}
+	return 0, ""
+}
+
+/**
+* @brief : Function to handle Read Request. Read data from main memory and sent to client
+* @param : ReqData: Request iformation
+ */
+
+func (Srv *Server) HandleReadRequest(ReqData *RequestData) {
+
+	var File *FileEntry
+	var ok bool
+	var Fetch *UpstreamFetch //fetch from -upstream streamed to client. Nil if file is served from FileMap
+	Completed := false
+
+	Stats.ActiveTransfers.Add(1)
+	defer func() { //updating statistics at end of request handling
+		Stats.ActiveTransfers.Add(-1)
+		if Completed {
+			Stats.Reads.Add(1)
+		} else {
+			Stats.Errors.Add(1)
+		}
+	}()
+
+	NewConn, err := OpenTransferConn(ReqData)
+	if err != nil {
+		fmt.Println("Error: ", err)
+		return
+	}
+	Status := Srv.StartTransfer(ReqData, "read")
+	Dallying := false //socket and transfer are handed over to dallying goroutine after completion
+	defer func() {
+		if !Dallying {
+			Srv.EndTransfer(Status)
+			NewConn.Close()
+		}
+	}()
+
+	_, Stat := ReqData.Options["stat"]
+	StoredName := ReqData.FileName //name of file in FileMap
+	if Srv.ResolveFilename != nil {
+		StoredName = Srv.ResolveFilename(ReqData.FileName, ReqData.ClientAddr)
+	}
+	Decompress := false
+	Producer, Virtual := Srv.VirtualFiles.Load(ReqData.FileName)
+	if Virtual && *VirtualWrites == "shadow" { //uploaded file hides virtual file of same name
+		FileMapLock.RLock()
+		_, Shadowed := FileMap[StoredName]
+		FileMapLock.RUnlock()
+		Virtual = !Shadowed
+	}
+	if Virtual { //content of virtual file is produced for this client and it is not stored
+		StopKeepAlive := StartKeepAlive(ReqData, NewConn)
+		Data, err := Producer.(VirtualFileProducer)(ReqData.ClientAddr)
+		StopKeepAlive()
+		if err != nil {
+			fmt.Println("Error: ", err)
+			SendErrorPacket(StorageErrorCode(err), err.Error(), NewConn)
+			return
+		}
+		File, ok = NewFileEntry(BlocksFromBytes(Data)), true
+	} else {
+		FileMapLock.RLock()
+		File, ok = FileMap[StoredName]
+		if !ok && *AutoGunzip && !Stat { //compressed file is served decompressed if file itself is not present
+			File, ok = FileMap[StoredName+".gz"]
+			if ok {
+				StoredName = StoredName + ".gz"
+				Decompress = true
+			}
+		}
+		FileMapLock.RUnlock()
+		if !ok && *Upstream != "" { //file is fetched from upstream server and kept for later requests
+			StopKeepAlive := StartKeepAlive(ReqData, NewConn)
+			Fetch = Srv.FetchUpstream(StoredName)
+			err = Fetch.WaitStarted() //blocks are sent to client while rest of file is fetched
+			if err == nil && Stat {   //metadata needs whole file
+				err = Fetch.WaitDone()
+			}
+			StopKeepAlive()
+			switch {
+			case errors.Is(err, ErrUpstreamNotFound):
+				Fetch = nil
+			case err != nil:
+				SendErrorPacket(UNKNOWNERROR, "Error not able to fetch file from upstream server", NewConn)
+				return
+			case Stat:
+				File, ok, Fetch = Fetch.File, true, nil
+			default: //file data is taken from fetch. It is stored file once fetch is completed
+				File, ok = NewFileEntry(BlocksFromBytes(nil)), true
+			}
+		}
+		if ok && !Stat {
+			FileMapLock.Lock()
+			File.LastReadAt = time.Now()
+			FileMapLock.Unlock()
+		}
+	}
+	if ok && !Virtual && *MinFileAge > 0 && !File.UploadedAt.IsZero() && Srv.Now().Sub(File.UploadedAt) < *MinFileAge { //uploaded file is not settled yet
+		fmt.Println("\n==== File too new to serve :[", StoredName, "]")
+		ok = false
+	}
+	if !ok { //checking for file availability.
+		SendErrorPacket(FILENOTFOUND, FILENOTFOUNDMSG, NewConn) //if not exist send error message of "file not found"
+		return
+	}
+	if File.Protected { //password given with pw option must match password given at upload
+		Hash := sha256.Sum256([]byte(ReqData.Options["pw"]))
+		if subtle.ConstantTimeCompare(Hash[:], File.PasswordHash[:]) != 1 {
+			SendErrorPacket(ACCESSVIOLATION, WRONGPASSWORDMSG, NewConn)
+			return
+		}
+	}
+	ReleaseReader := func() {}
+	if *MaxReadersPerFile > 0 && !Stat && !Virtual { //popular file can not take all bandwidth
+		FileMapLock.Lock()
+		Busy := File.Readers >= *MaxReadersPerFile
+		if !Busy {
+			File.Readers = File.Readers + 1
+		}
+		FileMapLock.Unlock()
+		if Busy {
+			fmt.Println("\n==== Too many readers of :[", StoredName, "]")
+			SendErrorPacket(UNKNOWNERROR, SERVERBUSYMSG, NewConn)
+			return
+		}
+		Released := false
+		ReleaseReader = func() { //called also at completion so dallying transfer does not hold reader place
+			if !Released {
+				Released = true
+				FileMapLock.Lock()
+				File.Readers = File.Readers - 1
+				FileMapLock.Unlock()
+			}
+		}
+		defer ReleaseReader()
+	}
+	if File.MaxReads > 0 && !Stat { //slot is taken at start so concurrent readers can not go over quota
+		if File.ReadSlots.Add(1) > File.MaxReads {
+			File.ReadSlots.Add(-1)
+			SendErrorPacket(FILENOTFOUND, READQUOTAMSG, NewConn)
+			return
+		}
+		defer func() {
+			if !Completed { //failed read gives back its slot
+				File.ReadSlots.Add(-1)
+			}
+		}()
+	}
+	if *OneShot && !Stat && !Virtual && Fetch == nil { //file is claimed at start so it is delivered to one reader only
+		FileMapLock.Lock()
+		Taken := File.Claimed
+		if !File.Pinned {
+			File.Claimed = true
+		}
+		FileMapLock.Unlock()
+		if Taken {
+			SendErrorPacket(FILENOTFOUND, FILENOTFOUNDMSG, NewConn)
+			return
+		}
+		defer func() {
+			if !Completed { //failed read gives file back for next reader
+				FileMapLock.Lock()
+				File.Claimed = false
+				FileMapLock.Unlock()
+			}
+		}()
+	}
+	LogTransfer("\n==== Read Started for :[", ReqData.FileName, "]")
+	var BlockCount uint16 //block number of last DATA packet produced. Zero before first block
+	Negotiated, OACK := Negotiate(ReqData, FlagNegotiationConfig())
+	if *StrictNegotiation && len(Negotiated.Malformed) > 0 { //strict client is told instead of option being ignored
+		SendErrorPacket(OPTIONNEGFAILED, OPTIONNEGMSG+": "+strings.Join(Negotiated.Malformed, ", "), NewConn)
+		return
+	}
+	Options := Negotiated.Accepted
+	BlockSize := Negotiated.Blksize
+	Limiter := Negotiated.RateLimiter()
+	WindowSize := Negotiated.Windowsize
+	//file data is read from here block by block
+	var Source io.Reader = NewListReader(File.Blocks)
+	if Fetch != nil {
+		Source = &FetchReader{Fetch: Fetch}
+	}
+	if Stat { //only metadata is sent in OACK and file data is not sent
+		delete(Options, "compress")
+		Negotiated.Compress = ""
+		for Name, Value := range FileMetadata(File) {
+			Options[Name] = Value
+		}
+		OACK = MakeOACKPacket(Options)
+		Source = NewListReader(BlocksFromBytes(nil))
+	}
+	Compress := Negotiated.Compress == "gzip"
+	if Decompress && Compress { //stored gzip data is sent as it is
+		Decompress, Compress = false, false
+	}
+	if Decompress { //decompressing while sending
+		Source, err = gzip.NewReader(Source)
+		if err != nil {
+			SendErrorPacket(UNKNOWNERROR, "Error not able to decompress file", NewConn)
+			return
+		}
+	}
+	AckedBytes := int64(0)                                                //file data acknowledged by client. It is saved as checkpoint if transfer fails
+	if *ResumeTTL > 0 && !Stat && !Virtual && Negotiated.Compress == "" { //offset of compressed data does not match file
+		CheckpointKey := ReqData.ClientAddr.IP.String() + " " + StoredName
+		if _, ok := ReqData.Options["resume"]; ok { //client asks to continue from failed transfer
+			if Offset, ok := LoadCheckpoint(CheckpointKey, File); ok {
+				if _, err = io.CopyN(io.Discard, Source, Offset); err != nil {
+					SendErrorPacket(UNKNOWNERROR, "Error not able to read file", NewConn)
+					return
+				}
+				Options["resume"] = strconv.FormatInt(Offset, 10)
+				OACK = MakeOACKPacket(Options)
+				AckedBytes = Offset
+			}
+		}
+		defer func() {
+			if Completed {
+				DeleteCheckpoint(CheckpointKey)
+			} else if AckedBytes > 0 {
+				SaveCheckpoint(CheckpointKey, File, AckedBytes)
+			}
+		}()
+	}
+	Counter := &CountingReader{Reader: Source} //file bytes delivered by this transfer, before compression and after resumed offset
+	Source = Counter
+	if Compress { //compressing while sending. Client decompresses
+		var StopCompress func()
+		Source, StopCompress = NewCompressingReader(Source)
+		defer StopCompress()
+	}
+	Ctx, CancelDeadline := Negotiated.WithDeadline(Status.Ctx)
+	defer func() {
+		if !Dallying {
+			CancelDeadline()
+		}
+	}()
+	Transfer := Srv.NewTransfer(Ctx, NewConn, 1024, Negotiated.Timeout)
+	Transfer.Gap = *InterPacketDelay      //slow clients drop packets arriving back-to-back
+	var Window [][]byte                   //DATA packets sent and not acknowledged yet, oldest first
+	Buffers := make([][]byte, WindowSize) //packet buffers. Buffer is reused for block produced WindowSize blocks later
+	Produced := 0                         //number of blocks produced
+	LastProduced := false                 //short last block of file is produced
+	//producing next data blocks until window is full
+	FillWindow := func() error {
+		for len(Window) < WindowSize && !LastProduced {
+			DataToSend := Buffers[Produced%WindowSize]
+			if DataToSend == nil {
+				DataToSend = make([]byte, BlockSize+4)
+				Buffers[Produced%WindowSize] = DataToSend
+			}
+			BlockCount = BlockCount + 1
+			binary.BigEndian.PutUint16(DataToSend, DATA)           //setting opcode DATA in packet
+			binary.BigEndian.PutUint16(DataToSend[2:], BlockCount) //setting Block number in packet
+			ByteCopied, err := io.ReadFull(Source, DataToSend[4:]) // copying block data in packet
+			if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+				fmt.Println("Error: ", err)
+				SendErrorPacket(UNKNOWNERROR, "Error not able to read file", NewConn)
+				return err
+			}
+			Limiter.Wait(Ctx, ByteCopied)
+			if err := Transfer.Stopped(); err != nil {
+				return err
+			}
+			Produced = Produced + 1
+			LastProduced = ByteCopied < BlockSize // short block is last block of file
+			Window = append(Window, DataToSend[:4+ByteCopied])
+		}
+		return nil
+	}
+	if *DebugNegotiation {
+		LogNegotiation(ReqData, Negotiated)
+	}
+	First := OACK // if any option is accepted then OACK is sent first and client acknowledges it with block 0
+	if OACK == nil {
+		if err = FillWindow(); err != nil { //window is one block without options
+			return
+		}
+		First = Window[0]
+	}
+	var FirstByte time.Duration //lookup of file and socket setup time as seen by client. First packet is sent right away
+	if !ReqData.ReceivedAt.IsZero() {
+		FirstByte = time.Since(ReqData.ReceivedAt)
+		Stats.FirstByteNanos.Add(int64(FirstByte))
+		Stats.FirstByteCount.Add(1)
+	}
+
+	Started := OACK == nil //OACK is acknowledged and DATA is sent
+	err = Transfer.Run(First, func(Pkt []byte) ([]byte, bool, error) {
+		BlockNoFromACK, IsACK := DecodeACKPacket(Pkt)
+		if !IsACK { //other packets are ignored
+			return nil, false, nil
+		}
+		//number of window blocks acknowledged. Block numbers wrap around for big files so block
+		//is in future if it is less than half of number space ahead of last acknowledged block.
+		Acked := BlockNoFromACK - (BlockCount - uint16(len(Window)))
+		if !Started && BlockNoFromACK == 0 { //ACK of OACK does not consume any data block
+			Started = true
+		} else if Acked > uint16(len(Window)) && Acked < 0x8000 {
+			//ACK for block which is not sent yet can not be received from well behaved client
+			SendErrorPacket(ILLEGALOP, FUTUREACKMSG, NewConn)
+			return nil, false, errors.New(FUTUREACKMSG)
+		} else if Acked == 0 || Acked >= 0x8000 { //duplicate ACK is ignored
+			return nil, false, nil
+		}
+		for _, Sent := range Window[:Acked] {
+			AckedBytes = AckedBytes + int64(len(Sent)-4)
+		}
+		Window = Window[Acked:]
+		Status.Bytes.Store(AckedBytes)
+		Status.Block.Store(int64(BlockNoFromACK))
+		if LastProduced && len(Window) == 0 { //last block of file is acknowledged
+			return nil, true, nil
+		}
+		//blocks of window after ACK are lost at client (RFC 7440) so they are sent again followed by next blocks
+		if err := FillWindow(); err != nil {
+			return nil, false, err
+		}
+		return nil, false, Transfer.SendWindow(Window)
+	})
+	if err != nil {
+		return
+	}
+	LogCompleted(Status, "\n==== Read Completed for :[", ReqData.FileName, "] options :", Options, "retransmits :", Transfer.Retransmits, "first byte :", FirstByte)
+	Completed = true
+	ReleaseReader()
+	if Fetch != nil { //whole file is read so fetch is completed and file is stored
+		File = Fetch.File
+	}
+	if !Stat && !Virtual { //counting reads for popularity of file
+		File.Reads.Add(1)
+	}
+	if Srv.OnReadComplete != nil {
+		Srv.OnReadComplete(TransferSummary{FileName: ReqData.FileName, Client: ReqData.ClientAddr, Options: Options, Size: int(AckedBytes), Delivered: int(Counter.Count), FirstByte: FirstByte, Retransmits: Transfer.Retransmits})
+	}
+
+	if *OneShot && !Stat && !Virtual { //file is delivered so removing it
+		FileMapLock.Lock()
+		Removed := FileMap[StoredName] == File && !File.Pinned //file may be replaced or pinned during transfer
+		if Removed {
+			RemoveFile(StoredName)
+			delete(PreloadedFiles, StoredName)
+		} else {
+			File.Claimed = false
+		}
+		FileMapLock.Unlock()
+		if Removed {
+			fmt.Println("\n==== One shot file removed :[", StoredName, "]")
+		}
+	}
+	if !Srv.Stopping.Load() { //final ACK seen by us may be duplicate while real one is lost. Worker is freed meanwhile
+		Dallying = true
+		Srv.Dallies.Add(1)
+		go func() {
+			defer Srv.Dallies.Done()
+			Transfer.Dally(BlockCount - 1)
+			CancelDeadline()
+			Srv.EndTransfer(Status)
+			NewConn.Close()
+		}()
+	}
+}
+
+/**
+* @brief : Function to send OACK of read request periodically while file is not ready yet (ex. slow
+*          -upstream) so client does not time out. Client acknowledges it and waits for first DATA.
+*          OACK is sent only if it does not depend on file (no stat or resume option) as same OACK is
+*          sent again when transfer starts. Client which asked no option can not be sent OACK.
+*          Returned function stops sending and must be called before transfer uses Conn.
+* @param : ReqData : Request iformation
+* @param : Conn : transfer socket of client
+ */
+
+func StartKeepAlive(ReqData *RequestData, Conn net.Conn) func() {
+
+	_, Stat := ReqData.Options["stat"]
+	_, Resume := ReqData.Options["resume"]
+	_, OACK := Negotiate(ReqData, FlagNegotiationConfig())
+	if *KeepAliveInterval <= 0 || OACK == nil || Stat || Resume {
+		return func() {}
+	}
+	Done := make(chan struct{})
+	Stopped := make(chan struct{})
+	go func() {
+		defer close(Stopped)
+		Ticker := time.NewTicker(*KeepAliveInterval)
+		defer Ticker.Stop()
+		for {
+			select {
+			case <-Done:
+				return
+			case <-Ticker.C:
+				Conn.Write(OACK)
+			}
+		}
+	}()
+	return func() {
+		close(Done)
+		<-Stopped
+	}
+}
+
+// file being fetched from -upstream. Data received so far can be read while fetch continues,
+// so client gets first blocks without waiting for whole file.
+type UpstreamFetch struct {
+	Lock sync.Mutex
+	Cond *sync.Cond
+	Data []byte     // data received so far
+	Done bool       // fetch ended
+	Err  error      // error ending fetch. Nil if file is complete
+	File *FileEntry // stored file. Set when fetch is completed
+}
+
+/**
+* @brief : Function to start fetching file missing locally from -upstream server in background.
+*          Completed file is stored for later requests. Whole fetch is tried again on timeout or
+*          transient error as set by -upstream-retries. Data already received is not repeated.
+* @param : Name : file name
+ */
+
+func (Srv *Server) FetchUpstream(Name string) *UpstreamFetch {
+
+	Fetch := &UpstreamFetch{}
+	Fetch.Cond = sync.NewCond(&Fetch.Lock)
+	go func() {
+		fmt.Println("\n==== Fetching from upstream :[", Name, "]")
+		var err error
+		Backoff := UPSTREAMBACKOFF
+		for Attempt := 0; ; Attempt++ {
+			Received := 0 //bytes received in this attempt
+			err = FetchFromUpstream(*Upstream, Name, *UpstreamBlksize, func(Block []byte) {
+				Fetch.Lock.Lock()
+				if Known := len(Fetch.Data); Received+len(Block) > Known { //part received by earlier attempt is skipped
+					Fetch.Data = append(Fetch.Data, Block[max(Known-Received, 0):]...)
+					Fetch.Cond.Broadcast()
+				}
+				Fetch.Lock.Unlock()
+				Received = Received + len(Block)
+			})
+			if Attempt >= *UpstreamRetries || !IsRetryable(err) { //flaky network may work on next try
+				break
+			}
+			fmt.Println("\n==== Upstream fetch failed :[", Name, "]", err, "retry", Attempt+1, "after", Backoff)
+			time.Sleep(Backoff)
+			Backoff = Backoff * 2
+		}
+		var File *FileEntry
+		if err == nil {
+			File = NewFileEntry(BlocksFromBytes(Fetch.Data))
+			FileMapLock.Lock()
+			if Stored, Exists := FileMap[Name]; Exists { //file may be stored by other request meanwhile
+				File = Stored
+			} else {
+				StoreFile(Name, File)
+			}
+			FileMapLock.Unlock()
+		} else if !errors.Is(err, ErrUpstreamNotFound) {
+			fmt.Println("Error: ", err)
+		}
+		Fetch.Lock.Lock()
+		Fetch.Done, Fetch.Err, Fetch.File = true, err, File
+		Fetch.Cond.Broadcast()
+		Fetch.Lock.Unlock()
+	}()
+	return Fetch
+}
+
+/**
+* @brief : Function to wait until first data of file is received or fetch ends. It returns
+*          error only if fetch failed before any data was received.
+ */
+
+func (Fetch *UpstreamFetch) WaitStarted() error {
+
+	Fetch.Lock.Lock()
+	defer Fetch.Lock.Unlock()
+	for len(Fetch.Data) == 0 && !Fetch.Done {
+		Fetch.Cond.Wait()
+	}
+	if len(Fetch.Data) == 0 {
+		return Fetch.Err
+	}
+	return nil
+}
+
+/**
+* @brief : Function to wait until fetch ends. It returns error of fetch.
+ */
+
+func (Fetch *UpstreamFetch) WaitDone() error {
+
+	Fetch.Lock.Lock()
+	defer Fetch.Lock.Unlock()
+	for !Fetch.Done {
+		Fetch.Cond.Wait()
+	}
+	return Fetch.Err
+}
+
+// reader of file data being fetched. It waits for data not received yet and returns
+// error of fetch once data received before failure is read.
+type FetchReader struct {
+	Fetch  *UpstreamFetch
+	Offset int
+}
+
+func (Reader *FetchReader) Read(buf []byte) (int, error) {
+
+	Fetch := Reader.Fetch
+	Fetch.Lock.Lock()
+	defer Fetch.Lock.Unlock()
+	for Reader.Offset >= len(Fetch.Data) && !Fetch.Done {
+		Fetch.Cond.Wait()
+	}
+	if Reader.Offset < len(Fetch.Data) {
+		n := copy(buf, Fetch.Data[Reader.Offset:])
+		Reader.Offset = Reader.Offset + n
+		return n, nil
+	}
+	if Fetch.Err != nil {
+		return 0, Fetch.Err
+	}
+	return 0, io.EOF
+}
+
+var ErrUpstreamNotFound = errors.New("file not found on upstream server")
+
+/**
+* @brief : Function to check failed upstream fetch may succeed if tried again. Error replied
+*          by upstream server (ex. file not found) is final.
+* @param : err : error of FetchFromUpstream
+ */
+
+func IsRetryable(err error) bool {
+
+	var NetErr net.Error
+	if errors.As(err, &NetErr) && NetErr.Timeout() {
+		return true
+	}
+	return IsTemporary(err) || IsUnreachable(err)
+}
+
+/**
+* @brief : Function to read file from other TFTP server acting as its client. Octet mode is used.
+*          Block size is requested by blksize option. Default block size is used if server
+*          does not support options and replies DATA in place of OACK.
+* @param : Upstream : server address [ip address:port]
+* @param : Name : file name
+* @param : BlockSize : requested block size. Option is not sent if it is default block size
+* @param : Deliver : called with data of each new block in order as it is received
+ */
+
+func FetchFromUpstream(Upstream string, Name string, BlockSize int, Deliver func(Block []byte)) error {
+
+	ServerAddr, err := net.ResolveUDPAddr("udp", Upstream)
+	if err != nil {
+		return err
+	}
+	Conn, err := net.ListenUDP("udp", nil)
+	if err != nil {
+		return err
+	}
+	defer Conn.Close()
+
+	Request := make([]byte, 2)
+	binary.BigEndian.PutUint16(Request, RRQ) //setting OPCODE as RRQ followed by file name and mode
+	Request = append(Request, Name...)
+	Request = append(Request, 0x00)
+	Request = append(Request, "octet"...)
+	Request = append(Request, 0x00)
+	if BlockSize != int(FILEBLOCKSIZE) {
+		Request = append(Request, "blksize"...)
+		Request = append(Request, 0x00)
+		Request = append(Request, strconv.Itoa(BlockSize)...)
+		Request = append(Request, 0x00)
+	}
+	Negotiated := int(FILEBLOCKSIZE) //block size used by server
+
+	var BlockNo uint16 = 1                   //block expected next
+	var Peer *net.UDPAddr                    //transfer socket of upstream. Known from first DATA packet
+	LastPkt, LastAddr := Request, ServerAddr //packet resent on timeout
+	Buf := make([]byte, max(BlockSize, int(FILEBLOCKSIZE))+4)
+	Retries := 0
+	if _, err = Conn.WriteToUDP(Request, ServerAddr); err != nil {
+		return err
+	}
+	for {
+		Conn.SetReadDeadline(time.Now().Add(TIMEOUT * time.Second))
+		n, From, err := Conn.ReadFromUDP(Buf)
+		if err != nil {
+			TimeoutErr, Status := err.(net.Error)
+			if Status && TimeoutErr.Timeout() && Retries < 3 {
+				Retries = Retries + 1
+				Conn.WriteToUDP(LastPkt, LastAddr)
+				continue
+			}
+			return err
+		}
+		if n < 4 || !From.IP.Equal(ServerAddr.IP) || (Peer != nil && From.Port != Peer.Port) { //not from upstream transfer
+			continue
+		}
+		switch binary.BigEndian.Uint16(Buf) {
+		case OACK:
+			if BlockNo != 1 { //OACK can come only as first reply
+				continue
+			}
+			Options := make(map[string]string) //option names and values of OACK
+			Fields := strings.Split(strings.TrimSuffix(string(Buf[2:n]), "\x00"), "\x00")
+			for i := 0; i+1 < len(Fields); i = i + 2 {
+				Options[strings.ToLower(Fields[i])] = Fields[i+1]
+			}
+			Negotiated = NegotiatedBlockSize(Options)
+			if _, ok := Options["blksize"]; ok && (Negotiated > BlockSize || Negotiated < MINBLKSIZE) { //server can only lower requested block size
+				return errors.New("upstream replied invalid blksize")
+			}
+			Peer = From
+			LastPkt, LastAddr = MakeACKPacket(0), From
+			if _, err = Conn.WriteToUDP(LastPkt, LastAddr); err != nil {
+				return err
+			}
+		case ERROR:
+			if binary.BigEndian.Uint16(Buf[2:]) == FILENOTFOUND {
+				return ErrUpstreamNotFound
+			}
+			return fmt.Errorf("upstream error: %s", strings.TrimRight(string(Buf[4:n]), "\x00"))
+		case DATA:
+			Block := binary.BigEndian.Uint16(Buf[2:])
+			if Block != BlockNo && Block != BlockNo-1 {
+				continue
+			}
+			if Block == BlockNo { //new block
+				Deliver(Buf[4:n])
+				BlockNo = BlockNo + 1
+				Retries = 0
+			}
+			Peer = From
+			LastPkt, LastAddr = MakeACKPacket(Block), From
+			if _, err = Conn.WriteToUDP(LastPkt, LastAddr); err != nil {
+				return err
+			}
+			if Block == BlockNo-1 && n < Negotiated+4 { //short block is last block
+				return nil
+			}
+		}
+	}
+}
+
+/**
+* @brief : Function to split file content in data blocks as they are stored in FileMap.
+*          Last block is always shorter than FILEBLOCKSIZE so it may be empty.
+* @param : Data : file content
+ */
+
+func BlocksFromBytes(Data []byte) *list.List {
+
+	FileBlocklist := list.New()
+	for {
+		BlockLen := len(Data)
+		if BlockLen > int(FILEBLOCKSIZE) {
+			BlockLen = int(FILEBLOCKSIZE)
+		}
+		FileBlocklist.PushBack(Data[:BlockLen])
+		Data = Data[BlockLen:]
+		if BlockLen < int(FILEBLOCKSIZE) { //last block
+			break
+		}
+	}
+	return FileBlocklist
+}
+
+/**
+* @brief : Function to create entry of file stored now.
+* @param : Blocks : data blocks of file
+ */
+
+func NewFileEntry(Blocks *list.List) *FileEntry {
+
+	File := &FileEntry{Blocks: Blocks, CreatedAt: time.Now()}
+	File.ModTime = File.CreatedAt
+	Hash := sha256.New()
+	for e := Blocks.Front(); e != nil; e = e.Next() {
+		File.Size = File.Size + len(e.Value.([]byte))
+		if *Dedup {
+			Hash.Write(e.Value.([]byte))
+		}
+	}
+	if *Dedup {
+		Hash.Sum(File.ContentHash[:0])
+	}
+	return File
+}
+
+/**
+* @brief : Function to check -max-files limit is reached so no new file name can be stored.
+ */
+
+func FileLimitReached() bool {
+
+	if *MaxFiles <= 0 {
+		return false
+	}
+	FileMapLock.RLock()
+	defer FileMapLock.RUnlock()
+	return len(FileMap) >= *MaxFiles
+}
+
+/**
+* @brief : Function to add file to FileMap replacing file of same name. With -dedup identical
+*          content is stored once and shared by all files having it. FileMapLock must be held.
+* @param : Name : file name
+* @param : File : file
+ */
+
+func StoreFile(Name string, File *FileEntry) {
+
+	RemoveFile(Name)
+	if *Dedup {
+		if Content, ok := Contents[File.ContentHash]; ok { //sharing already stored blocks
+			File.Blocks = Content.Blocks
+			Content.Refs = Content.Refs + 1
+		} else {
+			Contents[File.ContentHash] = &SharedContent{Blocks: File.Blocks, Refs: 1}
+		}
+	}
+	FileMap[Name] = File
+}
+
+/**
+* @brief : Function to remove file from FileMap. Shared content is released when
+*          last file having it is removed. FileMapLock must be held.
+* @param : Name : file name
+ */
+
+func RemoveFile(Name string) {
+
+	File, ok := FileMap[Name]
+	if !ok {
+		return
+	}
+	delete(FileMap, Name)
+	if Content, ok := Contents[File.ContentHash]; ok && *Dedup {
+		Content.Refs = Content.Refs - 1
+		if Content.Refs == 0 {
+			delete(Contents, File.ContentHash)
+		}
+	}
+}
+
+/**
+* @brief : Function to save checkpoint of failed read. Expired checkpoints are removed.
+* @param : Key : client IP and file name
+* @param : File : file being read
+* @param : Offset : bytes acknowledged by client
+ */
+
+func SaveCheckpoint(Key string, File *FileEntry, Offset int64) {
+
+	CheckpointLock.Lock()
+	defer CheckpointLock.Unlock()
+	for OldKey, Checkpoint := range Checkpoints {
+		if time.Since(Checkpoint.Time) > *ResumeTTL {
+			delete(Checkpoints, OldKey)
+		}
+	}
+	Checkpoints[Key] = ReadCheckpoint{File: File, Offset: Offset, Time: time.Now()}
+}
+
+/**
+* @brief : Function to get offset of checkpoint if it is not expired and file is not replaced.
+* @param : Key : client IP and file name
+* @param : File : file being read
+ */
+
+func LoadCheckpoint(Key string, File *FileEntry) (int64, bool) {
+
+	CheckpointLock.Lock()
+	defer CheckpointLock.Unlock()
+	Checkpoint, ok := Checkpoints[Key]
+	if !ok || Checkpoint.File != File || time.Since(Checkpoint.Time) > *ResumeTTL {
+		return 0, false
+	}
+	return Checkpoint.Offset, true
+}
+
+/**
+* @brief : Function to get bytes client IP can still upload in current quota window.
+*          Usage of windows ended is removed.
+* @param : IP : client IP
+* @param : Now : current time
+ */
+
+func UploadQuotaLeft(IP string, Now time.Time) int64 {
+
+	UploadUsageLock.Lock()
+	defer UploadUsageLock.Unlock()
+	for OldIP, Usage := range UploadUsages {
+		if Now.Sub(Usage.WindowStart) >= *QuotaWindow {
+			delete(UploadUsages, OldIP)
+		}
+	}
+	return *UploadQuota - UploadUsages[IP].Bytes
+}
+
+/**
+* @brief : Function to count received bytes to quota of client IP. Returns false without
+*          counting if bytes do not fit in quota. First bytes of client start its window.
+* @param : IP : client IP
+* @param : Bytes : bytes received
+* @param : Now : current time
+ */
+
+func ChargeUploadQuota(IP string, Bytes int64, Now time.Time) bool {
+
+	UploadUsageLock.Lock()
+	defer UploadUsageLock.Unlock()
+	Usage, ok := UploadUsages[IP]
+	if !ok || Now.Sub(Usage.WindowStart) >= *QuotaWindow { //new window starts
+		Usage = UploadUsage{WindowStart: Now}
+	}
+	if Usage.Bytes+Bytes > *UploadQuota {
+		return false
+	}
+	Usage.Bytes = Usage.Bytes + Bytes
+	UploadUsages[IP] = Usage
+	return true
+}
+
+/**
+* @brief : Function to remove checkpoint once file is read completely.
+* @param : Key : client IP and file name
+ */
+
+func DeleteCheckpoint(Key string) {
+
+	CheckpointLock.Lock()
+	delete(Checkpoints, Key)
+	CheckpointLock.Unlock()
+}
+
+// reader counting bytes read from Reader
+type CountingReader struct {
+	Reader io.Reader
+	Count  int64
+}
+
+func (Reader *CountingReader) Read(buf []byte) (int, error) {
+
+	n, err := Reader.Reader.Read(buf)
+	Reader.Count = Reader.Count + int64(n)
+	return n, err
+}
+
+// reader of file data stored in list of blocks
+type ListReader struct {
+	Element *list.Element // block being read
+	Offset  int           // offset of next byte to read in block
+}
+
+/**
+* @brief : Function to create reader of file data stored in list of blocks.
+*          List must not be modified while reading. Stored files are never modified.
+* @param : Blocks : list of blocks
+ */
+
+func NewListReader(Blocks *list.List) *ListReader {
+
+	return &ListReader{Element: Blocks.Front()}
+}
+
+func (Reader *ListReader) Read(buf []byte) (int, error) {
+
+	ByteCopied := 0
+	for ByteCopied < len(buf) && Reader.Element != nil {
+		Block := Reader.Element.Value.([]byte)
+		n := copy(buf[ByteCopied:], Block[Reader.Offset:])
+		ByteCopied = ByteCopied + n
+		Reader.Offset = Reader.Offset + n
+		if Reader.Offset == len(Block) { //moving to next block
+			Reader.Element = Reader.Element.Next()
+			Reader.Offset = 0
+		}
+	}
+	if ByteCopied == 0 && len(buf) > 0 {
+		return 0, io.EOF
+	}
+	return ByteCopied, nil
+}
+
+/**
+* @brief : Function to create reader of gzip compressed data of Source. Data is compressed in
+*          background while it is read. Returned function must be called when reading ends so
+*          compression stops if reader is not read till end.
+* @param : Source : uncompressed data
+ */
+
+func NewCompressingReader(Source io.Reader) (io.Reader, func()) {
+
+	Reader, Writer := io.Pipe()
+	go func() {
+		Compressor := gzip.NewWriter(Writer)
+		_, err := io.Copy(Compressor, Source)
+		if err == nil {
+			err = Compressor.Close()
+		}
+		Writer.CloseWithError(err) //reader gets EOF if err is nil
+	}()
+	return Reader, func() { Reader.Close() }
+}
+
+// summary of preload directory load
+type ReloadSummary struct {
+	Added   int `json:"added"`
+	Updated int `json:"updated"`
+	Removed int `json:"removed"`
+}
+
+/**
+* @brief : Function to load files of preload directory in FileMap. Changed files are replaced
+*          and files which are removed from directory are removed from FileMap.
+*          Transfers in progress are not affected as they keep their own block list.
+* @param : Dir : preload directory
+ */
+
+func LoadPreloadDir(Dir string) (ReloadSummary, error) {
+
+	var Summary ReloadSummary
+
+	Entries, err := os.ReadDir(Dir)
+	if err != nil {
+		return Summary, err
+	}
+	Found := make(map[string]bool)
+
+	for _, Entry := range Entries {
+		if !Entry.Type().IsRegular() { //only regular files are served
+			continue
+		}
+		Data, err := os.ReadFile(filepath.Join(Dir, Entry.Name()))
+		if err != nil {
+			return Summary, err
+		}
+		Found[Entry.Name()] = true
+		Hash := sha256.Sum256(Data)
+
+		FileMapLock.Lock()
+		OldHash, Preloaded := PreloadedFiles[Entry.Name()]
+		if !Preloaded || OldHash != Hash {
+			if Preloaded {
+				Summary.Updated = Summary.Updated + 1
+			} else {
+				Summary.Added = Summary.Added + 1
+			}
+			StoreFile(Entry.Name(), NewFileEntry(BlocksFromBytes(Data)))
+			PreloadedFiles[Entry.Name()] = Hash
+		}
+		FileMapLock.Unlock()
+	}
+
+	FileMapLock.Lock()
+	for Name := range PreloadedFiles { //removing files which are not in directory any more
+		if !Found[Name] {
+			RemoveFile(Name)
+			delete(PreloadedFiles, Name)
+			Summary.Removed = Summary.Removed + 1
+		}
+	}
+	FileMapLock.Unlock()
+	return Summary, nil
+}
+
+// first bytes of snapshot file. Each file follows as length prefixed fields:
+// name, content type, password hash (empty if not protected), modification time,
+// maxreads, completed reads, pinned (1 byte, 1 if pinned), data
+const SNAPSHOTMAGIC string = "TFTPSNAP2\n"
+
+// first bytes of snapshot file of older version, without maxreads, reads and pinned fields
+const SNAPSHOTMAGICV1 string = "TFTPSNAP1\n"
+
+/**
+* @brief : Function to write stored files to snapshot file. Preloaded files are not written
+*          because they are loaded from preload directory. File is replaced only when it is
+*          written completely.
+* @param : Path : snapshot file
+ */
+
+func SaveSnapshot(Path string) (int, error) {
+
+	Temp, err := os.CreateTemp(filepath.Dir(Path), filepath.Base(Path)+".tmp*")
+	if err != nil {
+		return 0, err
+	}
+	defer os.Remove(Temp.Name()) //removing partial file on error. It is already renamed on success
+	Writer := bufio.NewWriter(Temp)
+	Writer.WriteString(SNAPSHOTMAGIC)
+	Count := 0
+	FileMapLock.RLock()
+	for Name, File := range FileMap {
+		if _, Preloaded := PreloadedFiles[Name]; Preloaded {
+			continue
+		}
+		var PasswordHash, ModTime []byte
+		if File.Protected {
+			PasswordHash = File.PasswordHash[:]
+		}
+		ModTime = binary.BigEndian.AppendUint64(ModTime, uint64(File.ModTime.UnixNano()))
+		WriteSnapshotField(Writer, []byte(Name))
+		WriteSnapshotField(Writer, []byte(File.ContentType))
+		WriteSnapshotField(Writer, PasswordHash)
+		WriteSnapshotField(Writer, ModTime)
+		WriteSnapshotField(Writer, binary.BigEndian.AppendUint64(nil, uint64(File.MaxReads)))
+		WriteSnapshotField(Writer, binary.BigEndian.AppendUint64(nil, uint64(File.Reads.Load()))) //read quota used so far
+		Pinned := []byte{0}
+		if File.Pinned {
+			Pinned[0] = 1
+		}
+		WriteSnapshotField(Writer, Pinned)
+		binary.Write(Writer, binary.BigEndian, uint32(File.Size)) //data field is written block by block
+		for e := File.Blocks.Front(); e != nil; e = e.Next() {
+			Writer.Write(e.Value.([]byte))
+		}
+		Count = Count + 1
+	}
+	FileMapLock.RUnlock()
+	if err = Writer.Flush(); err != nil { //write errors of bufio.Writer are reported by Flush
+		Temp.Close()
+		return 0, err
+	}
+	if err = Temp.Close(); err != nil {
+		return 0, err
+	}
+	return Count, os.Rename(Temp.Name(), Path)
+}
+
+func WriteSnapshotField(Writer *bufio.Writer, Field []byte) {
+	binary.Write(Writer, binary.BigEndian, uint32(len(Field)))
+	Writer.Write(Field)
+}
+
+func ReadSnapshotField(Reader io.Reader) ([]byte, error) {
+	var Len uint32
+	if err := binary.Read(Reader, binary.BigEndian, &Len); err != nil {
+		return nil, err
+	}
+	Field := make([]byte, Len)
+	_, err := io.ReadFull(Reader, Field)
+	return Field, err
+}
+
+/**
+* @brief : Function to load files from snapshot file written by SaveSnapshot. Missing
+*          snapshot file is not an error.
+* @param : Path : snapshot file
+ */
+
+func LoadSnapshot(Path string) (int, error) {
+
+	SnapFile, err := os.Open(Path)
+	if errors.Is(err, os.ErrNotExist) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	defer SnapFile.Close()
+	Reader := bufio.NewReader(SnapFile)
+	Magic := make([]byte, len(SNAPSHOTMAGIC))
+	if _, err = io.ReadFull(Reader, Magic); err != nil || (string(Magic) != SNAPSHOTMAGIC && string(Magic) != SNAPSHOTMAGICV1) {
+		return 0, errors.New("not a snapshot file: " + Path)
+	}
+	V1 := string(Magic) == SNAPSHOTMAGICV1
+	Count := 0
+	for {
+		Name, err := ReadSnapshotField(Reader)
+		if err == io.EOF { //end of snapshot
+			return Count, nil
+		}
+		if err != nil {
+			return Count, err
+		}
+		//content type, password hash, modification time, maxreads, reads, pinned, data
+		Fields := [][]byte{nil, nil, nil, make([]byte, 8), make([]byte, 8), []byte{0}, nil}
+		for i := range Fields {
+			if V1 && i >= 3 && i <= 5 { //not in older version
+				continue
+			}
+			if Fields[i], err = ReadSnapshotField(Reader); err != nil {
+				return Count, err
+			}
+		}
+		if len(Fields[2]) != 8 || len(Fields[3]) != 8 || len(Fields[4]) != 8 || len(Fields[5]) != 1 || (len(Fields[1]) != 0 && len(Fields[1]) != sha256.Size) {
+			return Count, errors.New("corrupted snapshot file: " + Path)
+		}
+		File := NewFileEntry(BlocksFromBytes(Fields[6]))
+		File.ContentType = string(Fields[0])
+		if len(Fields[1]) > 0 {
+			File.Protected = true
+			copy(File.PasswordHash[:], Fields[1])
+		}
+		File.ModTime = time.Unix(0, int64(binary.BigEndian.Uint64(Fields[2])))
+		File.MaxReads = int64(binary.BigEndian.Uint64(Fields[3]))
+		File.Reads.Store(int64(binary.BigEndian.Uint64(Fields[4])))
+		if File.MaxReads > 0 { //quota used before restart stays used
+			File.ReadSlots.Store(File.Reads.Load())
+		}
+		File.Pinned = Fields[5][0] == 1 //restored file is not removed by -one-shot, TTL or LRU either
+		FileMapLock.Lock()
+		StoreFile(string(Name), File)
+		FileMapLock.Unlock()
+		Count = Count + 1
+	}
+}
+
+/**
+* @brief : Admin HTTP handler for "POST /reload". Reloads preload directory and
+*          replies with summary of added/updated/removed files.
+ */
+
+func HandleReload(w http.ResponseWriter, r *http.Request) {
+
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if *PreloadDir == "" {
+		http.Error(w, "preload directory is not configured", http.StatusNotFound)
+		return
+	}
+	Summary, err := LoadPreloadDir(*PreloadDir)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	fmt.Println("\n==== Preload directory reloaded : added", Summary.Added, "updated", Summary.Updated, "removed", Summary.Removed)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(Summary)
+}
+
+/**
+* @brief : Admin HTTP handler for "/files/{name}". "DELETE" removes file from FileMap.
+*          "POST" with pinned=true|false query pins/unpins file.
+*          Reads in progress are not affected by deletion. They keep reading block list
+*          of file they started with and stored block lists are never modified.
+*          "GET" sends file content if -http-gateway is given.
+ */
+
+func HandleFile(w http.ResponseWriter, r *http.Request) {
+
+	Name := strings.TrimPrefix(r.URL.Path, "/files/")
+	if r.Method == http.MethodGet && *HTTPGateway {
+		ServeFileHTTP(w, Name)
+		return
+	}
+	if r.Method == http.MethodPost && r.URL.Query().Has("pinned") { //"POST /files/{name}?pinned=true|false"
+		Pinned, err := strconv.ParseBool(r.URL.Query().Get("pinned"))
+		if err != nil {
+			http.Error(w, "pinned must be true or false", http.StatusBadRequest)
+			return
+		}
+		FileMapLock.Lock()
+		File, ok := FileMap[Name]
+		if ok {
+			File.Pinned = Pinned
+		}
+		FileMapLock.Unlock()
+		if !ok {
+			http.Error(w, FILENOTFOUNDMSG, http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	if r.Method != http.MethodDelete {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	FileMapLock.Lock()
+	_, ok := FileMap[Name]
+	RemoveFile(Name)
+	delete(PreloadedFiles, Name)
+	FileMapLock.Unlock()
+	if !ok {
+		http.Error(w, FILENOTFOUNDMSG, http.StatusNotFound)
+		return
+	}
+	fmt.Println("\n==== File removed by admin :[", Name, "]")
+	w.WriteHeader(http.StatusNoContent)
+}
+
+/**
+* @brief : Function to send content of stored file over HTTP. Password protected files are
+*          not served because password can be checked only by pw option of TFTP.
+* @param : w : HTTP response
+* @param : Name : file name
+ */
+
+func ServeFileHTTP(w http.ResponseWriter, Name string) {
+
+	FileMapLock.RLock()
+	File, ok := FileMap[Name]
+	FileMapLock.RUnlock()
+	if !ok {
+		http.Error(w, FILENOTFOUNDMSG, http.StatusNotFound)
+		return
+	}
+	if File.Protected {
+		http.Error(w, WRONGPASSWORDMSG, http.StatusForbidden)
+		return
+	}
+	ContentType := File.ContentType
+	if ContentType == "" {
+		ContentType = DEFAULTCONTENTTYPE
+	}
+	w.Header().Set("Content-Type", ContentType)
+	w.Header().Set("Content-Length", strconv.Itoa(File.Size))
+	if _, err := io.Copy(w, NewListReader(File.Blocks)); err != nil {
+		fmt.Println("Error: ", err)
+	}
+}
+
+/**
+* @brief : Function to cancel all transfers in progress of given direction.
+* @param : Direction : "read" or "write"
+ */
+
+func (Srv *Server) CancelTransfers(Direction string) {
+
+	Srv.TransfersLock.Lock()
+	for _, Status := range Srv.Transfers {
+		if Status.Info.Direction == Direction {
+			Status.Cancel()
+		}
+	}
+	Srv.TransfersLock.Unlock()
+}
+
+/**
+* @brief : Admin HTTP handler for "/transfers/{id}". "DELETE" cancels transfer in progress.
+* @param : Srv : server
+ */
+
+func HandleTransfer(Srv *Server) http.HandlerFunc {
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodDelete {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		ID, err := strconv.ParseInt(strings.TrimPrefix(r.URL.Path, "/transfers/"), 10, 64)
+		if err != nil {
+			http.Error(w, "invalid transfer id", http.StatusBadRequest)
+			return
+		}
+		if !Srv.CancelTransfer(ID) {
+			http.Error(w, "transfer not found", http.StatusNotFound)
+			return
+		}
+		fmt.Println("\n==== Transfer cancelled by admin :[", ID, "]")
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+/**
+* @brief : Function to start admin HTTP server on given address.
+* @param : Srv : server
+* @param : Addr : address to listen on
+ */
+
+func StartAdminServer(Srv *Server, Addr string) {
+
+	Mux := http.NewServeMux()
+	Mux.HandleFunc("/reload", HandleReload)
+	Mux.HandleFunc("/files", func(w http.ResponseWriter, r *http.Request) { //listing of stored files
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(Srv.ListFiles())
+	})
+	Mux.HandleFunc("/files/", HandleFile)
+	Mux.HandleFunc("/transfers", func(w http.ResponseWriter, r *http.Request) { //listing of transfers in progress
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(Srv.ActiveTransfers())
+	})
+	Mux.HandleFunc("/transfers/", HandleTransfer(Srv))
+	Mux.HandleFunc("/capabilities", func(w http.ResponseWriter, r *http.Request) { //options and limits of this instance
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(Srv.Capabilities())
+	})
+	fmt.Println("\n==== admin server started at [", Addr, "]")
+	err := http.ListenAndServe(Addr, Mux)
+	if err != nil {
+		fmt.Println("Error: ", err)
+	}
+}
+
+// bounded queue of requests waiting for worker. Request of higher priority is taken first and
+// requests of same priority are taken in arrival order.
+type RequestQueue struct {
+	Lock  sync.Mutex
+	Items QueuedRequests
+	Seq   int64         // arrival counter
+	Slots chan struct{} // one token per queued request. Full when queue is full
+	Ready chan struct{} // one token per queued request for workers. Closed by Close
+}
+
+// queued request with its priority
+type QueuedRequest struct {
+	Req      *RequestData
+	Priority int
+	Seq      int64
+}
+
+// heap of queued requests (container/heap)
+type QueuedRequests []QueuedRequest
+
+func (Items QueuedRequests) Len() int      { return len(Items) }
+func (Items QueuedRequests) Swap(i, j int) { Items[i], Items[j] = Items[j], Items[i] }
+func (Items QueuedRequests) Less(i, j int) bool {
+	if Items[i].Priority != Items[j].Priority {
+		return Items[i].Priority > Items[j].Priority
+	}
+	return Items[i].Seq < Items[j].Seq
+}
+func (Items *QueuedRequests) Push(Item any) { *Items = append(*Items, Item.(QueuedRequest)) }
+func (Items *QueuedRequests) Pop() any {
+	Old := *Items
+	Item := Old[len(Old)-1]
+	*Items = Old[:len(Old)-1]
+	return Item
+}
+
+func NewRequestQueue(Size int) *RequestQueue {
+
+	return &RequestQueue{Slots: make(chan struct{}, Size), Ready: make(chan struct{}, Size)}
+}
+
+/**
+* @brief : Function to add request to queue. Returns false if queue stays full for Timeout.
+*          Put must not be called after Close.
+* @param : Req : request
+* @param : Priority : priority of request. Higher is served first
+* @param : Timeout : longest wait for free place in queue
+ */
+
+func (Queue *RequestQueue) Put(Req *RequestData, Priority int, Timeout time.Duration) bool {
+
+	select {
+	case Queue.Slots <- struct{}{}:
+	case <-time.After(Timeout):
+		return false
+	}
+	Queue.Lock.Lock()
+	Queue.Seq = Queue.Seq + 1
+	heap.Push(&Queue.Items, QueuedRequest{Req: Req, Priority: Priority, Seq: Queue.Seq})
+	Queue.Lock.Unlock()
+	Queue.Ready <- struct{}{}
+	return true
+}
+
+/**
+* @brief : Function to take request of highest priority, waiting for one if queue is empty.
+*          Returns false when queue is closed and empty.
+ */
+
+func (Queue *RequestQueue) Get() (*RequestData, bool) {
+
+	if _, ok := <-Queue.Ready; !ok {
+		return nil, false
+	}
+	Queue.Lock.Lock()
+	Item := heap.Pop(&Queue.Items).(QueuedRequest)
+	Queue.Lock.Unlock()
+	<-Queue.Slots
+	return Item.Req, true
+}
+
+// Close lets workers exit once queued requests are taken
+func (Queue *RequestQueue) Close() {
+	close(Queue.Ready)
+}
+
+/**
+* @brief : Worker serving requests from queue one by one. Fixed number of workers
+*          are started so number of transfers in progress is limited.
+* @param : Queue : queue of parsed requests
+* @param : Served : called after each request is served
+ */
+
+func (Srv *Server) RequestWorker(Queue *RequestQueue, Served func()) {
+
+	for {
+		Req, ok := Queue.Get()
+		if !ok {
+			return
+		}
+		if Req.OPcode == RRQ {
+			Srv.HandleReadRequest(Req)
+		}
+		if Req.OPcode == WRQ {
+			Srv.HandleWriteRequest(Req)
+		}
+		Srv.ActiveRequests.Delete(RequestKey(Req))
+		Served()
+	}
+}
+
+/**
+* @brief : Function to get key identifying request of client. Client retransmits its request
+*          if it does not get reply in time and same key is used to detect such duplicates.
+* @param : Req : request
+ */
+
+func RequestKey(Req *RequestData) string {
+
+	return fmt.Sprint(Req.OPcode, " ", Req.ClientAddr, " ", Req.FileName)
+}
+
+// TFTP server. It receives requests on listening socket and serves each of them from its own transfer socket.
+type Server struct {
+	ActiveRequests sync.Map    // keys of requests queued or in progress
+	Clock          Clock       // clock used for transfer timeouts and time checks. Real time is used if nil
+	ReadOnly       bool        // write requests are rejected
+	Stopping       atomic.Bool // set when server stop begins
+
+	TransfersLock  sync.Mutex
+	Transfers      map[int64]*TransferStatus // transfers in progress mapped by ID
+	LastTransferID int64                     // protected by TransfersLock
+
+	// hook giving name of stored file to serve for read request of client. Name is served as it is if nil
+	ResolveFilename func(Name string, Client net.Addr) string
+	// hook giving name under which file uploaded by client is stored. Name is used as it is if nil
+	RewriteWriteName func(Name string, Client net.Addr) string
+
+	VirtualFiles sync.Map // VirtualFileProducer mapped by file name. Set by RegisterVirtualFile
+
+	// hooks called when read or write request is completed successfully
+	OnReadComplete  func(Summary TransferSummary)
+	OnWriteComplete func(Summary TransferSummary)
+
+	// hook giving priority of request waiting for worker. Higher is served first. Requests are
+	// served in arrival order if nil
+	Priority func(OPcode uint16, Name string, Client net.Addr) int
+
+	Mirror  MirrorSink     // secondary copy of completed uploads. Disabled if nil
+	Mirrors sync.WaitGroup // mirror copies in progress
+	Dallies sync.WaitGroup // completed reads staying ready for lost final ACK. They do not hold worker
+}
+
+// completed transfer reported to completion hooks
+type TransferSummary struct {
+	FileName  string
+	Client    *net.UDPAddr
+	Options   map[string]string // options negotiated with client as sent in OACK
+	Size      int               // file size in bytes. For read, data bytes acknowledged by client: compressed size with compress option, resumed offset included
+	Delivered int               // file bytes sent to client by this read, before compression and without resumed offset. Zero for write
+	FirstByte time.Duration     // time from read request to first OACK or DATA packet. Zero for write
+	File      *FileEntry        // stored file of write. Nil for read
+
+	Retransmits int // number of DATA (read) or ACK (write) packets resent after timeout
+}
+
+// source of current time. Tests can replace it to control timeouts without waiting. Timer of
+// After must fire when clock reaches given time, so advancing fake clock ends waits of transfers.
+type Clock interface {
+	Now() time.Time
+	After(d time.Duration) <-chan time.Time
+}
+
+// clock giving real time
+type RealClock struct{}
+
+func (RealClock) Now() time.Time {
+	return time.Now()
+}
+
+func (RealClock) After(d time.Duration) <-chan time.Time {
+	return time.After(d)
+}
+
+/**
+* @brief : Function to get current time of server clock.
+ */
+
+func (Srv *Server) Now() time.Time {
+
+	if Srv.Clock == nil {
+		return time.Now()
+	}
+	return Srv.Clock.Now()
+}
+
+// secondary destination of completed uploads (ex. backup). Mirror is called in background and
+// its failure does not affect upload.
+type MirrorSink interface {
+	Mirror(Name string, Data []byte) error
+}
+
+// callback used as MirrorSink
+type MirrorFunc func(Name string, Data []byte) error
+
+func (Fn MirrorFunc) Mirror(Name string, Data []byte) error {
+	return Fn(Name, Data)
+}
+
+// MirrorSink writing uploads to directory given by -mirror-dir. Existing file is replaced.
+type DirMirror struct {
+	Dir string
+}
+
+func (Sink DirMirror) Mirror(Name string, Data []byte) error {
+
+	if !filepath.IsLocal(Name) { //name must not escape mirror directory
+		return fmt.Errorf("file name %q can not be mirrored", Name)
+	}
+	Path := filepath.Join(Sink.Dir, Name)
+	if err := os.MkdirAll(filepath.Dir(Path), 0755); err != nil {
+		return err
+	}
+	Temp, err := os.CreateTemp(filepath.Dir(Path), filepath.Base(Path)+".tmp*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(Temp.Name()) //removing partial file on error. It is already renamed on success
+	if _, err = Temp.Write(Data); err != nil {
+		Temp.Close()
+		return err
+	}
+	if err = Temp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(Temp.Name(), Path)
+}
+
+/**
+* @brief : Function to copy completed upload to Srv.Mirror in background.
+* @param : Name : stored file name
+* @param : File : stored file. Its blocks are never modified so they are read without lock
+ */
+
+func (Srv *Server) MirrorUpload(Name string, File *FileEntry) {
+
+	Srv.Mirrors.Add(1)
+	go func() {
+		defer Srv.Mirrors.Done()
+		Data, _ := io.ReadAll(NewListReader(File.Blocks))
+		if err := Srv.Mirror.Mirror(Name, Data); err != nil {
+			fmt.Println("\n==== Mirror failed for :[", Name, "]", err)
+		}
+	}()
+}
+
+// notifier of completed transfers for -write-webhook-url and -read-webhook-url. NotifyWrite and
+// NotifyRead are used as completion hooks of Server. Notification is POSTed in background so
+// transfer is not delayed by it.
+type Webhook struct {
+	URL     string
+	Client  *http.Client
+	Pending sync.WaitGroup // notifications not sent yet. Waited for on stop
+}
+
+// JSON body POSTed for completed upload
+type WriteEvent struct {
+	FileName string `json:"filename"`
+	Size     int    `json:"size"`
+	Client   string `json:"client"`
+	SHA256   string `json:"sha256"` // hash of file data in hex
+}
+
+// JSON body POSTed for completed read
+type ReadEvent struct {
+	FileName string `json:"filename"`
+	Client   string `json:"client"`
+	Bytes    int    `json:"bytes"` // file bytes delivered by this read. Compression and resumed part are not counted
+}
+
+/**
+* @brief : Function to POST completed upload to webhook in background.
+* @param : Summary : completed write
+ */
+
+func (Hook *Webhook) NotifyWrite(Summary TransferSummary) {
+
+	Hook.Pending.Add(1)
+	go func() {
+		defer Hook.Pending.Done()
+		Hash := sha256.New()
+		io.Copy(Hash, NewListReader(Summary.File.Blocks)) //blocks of stored file are never modified
+		Hook.Deliver(Summary.FileName, WriteEvent{
+			FileName: Summary.FileName,
+			Size:     Summary.Size,
+			Client:   Summary.Client.String(),
+			SHA256:   hex.EncodeToString(Hash.Sum(nil)),
+		})
+	}()
+}
+
+/**
+* @brief : Function to POST completed read to webhook in background.
+* @param : Summary : completed read
+ */
+
+func (Hook *Webhook) NotifyRead(Summary TransferSummary) {
+
+	Hook.Pending.Add(1)
+	go func() {
+		defer Hook.Pending.Done()
+		Hook.Deliver(Summary.FileName, ReadEvent{FileName: Summary.FileName, Client: Summary.Client.String(), Bytes: Summary.Delivered})
+	}()
+}
+
+/**
+* @brief : Function to POST event to webhook. Failed POST (error or status other than 2xx) is
+*          tried again WEBHOOKRETRIES times with doubling pause. Final failure is only logged.
+* @param : Name : file name of transfer
+* @param : Event : JSON body
+ */
+
+func (Hook *Webhook) Deliver(Name string, Event any) {
+
+	Body, _ := json.Marshal(Event)
+	Backoff := WEBHOOKBACKOFF
+	for Attempt := 0; ; Attempt++ {
+		err := Hook.Post(Body)
+		if err == nil {
+			return
+		}
+		if Attempt >= WEBHOOKRETRIES {
+			fmt.Println("\n==== Webhook failed for :[", Name, "]", err)
+			return
+		}
+		time.Sleep(Backoff)
+		Backoff = Backoff * 2
+	}
+}
+
+/**
+* @brief : Function to POST JSON body to webhook once.
+* @param : Body : JSON body
+ */
+
+func (Hook *Webhook) Post(Body []byte) error {
+
+	Resp, err := Hook.Client.Post(Hook.URL, "application/json", bytes.NewReader(Body))
+	if err != nil {
+		return err
+	}
+	defer Resp.Body.Close()
+	io.Copy(io.Discard, Resp.Body) //connection can be reused only if body is read
+	if Resp.StatusCode < 200 || Resp.StatusCode > 299 {
+		return fmt.Errorf("webhook replied %s", Resp.Status)
+	}
+	return nil
+}
+
+// function producing content of virtual file for client reading it. Its error is sent to client
+// with TFTP error code of StorageErrorCode (ex. disk full for ENOSPC of file it reads)
+type VirtualFileProducer func(Client net.Addr) ([]byte, error)
+
+/**
+* @brief : Function to register virtual file. Its content is produced by Producer at each read
+*          instead of being stored. Virtual file hides stored file of same name. It can not be written
+*          unless -virtual-writes is shadow, in which case uploaded file is served in its place.
+* @param : Name : file name
+* @param : Producer : function producing file content for client
+ */
+
+func (Srv *Server) RegisterVirtualFile(Name string, Producer func(Client net.Addr) ([]byte, error)) {
+
+	Srv.VirtualFiles.Store(Name, VirtualFileProducer(Producer))
+}
+
+/**
+* @brief : Function to log progress line of transfer. Nothing is logged with -slow-log-threshold
+*          as only slow transfers are logged then.
+* @param : Line : values printed as by fmt.Println
+ */
+
+func LogTransfer(Line ...any) {
+
+	if *SlowLogThreshold == 0 {
+		fmt.Println(Line...)
+	}
+}
+
+/**
+* @brief : Function to log completion of transfer. With -slow-log-threshold only transfer
+*          slower than threshold is logged as warning with its duration and blocks.
+* @param : Status : transfer
+* @param : Line : values printed as by fmt.Println
+ */
+
+func LogCompleted(Status *TransferStatus, Line ...any) {
+
+	if *SlowLogThreshold == 0 {
+		fmt.Println(Line...)
+		return
+	}
+	if Duration := time.Since(Status.Info.StartedAt); Duration > *SlowLogThreshold {
+		fmt.Println("\n==== Warning: slow", Status.Info.Direction, "transfer of :[", Status.Info.FileName, "] client :[", Status.Info.Client,
+			"] duration :", Duration.Round(time.Millisecond), "blocks :", Status.Block.Load(), "bytes :", Status.Bytes.Load())
+	}
+}
+
+/**
+* @brief : Function to register transfer in progress. It must be removed by EndTransfer when handler exits.
+* @param : ReqData : request of transfer
+* @param : Direction : "read" or "write"
+ */
+
+func (Srv *Server) StartTransfer(ReqData *RequestData, Direction string) *TransferStatus {
+
+	Srv.TransfersLock.Lock()
+	defer Srv.TransfersLock.Unlock()
+	if Srv.Transfers == nil {
+		Srv.Transfers = make(map[int64]*TransferStatus)
+	}
+	Srv.LastTransferID = Srv.LastTransferID + 1
+	Status := &TransferStatus{Info: TransferInfo{
+		ID:        Srv.LastTransferID,
+		FileName:  ReqData.FileName,
+		Direction: Direction,
+		Client:    ReqData.ClientAddr.String(),
+		StartedAt: time.Now(),
+	}}
+	Status.Ctx, Status.Cancel = context.WithCancel(context.Background())
+	Srv.Transfers[Status.Info.ID] = Status
+	return Status
+}
+
+/**
+* @brief : Function to remove finished transfer from registry of transfers in progress.
+* @param : Status : transfer registered by StartTransfer
+ */
+
+func (Srv *Server) EndTransfer(Status *TransferStatus) {
+
+	Srv.TransfersLock.Lock()
+	delete(Srv.Transfers, Status.Info.ID)
+	Srv.TransfersLock.Unlock()
+	Status.Cancel() //releasing context
+}
+
+/**
+* @brief : Function to cancel transfer in progress. Client gets error packet and handler exits.
+*          It returns false if transfer is not found.
+* @param : ID : transfer ID
+ */
+
+func (Srv *Server) CancelTransfer(ID int64) bool {
+
+	Srv.TransfersLock.Lock()
+	Status, ok := Srv.Transfers[ID]
+	Srv.TransfersLock.Unlock()
+	if ok {
+		Status.Cancel()
+	}
+	return ok
+}
+
+/**
+* @brief : Function to get snapshot of transfers in progress sorted by ID.
+ */
+
+func (Srv *Server) ActiveTransfers() []TransferInfo {
+
+	Srv.TransfersLock.Lock()
+	Transfers := make([]TransferInfo, 0, len(Srv.Transfers))
+	for _, Status := range Srv.Transfers {
+		Info := Status.Info
+		Info.Bytes = Status.Bytes.Load()
+		Info.Block = Status.Block.Load()
+		Transfers = append(Transfers, Info)
+	}
+	Srv.TransfersLock.Unlock()
+	sort.Slice(Transfers, func(i, j int) bool { return Transfers[i].ID < Transfers[j].ID })
+	return Transfers
+}
+
+/**
+* @brief : Function to get options, modes and limits of running server.
+*          Blksize range is the one clients actually get after clamping by
+*          -min-blksize and -max-unfragmented-blksize.
+ */
+
+func (Srv *Server) Capabilities() Capabilities {
+
+	MinBlockSize, MaxBlockSize := max(MINBLKSIZE, *MinBlksize), MAXBLKSIZE
+	if *MaxUnfragmentedBlksize > 0 {
+		MaxBlockSize = min(MaxBlockSize, max(*MaxUnfragmentedBlksize, MinBlockSize))
+	}
+	Options := []string{"blksize", "windowsize", "stat", "ratelimit", "pw", "tsize", "mtime", "contenttype", "pinned", "maxreads", "deadline", "compress"}
+	if *ResumeTTL > 0 {
+		Options = append(Options, "resume")
+	}
+	return Capabilities{
+		Options:            Options,
+		Modes:              TransferModes,
+		UnknownMode:        *UnknownMode,
+		NetasciiConversion: false,
+		MinBlksize:         MinBlockSize,
+		MaxBlksize:         MaxBlockSize,
+		MaxWindowsize:      max(*MaxWindowsize, 1),
+		RateLimitBps:       *RateLimitBps,
+		ReadOnly:           Srv.ReadOnly,
+		MaxRequestSize:     *MaxRequestSize,
+		MaxOptions:         *MaxOptions,
+		MaxOptionsLength:   *MaxOptionsLength,
+		Workers:            *Workers,
+		ResumeTTL:          ResumeTTL.String(),
+		OneShot:            *OneShot,
+		Dedup:              *Dedup,
+		Upstream:           *Upstream,
+		SinglePort:         *SinglePort,
+	}
+}
+
+/**
+* @brief : Function to get snapshot of stored files sorted by name.
+*          Returned slice is not affected by later changes of stored files.
+ */
+
+func (Srv *Server) ListFiles() []FileInfo {
+
+	FileMapLock.RLock()
+	Files := make([]FileInfo, 0, len(FileMap))
+	for Name, File := range FileMap {
+		Files = append(Files, FileInfo{Name: Name, Size: File.Size, Blocks: File.Blocks.Len(), ModTime: File.ModTime, LastReadAt: File.LastReadAt, Reads: File.Reads.Load(), Pinned: File.Pinned, MaxReads: File.MaxReads})
+	}
+	FileMapLock.RUnlock()
+	sort.Slice(Files, func(i, j int) bool { return Files[i].Name < Files[j].Name })
+	return Files
+}
+
+// read-only fs.FS view of stored files returned by Server.FS. Names with "/" appear as
+// directories. Files protected by pw option and names which are not valid fs paths are left out.
+type StoreFS struct{}
+
+// fs.FileInfo and fs.DirEntry of file or directory of StoreFS
+type StoreFileInfo struct {
+	FileName  string
+	FileSize  int64
+	Modified  time.Time
+	Directory bool
+}
+
+func (Info StoreFileInfo) Name() string               { return Info.FileName }
+func (Info StoreFileInfo) Size() int64                { return Info.FileSize }
+func (Info StoreFileInfo) ModTime() time.Time         { return Info.Modified }
+func (Info StoreFileInfo) IsDir() bool                { return Info.Directory }
+func (Info StoreFileInfo) Sys() any                   { return nil }
+func (Info StoreFileInfo) Type() fs.FileMode          { return Info.Mode().Type() }
+func (Info StoreFileInfo) Info() (fs.FileInfo, error) { return Info, nil }
+func (Info StoreFileInfo) Mode() fs.FileMode {
+	if Info.Directory {
+		return fs.ModeDir | 0555
+	}
+	return 0444
+}
+
+// opened file of StoreFS. Data is copied at open so later uploads do not affect it
+type StoreOpenFile struct {
+	*bytes.Reader
+	Info StoreFileInfo
+}
+
+func (File *StoreOpenFile) Stat() (fs.FileInfo, error) { return File.Info, nil }
+func (File *StoreOpenFile) Close() error               { return nil }
+
+// opened directory of StoreFS. Entries are listed at open
+type StoreOpenDir struct {
+	Info    StoreFileInfo
+	Entries []fs.DirEntry
+	Pos     int
 }
 
-//Map containing file name and its list of blocks. This is small part of file system implementation.
-// It maps file name to its data blocks
-var FileMap map[string]*list.List
+func (Dir *StoreOpenDir) Stat() (fs.FileInfo, error) { return Dir.Info, nil }
+func (Dir *StoreOpenDir) Close() error               { return nil }
+func (Dir *StoreOpenDir) Read([]byte) (int, error) {
+	return 0, &fs.PathError{Op: "read", Path: Dir.Info.FileName, Err: errors.New("is a directory")}
+}
+
+func (Dir *StoreOpenDir) ReadDir(Count int) ([]fs.DirEntry, error) {
+
+	Rest := Dir.Entries[Dir.Pos:]
+	if Count > 0 {
+		if len(Rest) == 0 {
+			return nil, io.EOF
+		}
+		Rest = Rest[:min(Count, len(Rest))]
+	}
+	Dir.Pos = Dir.Pos + len(Rest)
+	return Rest, nil
+}
 
 /**
-* @brief : Fucntion to Parse Request received from client.
-* @param : buf: Raw data of request.
-* @param : ReqLen: request length
-* @param : ReqData: result of parsing
+* @brief : Function to get fs.FS view of stored files for use with io/fs functions.
  */
-func ParseRequest(buf []byte, ReqLen uint16, ReqData *RequestData) {
 
-	ReqData.OPcode = binary.BigEndian.Uint16(buf[0:2]) //opcode
-	pos := strings.IndexByte(string(buf[2:]), 0x00)
-	ReqData.FileName = string(buf[2 : pos+2])    // extracting file name
-	ReqData.Mode = string(buf[pos+3 : ReqLen-1]) // extracting operating mode.
+func (Srv *Server) FS() fs.FS {
+
+	return StoreFS{}
 }
 
 /**
-* @brief : Function to send ack packet to client
-* @param : BlockNo : Block number to acknoledge
-* @param : conn : client connection
+* @brief : Function to get stored file visible in StoreFS. FileMapLock must be held.
+* @param : Name : file name
  */
 
-func SendACKPacket(BlockNo uint16, Conn *net.UDPConn) {
+func VisibleFile(Name string) (*FileEntry, bool) {
 
-	var ack_data []byte = make([]byte, 4)
-	offset := 0
-	binary.BigEndian.PutUint16(ack_data[offset:], ACK) //setting OPCODE as ACK
-	offset = offset + 2
-	binary.BigEndian.PutUint16(ack_data[offset:], BlockNo) // setting BLOCK number Acknoledged
-	_, err := Conn.Write(ack_data)                         //writing ACK packet to client
+	File, ok := FileMap[Name]
+	if !ok || File.Protected || !fs.ValidPath(Name) || Name == "." {
+		return nil, false
+	}
+	return File, true
+}
+
+func (StoreFS) Open(Name string) (fs.File, error) {
+
+	if !fs.ValidPath(Name) {
+		return nil, &fs.PathError{Op: "open", Path: Name, Err: fs.ErrInvalid}
+	}
+	FileMapLock.RLock()
+	File, ok := VisibleFile(Name)
+	FileMapLock.RUnlock()
+	if ok { //blocks are never modified so they are read without lock
+		Data, _ := io.ReadAll(NewListReader(File.Blocks))
+		return &StoreOpenFile{Reader: bytes.NewReader(Data), Info: StoreFileInfo{FileName: path.Base(Name), FileSize: int64(File.Size), Modified: File.ModTime}}, nil
+	}
+	Entries, err := StoreFS{}.ReadDir(Name)
 	if err != nil {
-		fmt.Println("Error: ", err)
-		return
+		return nil, &fs.PathError{Op: "open", Path: Name, Err: fs.ErrNotExist}
+	}
+	return &StoreOpenDir{Info: StoreFileInfo{FileName: path.Base(Name), Directory: true}, Entries: Entries}, nil
+}
+
+func (StoreFS) ReadFile(Name string) ([]byte, error) {
+
+	if !fs.ValidPath(Name) {
+		return nil, &fs.PathError{Op: "readfile", Path: Name, Err: fs.ErrInvalid}
 	}
+	FileMapLock.RLock()
+	File, ok := VisibleFile(Name)
+	FileMapLock.RUnlock()
+	if !ok {
+		return nil, &fs.PathError{Op: "readfile", Path: Name, Err: fs.ErrNotExist}
+	}
+	return io.ReadAll(NewListReader(File.Blocks))
 }
 
 /**
-* @brief : Function to send Error packet to client
-* @param : ErrNo : Error Number
-* @param : ErrStr : Error string associated with that error number
-* @param : conn : client connection
+* @brief : Function to list directory of StoreFS sorted by name. Directory exists if any
+*          visible file name starts with its name and "/". Root "." always exists.
+* @param : Name : directory name
  */
 
-func SendErrorPacket(ErrNo uint16, ErrStr string, Conn *net.UDPConn) {
+func (StoreFS) ReadDir(Name string) ([]fs.DirEntry, error) {
 
-	fmt.Println("\n==== Error packet ===== ", ErrStr)
-	var ErrPkt []byte = make([]byte, 5+len(ErrStr))
-	offset := 0
-	binary.BigEndian.PutUint16(ErrPkt[offset:], ERROR) //setting OPCODE as ERROR
-	offset = offset + 2
-	binary.BigEndian.PutUint16(ErrPkt[offset:], ErrNo) //setting Error no
-	offset = offset + 2
-	copy(ErrPkt[offset:], ErrStr) //setting error string
-	offset = offset + len(ErrStr)
-	ErrPkt[offset] = 0x00
-	_, err := Conn.Write(ErrPkt) //writing Error packet to client
-	if err != nil {
-		fmt.Println("Error: ", err)
-		return
+	if !fs.ValidPath(Name) {
+		return nil, &fs.PathError{Op: "readdir", Path: Name, Err: fs.ErrInvalid}
+	}
+	Prefix := Name + "/"
+	if Name == "." {
+		Prefix = ""
+	}
+	Children := make(map[string]StoreFileInfo)
+	FileMapLock.RLock()
+	for FileName := range FileMap {
+		File, ok := VisibleFile(FileName)
+		if !ok || !strings.HasPrefix(FileName, Prefix) {
+			continue
+		}
+		Child, Rest, Nested := strings.Cut(FileName[len(Prefix):], "/")
+		if Nested && Rest != "" { //file in subdirectory
+			Children[Child] = StoreFileInfo{FileName: Child, Directory: true}
+		} else if _, Seen := Children[Child]; !Seen {
+			Children[Child] = StoreFileInfo{FileName: Child, FileSize: int64(File.Size), Modified: File.ModTime}
+		}
+	}
+	FileMapLock.RUnlock()
+	if len(Children) == 0 && Name != "." {
+		return nil, &fs.PathError{Op: "readdir", Path: Name, Err: fs.ErrNotExist}
 	}
+	Entries := make([]fs.DirEntry, 0, len(Children))
+	for _, Info := range Children {
+		Entries = append(Entries, Info)
+	}
+	sort.Slice(Entries, func(i, j int) bool { return Entries[i].Name() < Entries[j].Name() })
+	return Entries, nil
 }
 
 /**
-* @brief : Function to handle Write Request. This will write data to main mamory not on disk.
-* @param : ReqData: Request iformation
+* @brief : Function to listen on given address and serve requests until context is cancelled.
+* @param : Ctx : context. Server stops when it is cancelled
+* @param : Addr : address to listen on [ip address:port]
  */
 
-func HandleWriteRequest(ReqData *RequestData) {
-
-	var ACKNo uint16
-	var FileBlocklist *list.List
-	ACKNo = 0
-
-	/*after intial request we will use different local port(TID) to do further data
-	transfer so creating new address with different port and connecting to client.*/
+func (Srv *Server) ListenAndServe(Ctx context.Context, Addr string) error {
 
-	RequestAddr, err := net.ResolveUDPAddr("udp", ":0")
+	ServerAddr, err := net.ResolveUDPAddr("udp", Addr) //setting port on which tftp server listen for requests.
 	if err != nil {
-		fmt.Println("Error: ", err)
-		return
+		return err
+	}
+
+	//socket of explicit IPv4 or IPv6 address serves only its own family. Other one can be given as another address
+	Network := "udp"
+	if ServerAddr.IP.To4() != nil {
+		Network = "udp4"
+	} else if ServerAddr.IP != nil {
+		Network = "udp6"
+	}
+	var Config net.ListenConfig
+	if *SinglePort && *DSCP > 0 && TOSSupported { //transfer packets are sent from listening socket so it is marked
+		Config.Control = func(Network string, Address string, RawConn syscall.RawConn) error {
+			return SetSocketTOS(Network, RawConn, *DSCP<<2)
+		}
 	}
-	NewConn, err := net.DialUDP("udp", RequestAddr, ReqData.ClientAddr)
+	ServerConn, err := Config.ListenPacket(Ctx, Network, ServerAddr.String()) //listening on given port for request
 	if err != nil {
-		fmt.Println("Error: ", err)
-		return
+		return err
 	}
-	defer NewConn.Close() //defering connection close to end of request handling.
+	return Srv.ServeConn(Ctx, ServerConn)
+}
 
-	FileBlocklist = list.New()
-	RetryCnt := 0
-	if _, ok := FileMap[ReqData.FileName]; ok { //checking file already exists. if yes send error message
-		SendErrorPacket(FILEEXISTS, FILEEXISTSMSG, NewConn)
-		return
+/**
+* @brief : Function to serve requests received on already bound socket until context is cancelled.
+*          Socket is closed when function returns.
+* @param : Ctx : context. Server stops when it is cancelled
+* @param : ServerConn : listening socket
+ */
+
+func (Srv *Server) ServeConn(Ctx context.Context, ServerConn net.PacketConn) error {
+
+	if *Banner == "json" { //single line for scripts. Port chosen by system for port 0 is reported
+		Line, _ := json.Marshal(map[string]string{"addr": ServerConn.LocalAddr().String()})
+		fmt.Println(string(Line))
 	} else {
-		fmt.Println("\n==== Write Started for :[", ReqData.FileName, "]") // Sending first ACK to client
-		SendACKPacket(ACKNo, NewConn)
+		fmt.Println("\n==== server started at [", ServerConn.LocalAddr(), "]")
 	}
+	defer ServerConn.Close()
 
-	ACKNo = ACKNo + 1
-	TempBuf := make([]byte, FILEBLOCKSIZE+4)
+	//on stop requests arriving while transfers in progress are finishing get shutdown error.
+	//Socket is closed to unblock reading from it when no request is queued or in progress.
+	var Pending atomic.Int64
+	WaitWrites := *ShutdownWrites == "wait" //read before stop, flags may be changed meanwhile by embedding program
+	Served := func() {
+		if Pending.Add(-1) == 0 && Ctx.Err() != nil {
+			ServerConn.Close()
+		}
+	}
+	go func() {
+		<-Ctx.Done()
+		fmt.Println("\n==== server stopping. Waiting for transfers in progress")
+		Srv.Stopping.Store(true)
+		if !WaitWrites { //uploads are not waited for
+			Srv.CancelTransfers("write")
+		}
+		if Pending.Load() == 0 {
+			ServerConn.Close()
+		}
+	}()
+
+	var Mux *PortMux
+	buf := make([]byte, *MaxRequestSize+1) //one byte more to detect request longer than limit
+	if *SinglePort {                       //transfers are done from this socket too so it also receives biggest DATA packets
+		Mux = NewPortMux(ServerConn)
+		buf = make([]byte, max(*MaxRequestSize+1, MAXBLKSIZE+4))
+	}
+	Queue := NewRequestQueue(*Workers)
+	var WorkersDone, Enqueuing sync.WaitGroup
+	defer func() { //graceful stop. workers exit after serving queued requests and requests in progress
+		Enqueuing.Wait()
+		Queue.Close()
+		WorkersDone.Wait()
+		Srv.Dallies.Wait()
+		fmt.Println("\n==== server stopped [", ServerConn.LocalAddr(), "]")
+	}()
+	for i := 0; i < *Workers; i++ {
+		WorkersDone.Add(1)
+		go func() {
+			defer WorkersDone.Done()
+			Srv.RequestWorker(Queue, Served)
+		}()
+	}
 
 	for {
-		//setting read timeout
-		NewConn.SetReadDeadline(time.Now().Add(TIMEOUT * time.Second))
-		byte_read, _, err := NewConn.ReadFromUDP(TempBuf) //reading data to write from client
+		n, addr, err := ServerConn.ReadFrom(buf) //read request from client
+		//		fmt.Println("Received ", buf[0:n], " from ", addr)
 		if err != nil {
-			TimeoutErr, Status := err.(net.Error)
-			if Status && TimeoutErr.Timeout() { //if timeout occured then try again to read
-				if RetryCnt >= 3 { // if retry count is reached to limit then return
-					fmt.Println("\n==== TIMEOUT in Reading from client :[", ReqData.ClientAddr, "]")
-					return
+			if Ctx.Err() != nil { //server is stopped
+				return nil
+			}
+			return err
+		}
+		ClientAddr, ok := addr.(*net.UDPAddr)
+		if !ok {
+			fmt.Println("Error: request from not UDP address ", addr)
+			continue
+		}
+		if Mux != nil && n >= 2 { //packets other than requests belong to transfers
+			OPcode := binary.BigEndian.Uint16(buf)
+			if OPcode == DATA || OPcode == ACK || OPcode == ERROR {
+				if !Mux.Deliver(ClientAddr, buf[:n]) && OPcode != ERROR { //error is never answered with error
+					SendErrorPacketTo(UNKNOWNID, UNKNOWNTIDMSG, ServerConn, ClientAddr)
 				}
-				SendACKPacket(ACKNo-1, NewConn) //sending previous ack again while retrying may be it get lost.
-				RetryCnt = RetryCnt + 1         // increment retry count
 				continue
 			}
-			//if other error occured then send error message and discard this request
-			SendErrorPacket(UNKNOWNERROR, string("Error not able to receive data at server from client"), NewConn)
-			return
 		}
-		ReadBuf := make([]byte, byte_read-4)
-		//		fmt.Println("byte read in writing", byte_read)
-		offset := 0
-		OPcode := binary.BigEndian.Uint16(TempBuf[offset:])
-		offset = offset + 2
-		BlockNo := binary.BigEndian.Uint16(TempBuf[offset:])
-		offset = offset + 2
-		//		fmt.Println("block received ", BlockNo)
-		if OPcode == ERROR { // if opcode is error then stop this request and discard it
-			fmt.Println("Error received from client")
-			return
+		Req := &RequestData{ReceivedAt: time.Now()}
+		if n > *MaxRequestSize { //request is truncated so it can not be parsed correctly
+			err = NewParseError(buf[:*MaxRequestSize], *MaxRequestSize, "Request too long")
+		} else {
+			err = ParseRequest(buf, uint16(n), Req) //parse the request
+		}
+		if err == nil && (Req.OPcode == RRQ || Req.OPcode == WRQ) {
+			err = ApplyModePolicy(Req)
+		}
+		Req.ClientAddr = ClientAddr
+		Req.Mux = Mux
+		if err != nil { //replying illegal operation for packet which is not valid request
+			var ParseErr *ParseError
+			if errors.As(err, &ParseErr) { //garbage, scans or malformed requests are counted apart from rejected requests
+				Stats.Quarantined.Add(1)
+				fmt.Println("\n==== Invalid packet from :[", ClientAddr, "] offset :", ParseErr.Offset, "raw :", ParseErr.Raw)
+			}
+			SendErrorPacketTo(ILLEGALOP, err.Error(), ServerConn, ClientAddr)
+			continue
 		}
 
-		if BlockNo != ACKNo {
-			fmt.Println("==== Out of order Data Packet received from client ")
-			return
+		if Req.OPcode == ERROR { // If error message received then do nothing
+			fmt.Println(" Error received from client ")
+			continue
+		}
+		if Req.OPcode == RRQ {
+			LogTransfer("\n==== Read reqeust file : [", Req.FileName, "] & client : [", Req.ClientAddr, "]")
+		}
+		if Req.OPcode == WRQ {
+			LogTransfer("\n==== Write reqeust file : [", Req.FileName, "] from client : [", Req.ClientAddr, "]")
+		}
+		if Req.OPcode != RRQ && Req.OPcode != WRQ {
+			continue
+		}
+		if FilenameRegexp != nil && !FilenameRegexp.MatchString(Req.FileName) { //name not allowed on this server
+			SendErrorPacketTo(ACCESSVIOLATION, FILENAMEMSG, ServerConn, Req.ClientAddr)
+			continue
+		}
+		if Req.OPcode == WRQ && Srv.ReadOnly { //rejecting upload before any transfer socket is created
+			SendErrorPacketTo(ACCESSVIOLATION, READONLYMSG, ServerConn, Req.ClientAddr)
+			continue
+		}
+		if Ctx.Err() != nil { //server is stopping so client can try other server without waiting
+			SendErrorPacketTo(UNKNOWNERROR, SHUTDOWNMSG, ServerConn, Req.ClientAddr)
+			continue
+		}
+		if _, Duplicate := Srv.ActiveRequests.LoadOrStore(RequestKey(Req), true); Duplicate {
+			//retransmitted request. It is already being served so reply will come from its transfer socket
+			fmt.Println("\n==== Duplicate request ignored file : [", Req.FileName, "] from client : [", Req.ClientAddr, "]")
+			continue
+		}
+
+		Pending.Add(1)
+		Priority := 0
+		if Srv.Priority != nil {
+			Priority = Srv.Priority(Req.OPcode, Req.FileName, Req.ClientAddr)
+		}
+		Enqueue := func() { //handing over request to free worker. If all are busy for long then reply busy error
+			if !Queue.Put(Req, Priority, *QueueTimeout) {
+				Srv.ActiveRequests.Delete(RequestKey(Req))
+				SendErrorPacketTo(UNKNOWNERROR, SERVERBUSYMSG, ServerConn, Req.ClientAddr)
+				Served()
+			}
+		}
+		if Mux != nil { //waiting for worker must not stop routing of packets to transfers in progress
+			Enqueuing.Add(1)
+			go func() {
+				defer Enqueuing.Done()
+				Enqueue()
+			}()
+		} else {
+			Enqueue()
 		}
+	}
+}
 
-		_ = copy(ReadBuf, TempBuf[offset:])
+/**
+* @brief : Function to log statistics line periodically until context is cancelled.
+* @param : Ctx : context
+* @param : Interval : interval between log lines
+ */
 
-		//		byte_copied := copy(ReadBuf, TempBuf[offset:])
-		//		fmt.Println("byte copied in writing", byte_copied)
+func LogStats(Ctx context.Context, Interval time.Duration) {
 
-		FileBlocklist.PushBack(ReadBuf) // add received block to list of block of given file
-		//		fmt.Println("ACK for writing ", ACKNo)
-		SendACKPacket(ACKNo, NewConn) //sending ACK for received block
-		ACKNo = ACKNo + 1
-		RetryCnt = 0
-		if byte_read < 516 { //checking for last packet received
-			break
+	Ticker := time.NewTicker(Interval)
+	defer Ticker.Stop()
+	for {
+		select {
+		case <-Ctx.Done():
+			return
+		case <-Ticker.C:
+		}
+		StoredBytes := 0
+		FileMapLock.RLock()
+		FileCount := len(FileMap)
+		for _, File := range FileMap {
+			StoredBytes = StoredBytes + File.Size
+		}
+		FileMapLock.RUnlock()
+		FirstByte := time.Duration(0) //average time to first byte of reads
+		if Count := Stats.FirstByteCount.Load(); Count > 0 {
+			FirstByte = time.Duration(Stats.FirstByteNanos.Load() / Count)
 		}
+		fmt.Println("\n==== Stats : active transfers", Stats.ActiveTransfers.Load(), "stored bytes", StoredBytes, "files", FileCount,
+			"reads", Stats.Reads.Load(), "writes", Stats.Writes.Load(), "errors", Stats.Errors.Load(), "quarantined", Stats.Quarantined.Load(), "avg first byte", FirstByte)
 	}
-	//adding file blocks list to file map. Adding it here so file will be only
-	//visible after it is stored in map
-	FileMap[ReqData.FileName] = FileBlocklist
-	fmt.Println("\n==== Write Completed for :[", ReqData.FileName, "]")
-	return
 }
 
 /**
-* @brief : Function to handle Read Request. Read data from main memory and sent to client
-* @param : ReqData: Request iformation
+* @brief : Function to get listening socket passed by systemd socket activation.
+*          systemd passes sockets from file descriptor 3 onwards and sets LISTEN_PID and LISTEN_FDS.
+*          Returns nil socket if server is not started by socket activation.
  */
 
-func HandleReadRequest(ReqData *RequestData) {
+func SystemdPacketConn() (net.PacketConn, error) {
 
-	var FileBlocklist *list.List
-	var ok bool
+	if Pid := os.Getenv("LISTEN_PID"); Pid != "" && Pid != strconv.Itoa(os.Getpid()) {
+		return nil, nil //variables are meant for other process
+	}
+	Fds, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || Fds < 1 {
+		return nil, nil
+	}
+	os.Unsetenv("LISTEN_PID") //not passing them to child processes
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_FDNAMES")
+
+	File := os.NewFile(3, "LISTEN_FD_3") //only first passed socket is used
+	defer File.Close()
+	Conn, err := net.FilePacketConn(File)
+	if err != nil {
+		return nil, fmt.Errorf("socket activation: %v", err)
+	}
+	return Conn, nil
+}
 
-	/*after intial request we will use different local port(TID) to do further data
-	transfer so creating new address with different port and connecting to client.*/
+func main() {
 
-	RequestAddr, err := net.ResolveUDPAddr("udp", ":0")
+	flag.Var(&Aliases, "subnet-alias", "serve different file to clients of subnet. name=subnet:target (can be given many times)")
+	flag.Parse()
+	ActivatedConn, err := SystemdPacketConn() //socket passed by systemd is used in place of address if present
 	if err != nil {
 		fmt.Println("Error: ", err)
+		os.Exit(1)
+	}
+	if ActivatedConn == nil {
+		if flag.NArg() < 1 {
+			fmt.Println("\n==== Please enter command line argument := [options] [ip address:port] [ip address:port]...")
+			flag.PrintDefaults()
+			return
+		}
+		for _, Addr := range flag.Args() {
+			if err := ValidateAddress(Addr); err != nil {
+				fmt.Println("\n====", err)
+				return
+			}
+		}
+	}
+
+	if *MaxUnfragmentedBlksize < 0 || *MaxUnfragmentedBlksize > MAXBLKSIZE || (*MaxUnfragmentedBlksize > 0 && *MaxUnfragmentedBlksize < MINBLKSIZE) {
+		fmt.Println("\n==== Please enter max unfragmented blksize 0 or in range [", MINBLKSIZE, ":", MAXBLKSIZE, "]")
 		return
 	}
-	NewConn, err := net.DialUDP("udp", RequestAddr, ReqData.ClientAddr)
-	if err != nil {
-		fmt.Println("Error: ", err)
+	if *UpstreamBlksize < MINBLKSIZE || *UpstreamBlksize > MAXBLKSIZE {
+		fmt.Println("\n==== Please enter upstream blksize in range [", MINBLKSIZE, ":", MAXBLKSIZE, "]")
 		return
 	}
-	defer NewConn.Close() //defering connection close to end of request handling.
-
-	if FileBlocklist, ok = FileMap[ReqData.FileName]; !ok { //checking for file availability.
-		SendErrorPacket(FILENOTFOUND, FILENOTFOUNDMSG, NewConn) //if not exist send error message of "file not found"
+	if *MinBlksize > MAXBLKSIZE {
+		fmt.Println("\n==== Please enter minimum blksize not more than", MAXBLKSIZE)
 		return
 	}
-	fmt.Println("\n==== Read Started for :[", ReqData.FileName, "]")
-	DataToSend := make([]byte, FILEBLOCKSIZE+4)
-	ACKRec := make([]byte, 1024)
-	var BlockCount uint16 = 1 //block count for sending ACK
-	RetryCnt := 0
-
-	for e := FileBlocklist.Front(); e != nil; { //iterating over all files blocks in its list
-
-		offset := 0
-		binary.BigEndian.PutUint16(DataToSend[offset:], DATA) //setting opcode DATA in packet
-		offset = offset + 2
-		binary.BigEndian.PutUint16(DataToSend[offset:], BlockCount) //setting Block number in packet
-		offset = offset + 2
-		ByteCopied := copy(DataToSend[offset:], e.Value.([]byte)) // copying block data in packet
-
-		//		fmt.Println("byte copied to send ", ByteCopied)
-
-		_, err := NewConn.Write(DataToSend[:4+ByteCopied]) //writing data packet to client
-		//		fmt.Println("byte copied to send ", byte_written)
-		if err != nil {
-			fmt.Println("Error: ", err)
-			return
-		}
-		//reading ACK for data sent above
-		// Setting read deadine for timeout and trying to read for 3 attempt.
-		NewConn.SetReadDeadline(time.Now().Add(TIMEOUT * time.Second))
-		_, _, err = NewConn.ReadFromUDP(ACKRec)
+	if *DSCP < 0 || *DSCP > 63 {
+		fmt.Println("\n==== Please enter DSCP value in range [0:63]")
+		return
+	}
+	if *TransferPortRange != "" {
+		var err error
+		TransferPortLow, TransferPortHigh, err = ParsePortRange(*TransferPortRange)
 		if err != nil {
-			TimeoutErr, Status := err.(net.Error)
-			if Status && TimeoutErr.Timeout() {
-				if RetryCnt >= 3 { // if retry reach to thresold then stop and discard the reqeust.
-					fmt.Println("\n==== TIMEOUT in Reading from client :[", ReqData.ClientAddr, "]")
-					return
-				}
-				RetryCnt = RetryCnt + 1
-				continue //trying again if not enough retry done
-			}
-			//  send error message to client. Unknown error
-			SendErrorPacket(UNKNOWNERROR, string("Error not able to receive ACK at server from client"), NewConn)
+			fmt.Println("\n==== Invalid transfer port range :", err)
 			return
 		}
-
-		offset = 0
-		OPcode := binary.BigEndian.Uint16(ACKRec[offset:])
-		offset = offset + 2
-		BlockNoFromACK := binary.BigEndian.Uint16(ACKRec[offset:])
-
-		//		fmt.Println("Opcode ", OPcode, "block no ", BlockNoFromACK)
-
-		if OPcode == ERROR { // If error received instead of ACK then stop this request and discard it
-			fmt.Println("Error received from client")
+	}
+	if *ShutdownWrites != "wait" && *ShutdownWrites != "abort" && *ShutdownWrites != "commit" {
+		fmt.Println("\n==== Please enter shutdown writes as wait, abort or commit")
+		return
+	}
+	if *FilenamePattern != "" {
+		var err error
+		if FilenameRegexp, err = regexp.Compile(*FilenamePattern); err != nil {
+			fmt.Println("\n==== Invalid filename pattern :", err)
 			return
 		}
-
-		if OPcode == ACK && BlockNoFromACK == BlockCount { //if ack received for last packet sent then send next data block
-			BlockCount = BlockCount + 1
-			e = e.Next()
-			RetryCnt = 0 //resetting retry count if ACK received successfully
-		}
 	}
-	fmt.Println("\n==== Read Completed for :[", ReqData.FileName, "]")
-}
-
-func main() {
-
-	if len(os.Args) < 2 {
-		fmt.Println("\n==== Please enter command line argument := [ip address:port] \n")
+	if *VirtualWrites != "reject" && *VirtualWrites != "shadow" {
+		fmt.Println("\n==== Please enter virtual writes as reject or shadow")
 		return
 	}
-
-	IpPort := strings.Split(os.Args[1], ":") //checking for port number it must be different than 59
-	if IpPort[1] == "59" {
-		fmt.Println("\n==== Please enter Port Number other than 59 \n")
+	if *Banner != "text" && *Banner != "json" {
+		fmt.Println("\n==== Please enter banner as text or json")
 		return
 	}
-
-	port, err := strconv.Atoi(IpPort[1]) //checking port number is in valid range
-	if port < 1024 || port > 65536 {
-		fmt.Println("\n==== Please enter Port Number in range [1024:65536] \n")
+	if *UnknownMode != "reject" && *UnknownMode != "octet" {
+		fmt.Println("\n==== Please enter unknown mode as reject or octet")
+		return
+	}
+	if *MaxRequestSize < 516 || *MaxRequestSize > 65535 {
+		fmt.Println("\n==== Please enter max request size in range [516:65535]")
 		return
+	}
+	if *DSCP > 0 && !TOSSupported {
+		fmt.Println("\n==== DSCP marking is not supported on this platform. Ignoring -dscp")
+	}
 
+	if *SnapshotFile != "" { //restoring files stored before last stop. Preloaded files are loaded again below
+		Count, err := LoadSnapshot(*SnapshotFile)
+		if err != nil {
+			fmt.Println("Error: ", err)
+			os.Exit(1)
+		}
+		fmt.Println("\n==== Restored", Count, "files from snapshot [", *SnapshotFile, "]")
+	}
+	if *PreloadDir != "" { //loading files of preload directory
+		Summary, err := LoadPreloadDir(*PreloadDir)
+		if err != nil {
+			fmt.Println("Error: ", err)
+			os.Exit(1)
+		}
+		fmt.Println("\n==== Preloaded", Summary.Added, "files from [", *PreloadDir, "]")
+	}
+	//server is stopped gracefully on interrupt or after maximum uptime
+	Ctx, Stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer Stop()
+	if *MaxUptime > 0 {
+		Ctx, Stop = context.WithTimeout(Ctx, *MaxUptime)
+		defer Stop()
 	}
 
-	ip := net.ParseIP(IpPort[0])
+	Srv := new(Server)
+	Srv.ReadOnly = *ReadOnly
+	if len(Aliases) > 0 {
+		Srv.ResolveFilename = Aliases.Resolve
+	}
+	if *UploadClientPrefix {
+		Srv.RewriteWriteName = ClientPrefixedName
+	}
+	if *MirrorDir != "" {
+		Srv.Mirror = DirMirror{Dir: *MirrorDir}
+	}
+	WriteHook := &Webhook{URL: *WriteWebhookURL, Client: &http.Client{Timeout: 10 * time.Second}}
+	if *WriteWebhookURL != "" {
+		Srv.OnWriteComplete = WriteHook.NotifyWrite
+	}
+	ReadHook := &Webhook{URL: *ReadWebhookURL, Client: &http.Client{Timeout: 10 * time.Second}}
+	if *ReadWebhookURL != "" {
+		Srv.OnReadComplete = ReadHook.NotifyRead
+	}
+	if *CapabilitiesFile != "" { //clients without HTTP access read capabilities over TFTP
+		Srv.RegisterVirtualFile(*CapabilitiesFile, func(Client net.Addr) ([]byte, error) {
+			return json.Marshal(Srv.Capabilities())
+		})
+	}
+	if *AdminAddr != "" {
+		go StartAdminServer(Srv, *AdminAddr)
+	}
+	if *StatsInterval > 0 { //one line for all listening addresses as statistics are global
+		go LogStats(Ctx, *StatsInterval)
+	}
 
-	if IpPort[0] != "" && ip == nil { //checking for validity for ip address
-		fmt.Println("\n==== Please enter Valid Ip Adress \n")
+	if ActivatedConn != nil {
+		err = Srv.ServeConn(Ctx, ActivatedConn)
+		Srv.Mirrors.Wait()
+		WriteHook.Pending.Wait()
+		ReadHook.Pending.Wait()
+		SaveSnapshotOnStop()
+		if err != nil {
+			fmt.Println("Error: ", err)
+			os.Exit(1)
+		}
 		return
 	}
-
-	FileMap = make(map[string]*list.List) //setting filemap
-	buf := make([]byte, 516)
-
-	ServerAddr, err := net.ResolveUDPAddr("udp", os.Args[1]) //setting port on which tftp server listen for requests.
-	if err != nil {
-		fmt.Println("Error: ", err)
+	//each address has its own listening socket. Server stops if any of them fails
+	Ctx, Cancel := context.WithCancel(Ctx)
+	defer Cancel()
+	var Listeners sync.WaitGroup
+	Failed := atomic.Bool{}
+	for _, Addr := range flag.Args() {
+		Listeners.Add(1)
+		go func() {
+			defer Listeners.Done()
+			if err := Srv.ListenAndServe(Ctx, Addr); err != nil {
+				fmt.Println("Error: ", err)
+				Failed.Store(true)
+				Cancel()
+			}
+		}()
+	}
+	Listeners.Wait()
+	Srv.Mirrors.Wait() //uploads completed before stop are mirrored too
+	WriteHook.Pending.Wait()
+	ReadHook.Pending.Wait()
+	SaveSnapshotOnStop()
+	if Failed.Load() {
 		os.Exit(1)
 	}
+}
+
+/**
+* @brief : Function to write snapshot given by -snapshot-file after transfers are drained.
+ */
 
-	ServerConn, err := net.ListenUDP("udp", ServerAddr) //listening on given port for request
+func SaveSnapshotOnStop() {
+
+	if *SnapshotFile == "" {
+		return
+	}
+	Count, err := SaveSnapshot(*SnapshotFile)
 	if err != nil {
 		fmt.Println("Error: ", err)
-		os.Exit(1)
+		return
 	}
-	fmt.Println("\n==== server started at [", ServerAddr, "]")
+	fmt.Println("\n==== Saved", Count, "files to snapshot [", *SnapshotFile, "]")
+}
 
-	defer ServerConn.Close()
+/**
+* @brief : Function to check listening address given on command line.
+* @param : Addr : address [ip address:port]. IPv6 address is given in brackets ex. [::1]:9999
+ */
 
-	for {
-		n, addr, err := ServerConn.ReadFromUDP(buf) //read request from client
-		//		fmt.Println("Received ", buf[0:n], " from ", addr)
-		if err != nil {
-			fmt.Println("Error: ", err)
-			return
-		}
-		Req := new(RequestData)
-		ParseRequest(buf, uint16(n), Req) //parse the request
-		Req.ClientAddr = addr
+func ValidateAddress(Addr string) error {
 
-		if Req.OPcode == ERROR { // If error message received then do nothing
-			fmt.Println(" Error received from client ")
-			continue
-		}
-		if Req.OPcode == RRQ {
-			fmt.Println("\n==== Read reqeust file : [", Req.FileName, "] & client : [", Req.ClientAddr, "]")
-			go HandleReadRequest(Req)
-		}
-		if Req.OPcode == WRQ {
-			fmt.Println("\n==== Write reqeust file : [", Req.FileName, "] from client : [", Req.ClientAddr, "]")
-			go HandleWriteRequest(Req)
-		}
+	Host, Port, err := net.SplitHostPort(Addr)
+	if err != nil {
+		return errors.New("Please enter address as ip address:port")
+	}
+	PortNo, err := strconv.Atoi(Port) //checking port number is in valid range. 0 means any free port
+	if err != nil || (PortNo != 0 && (PortNo < 1024 || PortNo > 65535)) {
+		return errors.New("Please enter Port Number 0 or in range [1024:65535]")
+	}
+	if Host != "" && net.ParseIP(Host) == nil { //checking for validity for ip address
+		return errors.New("Please enter Valid Ip Adress")
 	}
+	return nil
 }
@@ -0,0 +1,3782 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/fs"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"testing/fstest"
+	"time"
+)
+
+// clock moved forward only by Advance. Timers of After fire when clock reaches their time.
+type FakeClock struct {
+	Lock   sync.Mutex
+	Time   time.Time
+	Timers []FakeTimer
+}
+
+// timer waiting for fake clock
+type FakeTimer struct {
+	At time.Time
+	C  chan time.Time
+}
+
+func NewFakeClock() *FakeClock {
+	return &FakeClock{Time: time.Unix(1000, 0)}
+}
+
+func (Clock *FakeClock) Now() time.Time {
+
+	Clock.Lock.Lock()
+	defer Clock.Lock.Unlock()
+	return Clock.Time
+}
+
+func (Clock *FakeClock) After(d time.Duration) <-chan time.Time {
+
+	Clock.Lock.Lock()
+	defer Clock.Lock.Unlock()
+	C := make(chan time.Time, 1)
+	if d <= 0 {
+		C <- Clock.Time
+		return C
+	}
+	Clock.Timers = append(Clock.Timers, FakeTimer{At: Clock.Time.Add(d), C: C})
+	return C
+}
+
+// Advance moves clock forward and fires timers which are due
+func (Clock *FakeClock) Advance(d time.Duration) {
+
+	Clock.Lock.Lock()
+	defer Clock.Lock.Unlock()
+	Clock.Time = Clock.Time.Add(d)
+	Waiting := Clock.Timers[:0]
+	for _, Timer := range Clock.Timers {
+		if Timer.At.After(Clock.Time) {
+			Waiting = append(Waiting, Timer)
+		} else {
+			Timer.C <- Clock.Time
+		}
+	}
+	Clock.Timers = Waiting
+}
+
+// WaitTimer waits until some goroutine waits on timer of clock
+func (Clock *FakeClock) WaitTimer(t *testing.T) {
+
+	t.Helper()
+	for Start := time.Now(); time.Since(Start) < 5*time.Second; time.Sleep(time.Millisecond) {
+		Clock.Lock.Lock()
+		Waiting := len(Clock.Timers)
+		Clock.Lock.Unlock()
+		if Waiting > 0 {
+			return
+		}
+	}
+	t.Fatal("no timer started")
+}
+
+// ResetStore removes all stored files so tests do not see files of each other
+func ResetStore(t testing.TB) {
+
+	FileMapLock.Lock()
+	for Name := range FileMap {
+		RemoveFile(Name)
+	}
+	clear(PreloadedFiles)
+	FileMapLock.Unlock()
+}
+
+// SetFlag changes flag value for one test
+func SetFlag[T any](t testing.TB, Flag *T, Value T) {
+
+	Old := *Flag
+	*Flag = Value
+	t.Cleanup(func() { *Flag = Old })
+}
+
+// StartTestServer serves requests on loopback port chosen by system until test ends
+func StartTestServer(t testing.TB, Srv *Server) *net.UDPAddr {
+
+	t.Helper()
+	return StartTestServerOn(t, Srv, &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+}
+
+// StartTestServerOn serves requests on given address until test ends
+func StartTestServerOn(t testing.TB, Srv *Server, Addr *net.UDPAddr) *net.UDPAddr {
+
+	t.Helper()
+	Conn, err := net.ListenUDP("udp", Addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return StartTestServerConn(t, Srv, Conn)
+}
+
+// StartTestServerConn serves requests on given listening socket until test ends
+func StartTestServerConn(t testing.TB, Srv *Server, Conn net.PacketConn) *net.UDPAddr {
+
+	t.Helper()
+	ResetStore(t)
+	Ctx, Cancel := context.WithCancel(context.Background())
+	Done := make(chan struct{})
+	go func() {
+		Srv.ServeConn(Ctx, Conn)
+		close(Done)
+	}()
+	t.Cleanup(func() {
+		Cancel()
+		Srv.CancelTransfers("read")
+		Srv.CancelTransfers("write")
+		<-Done
+	})
+	return Conn.LocalAddr().(*net.UDPAddr)
+}
+
+// client socket of test talking to server
+type TestClient struct {
+	T      testing.TB
+	Conn   *net.UDPConn
+	Buf    []byte
+	Listen *net.UDPAddr // listening address of server
+	Server *net.UDPAddr // listening address first, transfer address after first reply
+}
+
+func NewTestClient(t testing.TB, Server *net.UDPAddr) *TestClient {
+
+	t.Helper()
+	return NewTestClientFrom(t, Server, Server.IP) //same loopback address as server
+}
+
+// NewTestClientFrom creates client sending from given local IP
+func NewTestClientFrom(t testing.TB, Server *net.UDPAddr, IP net.IP) *TestClient {
+
+	t.Helper()
+	Conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: IP})
+	if err != nil {
+		t.Skip("can not bind client address:", err)
+	}
+	t.Cleanup(func() { Conn.Close() })
+	return &TestClient{T: t, Conn: Conn, Listen: Server, Server: Server}
+}
+
+// Send sends packet to server
+func (Client *TestClient) Send(Pkt []byte) {
+
+	Client.T.Helper()
+	if _, err := Client.Conn.WriteToUDP(Pkt, Client.Server); err != nil {
+		Client.T.Fatal(err)
+	}
+}
+
+// Request sends read or write request with options given as name, value pairs
+func (Client *TestClient) Request(OPcode uint16, Name string, Options ...string) {
+
+	Client.T.Helper()
+	Pkt := binary.BigEndian.AppendUint16(nil, OPcode)
+	Pkt = append(Pkt, Name+"\x00octet\x00"...)
+	for _, Field := range Options {
+		Pkt = append(Pkt, Field+"\x00"...)
+	}
+	Client.Send(Pkt)
+}
+
+// Recv receives packet from server. Transfer address of server is remembered
+func (Client *TestClient) Recv(Timeout time.Duration) ([]byte, bool) {
+
+	Client.T.Helper()
+	if Client.Buf == nil {
+		Client.Buf = make([]byte, MAXBLKSIZE+4)
+	}
+	Client.Conn.SetReadDeadline(time.Now().Add(Timeout))
+	n, From, err := Client.Conn.ReadFromUDP(Client.Buf)
+	if err != nil {
+		return nil, false
+	}
+	Client.Server = From
+	return append([]byte(nil), Client.Buf[:n]...), true
+}
+
+// Expect receives packet and checks its opcode and block number (error number for ERROR)
+func (Client *TestClient) Expect(OPcode uint16, Block uint16) []byte {
+
+	Client.T.Helper()
+	Pkt, ok := Client.Recv(3 * time.Second)
+	if !ok {
+		Client.T.Fatalf("no packet, expected opcode %d block %d", OPcode, Block)
+	}
+	if len(Pkt) < 4 || binary.BigEndian.Uint16(Pkt) != OPcode || (OPcode != OACK && binary.BigEndian.Uint16(Pkt[2:]) != Block) {
+		Client.T.Fatalf("got % x, expected opcode %d block %d", Pkt[:min(len(Pkt), 40)], OPcode, Block)
+	}
+	return Pkt
+}
+
+// error packet received by TestClient
+type ErrorReply struct {
+	Code    uint16
+	Message string
+}
+
+func (Reply *ErrorReply) Error() string {
+	return fmt.Sprintf("error %d: %s", Reply.Code, Reply.Message)
+}
+
+// ReplyError gives error of ERROR packet. Nil for other packets
+func ReplyError(Pkt []byte) error {
+
+	if len(Pkt) < 4 || binary.BigEndian.Uint16(Pkt) != ERROR {
+		return nil
+	}
+	return &ErrorReply{Code: binary.BigEndian.Uint16(Pkt[2:]), Message: strings.TrimRight(string(Pkt[4:]), "\x00")}
+}
+
+// ParseOACK gives options of OACK packet
+func ParseOACK(Pkt []byte) map[string]string {
+
+	Options := make(map[string]string)
+	Fields := strings.Split(string(Pkt[2:]), "\x00")
+	for i := 0; i+1 < len(Fields); i = i + 2 {
+		Options[Fields[i]] = Fields[i+1]
+	}
+	return Options
+}
+
+// Get reads whole file acknowledging last block of each window (each block without windowsize
+// option). It gives file data, options of OACK (nil if server sent no OACK) and error replied by server
+func (Client *TestClient) Get(Name string, Options ...string) ([]byte, map[string]string, error) {
+
+	Client.T.Helper()
+	Client.Server = Client.Listen
+	Client.Request(RRQ, Name, Options...)
+	var Data []byte
+	var Accepted map[string]string
+	BlockSize, WindowSize, InWindow := 512, 1, 0
+	for Block := uint16(1); ; {
+		Pkt, ok := Client.Recv(3 * time.Second)
+		if !ok {
+			return Data, Accepted, fmt.Errorf("no packet, expected block %d", Block)
+		}
+		if err := ReplyError(Pkt); err != nil {
+			return Data, Accepted, err
+		}
+		switch binary.BigEndian.Uint16(Pkt) {
+		case OACK:
+			Accepted = ParseOACK(Pkt)
+			if Size, err := strconv.Atoi(Accepted["blksize"]); err == nil {
+				BlockSize = Size
+			}
+			if Size, err := strconv.Atoi(Accepted["windowsize"]); err == nil {
+				WindowSize = Size
+			}
+			Client.Send(MakeACKPacket(0))
+		case DATA:
+			if binary.BigEndian.Uint16(Pkt[2:]) != Block { //duplicate or block after lost one
+				continue
+			}
+			Data = append(Data, Pkt[4:]...)
+			InWindow = InWindow + 1
+			Last := len(Pkt)-4 < BlockSize
+			if InWindow == WindowSize || Last {
+				Client.Send(MakeACKPacket(Block))
+				InWindow = 0
+			}
+			if Last {
+				return Data, Accepted, nil
+			}
+			Block = Block + 1
+		}
+	}
+}
+
+// Put writes whole file one window of blocks at a time. It gives options of OACK (nil if
+// server sent no OACK) and error replied by server
+func (Client *TestClient) Put(Name string, Data []byte, Options ...string) (map[string]string, error) {
+
+	Client.T.Helper()
+	Client.Server = Client.Listen
+	Client.Request(WRQ, Name, Options...)
+	var Accepted map[string]string
+	BlockSize, WindowSize := 512, 1
+	Pkt, ok := Client.Recv(3 * time.Second)
+	if !ok {
+		return nil, fmt.Errorf("no reply to request")
+	}
+	if err := ReplyError(Pkt); err != nil {
+		return nil, err
+	}
+	if binary.BigEndian.Uint16(Pkt) == OACK {
+		Accepted = ParseOACK(Pkt)
+		if Size, err := strconv.Atoi(Accepted["blksize"]); err == nil {
+			BlockSize = Size
+		}
+		if Size, err := strconv.Atoi(Accepted["windowsize"]); err == nil {
+			WindowSize = Size
+		}
+	}
+	Blocks := len(Data)/BlockSize + 1 //last block is shorter than block size, may be empty
+	for Acked := 0; Acked < Blocks; {
+		for Block := Acked + 1; Block <= min(Acked+WindowSize, Blocks); Block++ {
+			Client.Send(DataPacket(uint16(Block), Data[(Block-1)*BlockSize:min(Block*BlockSize, len(Data))]))
+		}
+		Pkt, ok := Client.Recv(3 * time.Second)
+		if !ok {
+			return Accepted, fmt.Errorf("no ACK after block %d", Acked)
+		}
+		if err := ReplyError(Pkt); err != nil {
+			return Accepted, err
+		}
+		if Block := int(binary.BigEndian.Uint16(Pkt[2:])); binary.BigEndian.Uint16(Pkt) == ACK && Block > Acked {
+			Acked = Block
+		}
+	}
+	return Accepted, nil
+}
+
+// DataPacket builds DATA packet
+func DataPacket(Block uint16, Data []byte) []byte {
+
+	Pkt := binary.BigEndian.AppendUint16(nil, DATA)
+	Pkt = binary.BigEndian.AppendUint16(Pkt, Block)
+	return append(Pkt, Data...)
+}
+
+// WaitStored waits until file is stored as upload is stored after its final ACK is sent
+func WaitStored(t testing.TB, Name string) []byte {
+
+	t.Helper()
+	for Start := time.Now(); time.Since(Start) < 3*time.Second; time.Sleep(time.Millisecond) {
+		if Data, ok := StoredData(Name); ok {
+			return Data
+		}
+	}
+	t.Fatalf("file %q not stored", Name)
+	return nil
+}
+
+// StoredData gives content of stored file
+func StoredData(Name string) ([]byte, bool) {
+
+	FileMapLock.RLock()
+	File, ok := FileMap[Name]
+	FileMapLock.RUnlock()
+	if !ok {
+		return nil, false
+	}
+	var Data []byte
+	for e := File.Blocks.Front(); e != nil; e = e.Next() {
+		Data = append(Data, e.Value.([]byte)...)
+	}
+	return Data, true
+}
+
+func TestFakeClockDrivesRetries(t *testing.T) {
+
+	Clock := NewFakeClock()
+	Srv := &Server{Clock: Clock}
+	Addr := StartTestServer(t, Srv)
+	Client := NewTestClient(t, Addr)
+	Start := time.Now()
+	Client.Request(WRQ, "clock")
+	Client.Expect(ACK, 0)
+	for i := 0; i < 3; i++ { //each timeout of fake clock resends ACK(0) at once
+		Clock.WaitTimer(t)
+		Clock.Advance(TIMEOUT * time.Second)
+		Client.Expect(ACK, 0)
+	}
+	if time.Since(Start) >= TIMEOUT*time.Second {
+		t.Fatal("retries waited for real time")
+	}
+	Client.Send(DataPacket(1, []byte("data")))
+	Client.Expect(ACK, 1)
+	if Data := WaitStored(t, "clock"); string(Data) != "data" {
+		t.Fatalf("stored %q", Data)
+	}
+}
+
+func TestFakeClockLaggingWallTime(t *testing.T) {
+
+	Srv := &Server{Clock: NewFakeClock()} //clock far behind real time must not expire socket deadlines
+	Addr := StartTestServer(t, Srv)
+	Client := NewTestClient(t, Addr)
+	Client.Request(WRQ, "lag")
+	Client.Expect(ACK, 0)
+	Client.Send(DataPacket(1, []byte("x")))
+	Client.Expect(ACK, 1)
+}
+
+// CaptureOutput gives text printed to stdout by Fn
+func CaptureOutput(t *testing.T, Fn func()) string {
+
+	t.Helper()
+	Reader, Writer, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	Stdout := os.Stdout
+	os.Stdout = Writer
+	defer func() { os.Stdout = Stdout }() //also restored if Fn fails test
+	Output := make(chan string)
+	go func() {
+		Data, _ := io.ReadAll(Reader)
+		Output <- string(Data)
+	}()
+	Fn()
+	Writer.Close()
+	return <-Output
+}
+
+func TestLogNegotiationRedactsPassword(t *testing.T) {
+
+	Req := &RequestData{OPcode: WRQ, FileName: "f", Mode: "octet", ClientAddr: &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1},
+		Options: map[string]string{"pw": "hunter2", "blksize": "1024"}}
+	Negotiated, _ := Negotiate(Req, FlagNegotiationConfig())
+	Log := CaptureOutput(t, func() { LogNegotiation(Req, Negotiated) })
+	if strings.Contains(Log, "hunter2") {
+		t.Fatalf("password in log:\n%s", Log)
+	}
+	if !strings.Contains(Log, "option pw") || !strings.Contains(Log, "option blksize") {
+		t.Fatalf("options missing in log:\n%s", Log)
+	}
+}
+
+// StartFakeUpstream serves one file in 512 byte blocks. Block after first is sent only after Release is closed
+func StartFakeUpstream(t *testing.T, Data []byte, Release chan struct{}) *net.UDPAddr {
+
+	t.Helper()
+	Conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { Conn.Close() })
+	go func() {
+		Buf := make([]byte, 1024)
+		_, Client, err := Conn.ReadFromUDP(Buf) //read request
+		if err != nil {
+			return
+		}
+		for Block := 1; ; Block++ {
+			if Block == 2 {
+				<-Release
+			}
+			Part := Data[min((Block-1)*512, len(Data)):min(Block*512, len(Data))]
+			Conn.WriteToUDP(DataPacket(uint16(Block), Part), Client)
+			Conn.SetReadDeadline(time.Now().Add(3 * time.Second))
+			if _, _, err := Conn.ReadFromUDP(Buf); err != nil { //ACK
+				return
+			}
+			if len(Part) < 512 {
+				return
+			}
+		}
+	}()
+	return Conn.LocalAddr().(*net.UDPAddr)
+}
+
+func TestUpstreamBlocksRelayedWhileFetching(t *testing.T) {
+
+	Data := []byte(strings.Repeat("0123456789abcdef", 100)) //1600 bytes, 4 blocks
+	Release := make(chan struct{})
+	SetFlag(t, Upstream, StartFakeUpstream(t, Data, Release).String())
+	Addr := StartTestServer(t, &Server{})
+	Client := NewTestClient(t, Addr)
+	Client.Request(RRQ, "up")
+	Pkt := Client.Expect(DATA, 1) //sent before upstream sends rest of file
+	if _, ok := StoredData("up"); ok {
+		t.Fatal("file stored before fetch completed")
+	}
+	close(Release)
+	Received := append([]byte(nil), Pkt[4:]...)
+	Client.Send(MakeACKPacket(1))
+	for Block := uint16(2); len(Pkt) == 516; Block++ {
+		Pkt = Client.Expect(DATA, Block)
+		Received = append(Received, Pkt[4:]...)
+		Client.Send(MakeACKPacket(Block))
+	}
+	if string(Received) != string(Data) {
+		t.Fatalf("received %d bytes, want %d", len(Received), len(Data))
+	}
+	if Stored := WaitStored(t, "up"); string(Stored) != string(Data) {
+		t.Fatalf("stored %d bytes, want %d", len(Stored), len(Data))
+	}
+}
+
+func TestCapabilitiesReportImplementedModes(t *testing.T) {
+
+	Modes := (&Server{}).Capabilities().Modes
+	if len(Modes) != 1 || Modes[0] != "octet" { //netascii is not converted so it is not advertised
+		t.Fatalf("modes %v, want [octet]", Modes)
+	}
+	Req := &RequestData{FileName: "f", Mode: "NetASCII"}
+	SetFlag(t, UnknownMode, "reject")
+	if err := ApplyModePolicy(Req); err != nil { //still accepted and served as stored
+		t.Fatalf("netascii rejected: %v", err)
+	}
+}
+
+// PutFile stores file as if it was uploaded
+func PutFile(Name string, Data []byte) {
+
+	FileMapLock.Lock()
+	StoreFile(Name, NewFileEntry(BlocksFromBytes(Data)))
+	FileMapLock.Unlock()
+}
+
+func TestNetasciiRequestDoesNotConvertData(t *testing.T) {
+
+	Data := []byte("\x7fELF\n\r\x00\r\n")
+	Addr := StartTestServer(t, &Server{})
+	PutFile("fw.bin", Data)
+	Client := NewTestClient(t, Addr)
+	Client.Send(append([]byte{0, byte(RRQ)}, "fw.bin\x00netascii\x00"...))
+	if Pkt := Client.Expect(DATA, 1); string(Pkt[4:]) != string(Data) {
+		t.Fatalf("got %q, want %q", Pkt[4:], Data)
+	}
+	Client.Send(MakeACKPacket(1))
+}
+
+func TestUnknownModePolicies(t *testing.T) {
+
+	t.Run("reject", func(t *testing.T) {
+		SetFlag(t, UnknownMode, "reject")
+		Addr := StartTestServer(t, &Server{})
+		PutFile("fw.bin", []byte("x"))
+		Client := NewTestClient(t, Addr)
+		Client.Send(append([]byte{0, byte(RRQ)}, "fw.bin\x00garbage\x00"...))
+		Client.Expect(ERROR, ILLEGALOP)
+	})
+	t.Run("octet", func(t *testing.T) {
+		SetFlag(t, UnknownMode, "octet")
+		Addr := StartTestServer(t, &Server{})
+		PutFile("fw.bin", []byte("x"))
+		Client := NewTestClient(t, Addr)
+		Client.Send(append([]byte{0, byte(RRQ)}, "fw.bin\x00garbage\x00"...))
+		if Pkt := Client.Expect(DATA, 1); string(Pkt[4:]) != "x" {
+			t.Fatalf("octet policy sent %q", Pkt[4:])
+		}
+		Client.Send(MakeACKPacket(1))
+	})
+}
+
+func TestIPv4AndIPv6Listeners(t *testing.T) {
+
+	Srv := &Server{}
+	Addrs := []*net.UDPAddr{
+		StartTestServerOn(t, Srv, &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)}),
+		StartTestServerOn(t, Srv, &net.UDPAddr{IP: net.IPv6loopback}),
+	}
+	PutFile("both", []byte("data"))
+	for _, Addr := range Addrs {
+		Client := NewTestClient(t, Addr)
+		Client.Request(RRQ, "both")
+		if Pkt := Client.Expect(DATA, 1); string(Pkt[4:]) != "data" {
+			t.Fatalf("%v: got %q", Addr, Pkt[4:])
+		}
+		if !Client.Server.IP.Equal(Addr.IP) { //transfer socket is of same family and address as listener
+			t.Fatalf("transfer from %v for request to %v", Client.Server, Addr)
+		}
+		Client.Send(MakeACKPacket(1))
+	}
+}
+
+func TestSinglePortTransfer(t *testing.T) {
+
+	SetFlag(t, SinglePort, true)
+	Addr := StartTestServer(t, &Server{Clock: NewFakeClock()}) //fake clock keeps dallying transfer until test ends
+	Data := []byte(strings.Repeat("x", 700))
+	PutFile("single", Data)
+	PutFile("other", Data)
+	Client := NewTestClient(t, Addr)
+	Client.Request(RRQ, "single")
+	Client.Expect(DATA, 1)
+	Client.Send(MakeACKPacket(1))
+	Client.Expect(DATA, 2)
+	if Client.Server.Port != Addr.Port { //every packet comes from listening port
+		t.Fatalf("transfer from port %d, listening port %d", Client.Server.Port, Addr.Port)
+	}
+	Client.Send(MakeACKPacket(2))
+	Client.Request(RRQ, "other") //first transfer of same client address is dallying
+	Pkt := Client.Expect(ERROR, UNKNOWNERROR)
+	if string(Pkt[4:len(Pkt)-1]) != SERVERBUSYMSG || Client.Server.Port != Addr.Port {
+		t.Fatalf("got %q from port %d", Pkt[4:], Client.Server.Port)
+	}
+}
+
+func TestReloadServesChangedPreloadFile(t *testing.T) {
+
+	Dir := t.TempDir()
+	SetFlag(t, PreloadDir, Dir)
+	Addr := StartTestServer(t, &Server{})
+	Path := filepath.Join(Dir, "boot.cfg")
+	os.WriteFile(Path, []byte("old"), 0644)
+	if _, err := LoadPreloadDir(Dir); err != nil {
+		t.Fatal(err)
+	}
+	os.WriteFile(Path, []byte("new content"), 0644)
+	Recorder := httptest.NewRecorder()
+	HandleReload(Recorder, httptest.NewRequest(http.MethodPost, "/reload", nil))
+	if Recorder.Code != http.StatusOK || !strings.Contains(Recorder.Body.String(), `"updated":1`) {
+		t.Fatalf("reload replied %d %s", Recorder.Code, Recorder.Body)
+	}
+	Data, _, err := NewTestClient(t, Addr).Get("boot.cfg")
+	if err != nil || string(Data) != "new content" {
+		t.Fatalf("got %q, %v", Data, err)
+	}
+}
+
+func TestWindowsizeOneIsStopAndWait(t *testing.T) {
+
+	Addr := StartTestServer(t, &Server{})
+	PutFile("window", []byte(strings.Repeat("w", 2000)))
+	Client := NewTestClient(t, Addr)
+	Client.Request(RRQ, "window", "windowsize", "1")
+	if Options := ParseOACK(Client.Expect(OACK, 0)); Options["windowsize"] != "1" {
+		t.Fatalf("OACK %v", Options)
+	}
+	Client.Send(MakeACKPacket(0))
+	for Block := uint16(1); Block <= 3; Block++ {
+		Client.Expect(DATA, Block)
+		if Pkt, ok := Client.Recv(100 * time.Millisecond); ok { //next block waits for ACK
+			t.Fatalf("block %d sent before ACK: % x", Block+1, Pkt[:4])
+		}
+		Client.Send(MakeACKPacket(Block))
+	}
+	Client.Expect(DATA, 4)
+	Client.Send(MakeACKPacket(4))
+}
+
+func TestWorkerPoolBoundsGoroutines(t *testing.T) {
+
+	SetFlag(t, Workers, 2)
+	SetFlag(t, QueueTimeout, 50*time.Millisecond)
+	Addr := StartTestServer(t, &Server{Clock: NewFakeClock()}) //transfers wait for ACK until test ends
+	PutFile("flood", []byte("x"))
+	Baseline := runtime.NumGoroutine()
+	var Clients []*TestClient
+	for i := 0; i < 50; i++ {
+		Client := NewTestClient(t, Addr)
+		Client.Request(RRQ, "flood")
+		Clients = append(Clients, Client)
+	}
+	Busy := 0
+	for _, Client := range Clients {
+		if Pkt, ok := Client.Recv(time.Second); ok && ReplyError(Pkt) != nil {
+			Busy = Busy + 1
+		}
+	}
+	if Grown := runtime.NumGoroutine() - Baseline; Grown > 10 {
+		t.Fatalf("%d goroutines started for 50 requests with 2 workers", Grown)
+	}
+	if Busy < 40 { //2 in progress, 2 queued until workers stay busy
+		t.Fatalf("only %d requests got busy error", Busy)
+	}
+}
+
+func TestStatOptionGivesMetadata(t *testing.T) {
+
+	Addr := StartTestServer(t, &Server{})
+	Data := []byte("metadata of this file")
+	Client := NewTestClient(t, Addr)
+	if _, err := Client.Put("meta", Data, "mtime", "1700000000"); err != nil {
+		t.Fatal(err)
+	}
+	WaitStored(t, "meta")
+	Received, Options, err := Client.Get("meta", "stat", "1")
+	if err != nil || len(Received) != 0 { //metadata only, no file data
+		t.Fatalf("got %q, %v", Received, err)
+	}
+	Want := map[string]string{"size": strconv.Itoa(len(Data)), "crc32": fmt.Sprintf("%08x", crc32.ChecksumIEEE(Data)), "mtime": "1700000000"}
+	for Name, Value := range Want {
+		if Options[Name] != Value {
+			t.Fatalf("stat %s = %q, want %q (%v)", Name, Options[Name], Value, Options)
+		}
+	}
+}
+
+func TestOneShotFileReadOnce(t *testing.T) {
+
+	SetFlag(t, OneShot, true)
+	Addr := StartTestServer(t, &Server{})
+	PutFile("once", []byte("secret"))
+	Client := NewTestClient(t, Addr)
+	if Data, _, err := Client.Get("once"); err != nil || string(Data) != "secret" {
+		t.Fatalf("first read got %q, %v", Data, err)
+	}
+	for Start := time.Now(); time.Since(Start) < 3*time.Second; time.Sleep(time.Millisecond) { //removed once final ACK arrives
+		if _, ok := StoredData("once"); !ok {
+			break
+		}
+	}
+	_, _, err := NewTestClient(t, Addr).Get("once")
+	if Reply, ok := err.(*ErrorReply); !ok || Reply.Code != FILENOTFOUND {
+		t.Fatalf("second read got %v", err)
+	}
+}
+
+func TestOneShotFileDeliveredToOneConcurrentReader(t *testing.T) {
+
+	SetFlag(t, OneShot, true)
+	Srv := &Server{}
+	Addr := StartTestServer(t, Srv)
+	PutFile("secret", bytes.Repeat([]byte("s"), 1000))
+	NotFound := func(err error) bool {
+		Reply, ok := err.(*ErrorReply)
+		return ok && Reply.Code == FILENOTFOUND
+	}
+
+	First := NewTestClient(t, Addr)
+	First.Request(RRQ, "secret")
+	First.Expect(DATA, 1)
+	if _, _, err := NewTestClient(t, Addr).Get("secret"); !NotFound(err) { //first read still in progress
+		t.Fatalf("read during first read got %v", err)
+	}
+	First.Send(MakeErrorPacket(UNKNOWNERROR, "aborted")) //failed read gives file back
+	WaitTransfers(t, Srv, 0)
+
+	var Delivered, Refused atomic.Int32
+	var Readers sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		Client := NewTestClient(t, Addr)
+		Readers.Add(1)
+		go func() {
+			defer Readers.Done()
+			if _, _, err := Client.Get("secret"); err == nil {
+				Delivered.Add(1)
+			} else if NotFound(err) {
+				Refused.Add(1)
+			}
+		}()
+	}
+	Readers.Wait()
+	if Delivered.Load() != 1 || Refused.Load() != 7 {
+		t.Fatalf("%d reads delivered and %d refused, want 1 and 7", Delivered.Load(), Refused.Load())
+	}
+}
+
+func TestFutureACKAbortsRead(t *testing.T) {
+
+	Addr := StartTestServer(t, &Server{})
+	PutFile("future", []byte(strings.Repeat("f", 2000)))
+	Client := NewTestClient(t, Addr)
+	Client.Request(RRQ, "future")
+	Client.Expect(DATA, 1)
+	Start := time.Now()
+	Client.Send(MakeACKPacket(1000))
+	Pkt := Client.Expect(ERROR, ILLEGALOP)
+	if err := ReplyError(Pkt).(*ErrorReply); err.Message != FUTUREACKMSG || time.Since(Start) > time.Second {
+		t.Fatalf("got %v after %v", err, time.Since(Start))
+	}
+}
+
+func TestServeConnWithSuppliedConn(t *testing.T) {
+
+	Conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ResetStore(t)
+	Ctx, Cancel := context.WithCancel(context.Background())
+	Done := make(chan error)
+	go func() { Done <- (&Server{}).ServeConn(Ctx, Conn) }()
+	Client := NewTestClient(t, Conn.LocalAddr().(*net.UDPAddr))
+	if _, err := Client.Put("supplied", []byte("over supplied conn")); err != nil {
+		t.Fatal(err)
+	}
+	WaitStored(t, "supplied")
+	if Data, _, err := Client.Get("supplied"); err != nil || string(Data) != "over supplied conn" {
+		t.Fatalf("got %q, %v", Data, err)
+	}
+	Cancel()
+	if err := <-Done; err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestSystemdActivationHelper serves socket passed as fd 3 when run as child process by TestSystemdActivation
+func TestSystemdActivationHelper(t *testing.T) {
+
+	if os.Getenv("TFTP_TEST_ACTIVATION") != "1" {
+		t.Skip("run by TestSystemdActivation")
+	}
+	Conn, err := SystemdPacketConn()
+	if err != nil || Conn == nil {
+		t.Fatal("no activated socket", err)
+	}
+	PutFile("activated", []byte("from fd 3"))
+	Ctx, Cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer Cancel()
+	(&Server{}).ServeConn(Ctx, Conn)
+}
+
+func TestSystemdActivation(t *testing.T) {
+
+	if runtime.GOOS == "windows" {
+		t.Skip("socket activation is not available")
+	}
+	Conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	File, err := Conn.File()
+	if err != nil {
+		t.Fatal(err)
+	}
+	Child := exec.Command(os.Args[0], "-test.run=^TestSystemdActivationHelper$")
+	Child.Env = append(os.Environ(), "TFTP_TEST_ACTIVATION=1", "LISTEN_FDS=1")
+	Child.ExtraFiles = []*os.File{File} //becomes fd 3 of child
+	if err := Child.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		Child.Process.Kill()
+		Child.Wait()
+	}()
+	File.Close()
+	Addr := Conn.LocalAddr().(*net.UDPAddr)
+	Conn.Close()
+	Data, _, err := NewTestClient(t, Addr).Get("activated")
+	if err != nil || string(Data) != "from fd 3" {
+		t.Fatalf("got %q, %v", Data, err)
+	}
+}
+
+func TestLogStatsHeartbeat(t *testing.T) {
+
+	Ctx, Cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer Cancel()
+	Log := CaptureOutput(t, func() { LogStats(Ctx, 10*time.Millisecond) })
+	if !strings.Contains(Log, "==== Stats : active transfers") {
+		t.Fatalf("no stats line in:\n%s", Log)
+	}
+}
+
+func TestAutoGunzipServesPlainName(t *testing.T) {
+
+	SetFlag(t, AutoGunzip, true)
+	Addr := StartTestServer(t, &Server{})
+	var Compressed bytes.Buffer
+	Writer := gzip.NewWriter(&Compressed)
+	Plain := strings.Repeat("plain text line\n", 200)
+	Writer.Write([]byte(Plain))
+	Writer.Close()
+	PutFile("log.txt.gz", Compressed.Bytes())
+	if Data, _, err := NewTestClient(t, Addr).Get("log.txt"); err != nil || string(Data) != Plain {
+		t.Fatalf("got %d bytes, %v", len(Data), err)
+	}
+}
+
+func TestAbortedWriteLeavesNoFile(t *testing.T) {
+
+	Dir := t.TempDir()
+	Srv := &Server{Mirror: DirMirror{Dir: Dir}}
+	Addr := StartTestServer(t, Srv)
+	Client := NewTestClient(t, Addr)
+	Client.Request(WRQ, "atomic")
+	Client.Expect(ACK, 0)
+	Client.Send(DataPacket(1, bytes.Repeat([]byte("a"), 512)))
+	Client.Expect(ACK, 1)
+	Client.Send(MakeErrorPacket(UNKNOWNERROR, "client aborted"))
+	time.Sleep(100 * time.Millisecond)
+	if _, ok := StoredData("atomic"); ok {
+		t.Fatal("partial upload stored")
+	}
+	Client = NewTestClient(t, Addr)
+	if _, err := Client.Put("atomic", []byte("complete")); err != nil {
+		t.Fatal(err)
+	}
+	if Data := WaitStored(t, "atomic"); string(Data) != "complete" {
+		t.Fatalf("stored %q", Data)
+	}
+	Srv.Mirrors.Wait()
+	Entries, _ := os.ReadDir(Dir)
+	if len(Entries) != 1 || Entries[0].Name() != "atomic" { //no partial or temporary file left
+		t.Fatalf("mirror directory has %v", Entries)
+	}
+	if Data, _ := os.ReadFile(filepath.Join(Dir, "atomic")); string(Data) != "complete" {
+		t.Fatalf("mirrored %q", Data)
+	}
+}
+
+func TestMinBlksizeClampsSmallRequest(t *testing.T) {
+
+	SetFlag(t, MinBlksize, 512)
+	Addr := StartTestServer(t, &Server{})
+	PutFile("clamp", []byte(strings.Repeat("c", 600)))
+	Data, Options, err := NewTestClient(t, Addr).Get("clamp", "blksize", "8")
+	if err != nil || Options["blksize"] != "512" || len(Data) != 600 {
+		t.Fatalf("OACK %v, got %d bytes, %v", Options, len(Data), err)
+	}
+}
+
+func TestListFilesSnapshot(t *testing.T) {
+
+	Srv := &Server{}
+	Addr := StartTestServer(t, Srv)
+	PutFile("a", []byte("12345"))
+	PutFile("b", []byte("1"))
+	Files := Srv.ListFiles()
+	if len(Files) != 2 || Files[0].Name != "a" || Files[0].Size != 5 || Files[1].Name != "b" {
+		t.Fatalf("files %+v", Files)
+	}
+	var Writers sync.WaitGroup
+	for i := 0; i < 4; i++ { //uploads change store while it is listed
+		Writers.Add(1)
+		go func() {
+			defer Writers.Done()
+			NewTestClient(t, Addr).Put(fmt.Sprint("w", i), []byte("data"))
+		}()
+	}
+	for i := 0; i < 100; i++ {
+		Srv.ListFiles()
+	}
+	Writers.Wait()
+	Files[0].Name = "changed" //snapshot is a copy
+	for i := 0; i < 4; i++ {
+		WaitStored(t, fmt.Sprint("w", i))
+	}
+	if Files = Srv.ListFiles(); len(Files) != 6 || Files[0].Name != "a" {
+		t.Fatalf("files %+v", Files)
+	}
+}
+
+func TestWriteAndReadTimestamps(t *testing.T) {
+
+	Srv := &Server{}
+	Addr := StartTestServer(t, Srv)
+	Client := NewTestClient(t, Addr)
+	Before := time.Now()
+	Client.Put("stamp", []byte("v1"))
+	WaitStored(t, "stamp")
+	Info := Srv.ListFiles()[0]
+	if Info.ModTime.Before(Before) || !Info.LastReadAt.IsZero() {
+		t.Fatalf("after write %+v", Info)
+	}
+	Written := Info.ModTime
+	time.Sleep(10 * time.Millisecond)
+	Client.Get("stamp")
+	if Info = Srv.ListFiles()[0]; !Info.LastReadAt.After(Written) || !Info.ModTime.Equal(Written) {
+		t.Fatalf("after read %+v", Info)
+	}
+	First := Info.LastReadAt
+	time.Sleep(10 * time.Millisecond)
+	NewTestClient(t, Addr).Get("stamp") //new port as first read is dallying
+	if Info = Srv.ListFiles()[0]; !Info.LastReadAt.After(First) {
+		t.Fatalf("after second read %+v", Info)
+	}
+}
+
+func TestDeleteDuringReadKeepsContent(t *testing.T) {
+
+	Addr := StartTestServer(t, &Server{})
+	Data := bytes.Repeat([]byte("0123456789"), 300)
+	PutFile("deleted", Data)
+	Client := NewTestClient(t, Addr)
+	Client.Request(RRQ, "deleted")
+	Received := Client.Expect(DATA, 1)[4:]
+	Recorder := httptest.NewRecorder()
+	HandleFile(Recorder, httptest.NewRequest(http.MethodDelete, "/files/deleted", nil))
+	if Recorder.Code != http.StatusNoContent {
+		t.Fatalf("delete replied %d", Recorder.Code)
+	}
+	for Block := uint16(1); len(Received)%512 == 0; Block++ {
+		Client.Send(MakeACKPacket(Block))
+		Received = append(Received, Client.Expect(DATA, Block+1)[4:]...)
+	}
+	Client.Send(MakeACKPacket(uint16(len(Data)/512 + 1)))
+	if !bytes.Equal(Received, Data) {
+		t.Fatalf("got %d bytes, want original %d", len(Received), len(Data))
+	}
+	if _, ok := StoredData("deleted"); ok {
+		t.Fatal("file still stored")
+	}
+}
+
+func TestLostACKRetransmittedWriteAndData(t *testing.T) {
+
+	Addr := StartTestServer(t, &Server{})
+	Client := NewTestClient(t, Addr)
+	Client.Request(WRQ, "lost")
+	Client.Expect(ACK, 0)
+	Transfer := Client.Server
+	Client.Server = Addr //ACK(0) seen as lost so request is sent again
+	Client.Request(WRQ, "lost")
+	if Pkt, ok := Client.Recv(200 * time.Millisecond); ok { //transfer in progress resends ACK(0) only after timeout
+		t.Fatalf("duplicate request answered: % x from %v", Pkt, Client.Server)
+	}
+	Client.Server = Transfer
+	Block := bytes.Repeat([]byte("l"), 512)
+	Client.Send(DataPacket(1, Block))
+	Client.Expect(ACK, 1)
+	Client.Send(DataPacket(1, Block)) //ACK(1) seen as lost
+	Client.Expect(ACK, 1)
+	Client.Send(DataPacket(2, []byte("end")))
+	Client.Expect(ACK, 2)
+	if Data := WaitStored(t, "lost"); string(Data) != string(Block)+"end" {
+		t.Fatalf("stored %d bytes", len(Data))
+	}
+}
+
+func TestResumeInterruptedRead(t *testing.T) {
+
+	SetFlag(t, ResumeTTL, time.Minute)
+	Addr := StartTestServer(t, &Server{})
+	Data := bytes.Repeat([]byte("0123456789abcdef"), 200)
+	PutFile("resumed", Data)
+	Client := NewTestClient(t, Addr)
+	Client.Request(RRQ, "resumed")
+	Client.Expect(DATA, 1)
+	Client.Send(MakeACKPacket(1))
+	Client.Expect(DATA, 2)
+	Client.Send(MakeACKPacket(2))
+	Client.Expect(DATA, 3)
+	Client.Send(MakeErrorPacket(UNKNOWNERROR, "interrupted"))
+	Key := "127.0.0.1 resumed"
+	for Start := time.Now(); time.Since(Start) < 3*time.Second; time.Sleep(time.Millisecond) {
+		CheckpointLock.Lock()
+		_, Saved := Checkpoints[Key]
+		CheckpointLock.Unlock()
+		if Saved {
+			break
+		}
+	}
+	Rest, Options, err := NewTestClient(t, Addr).Get("resumed", "resume", "1")
+	if err != nil || Options["resume"] != "1024" || !bytes.Equal(Rest, Data[1024:]) {
+		t.Fatalf("OACK %v, got %d bytes, %v", Options, len(Rest), err)
+	}
+}
+
+func TestIllegalOpcodeRejected(t *testing.T) {
+
+	Addr := StartTestServer(t, &Server{})
+	for _, OPcode := range []uint16{0, 99} {
+		Pkt := binary.BigEndian.AppendUint16(nil, OPcode)
+		Pkt = append(Pkt, "file\x00octet\x00"...)
+		if err := ParseRequest(Pkt, uint16(len(Pkt)), &RequestData{}); err == nil || err.Error() != "Illegal opcode" {
+			t.Fatalf("opcode %d parsed with %v", OPcode, err)
+		}
+		Client := NewTestClient(t, Addr)
+		Client.Send(Pkt)
+		Client.Expect(ERROR, ILLEGALOP)
+	}
+}
+
+func TestReadPassword(t *testing.T) {
+
+	Addr := StartTestServer(t, &Server{})
+	if _, err := NewTestClient(t, Addr).Put("locked", []byte("secret"), "pw", "right"); err != nil {
+		t.Fatal(err)
+	}
+	WaitStored(t, "locked")
+	for _, Password := range []string{"", "wrong"} {
+		Options := []string{"pw", Password}
+		if Password == "" {
+			Options = nil
+		}
+		_, _, err := NewTestClient(t, Addr).Get("locked", Options...)
+		if Reply, ok := err.(*ErrorReply); !ok || Reply.Code != ACCESSVIOLATION || Reply.Message != WRONGPASSWORDMSG {
+			t.Fatalf("password %q got %v", Password, err)
+		}
+	}
+	if Data, _, err := NewTestClient(t, Addr).Get("locked", "pw", "right"); err != nil || string(Data) != "secret" {
+		t.Fatalf("correct password got %q, %v", Data, err)
+	}
+}
+
+// TestMainHelper runs main with arguments given by RunMain when run as child process
+func TestMainHelper(t *testing.T) {
+
+	Args, ok := os.LookupEnv("TFTP_TEST_MAIN_ARGS")
+	if !ok {
+		t.Skip("run by RunMain")
+	}
+	os.Args = append([]string{"go_tftp_server"}, strings.Split(Args, "\n")...)
+	main()
+}
+
+// RunMain runs server with command line arguments in child process and gives its output
+// once it exits or Timeout passes
+func RunMain(t *testing.T, Timeout time.Duration, Args ...string) (string, error) {
+
+	t.Helper()
+	Ctx, Cancel := context.WithTimeout(context.Background(), Timeout)
+	defer Cancel()
+	Child := exec.CommandContext(Ctx, os.Args[0], "-test.run=^TestMainHelper$")
+	Child.Env = append(os.Environ(), "TFTP_TEST_MAIN_ARGS="+strings.Join(Args, "\n"))
+	Output, err := Child.CombinedOutput()
+	return string(Output), err
+}
+
+func TestMaxUptimeStopsServer(t *testing.T) {
+
+	Start := time.Now()
+	Output, err := RunMain(t, 10*time.Second, "-max-uptime", "300ms", "127.0.0.1:0")
+	if err != nil || !strings.Contains(Output, "==== server stopped") {
+		t.Fatalf("server did not stop: %v\n%s", err, Output)
+	}
+	if Elapsed := time.Since(Start); Elapsed < 300*time.Millisecond || Elapsed > 5*time.Second {
+		t.Fatalf("stopped after %v", Elapsed)
+	}
+}
+
+func TestRateLimitPacesRead(t *testing.T) {
+
+	SetFlag(t, RateLimitBps, 20000)
+	Addr := StartTestServer(t, &Server{})
+	PutFile("paced", bytes.Repeat([]byte("p"), 10000))
+	Start := time.Now()
+	Data, _, err := NewTestClient(t, Addr).Get("paced")
+	if Elapsed := time.Since(Start); err != nil || len(Data) != 10000 || Elapsed < 450*time.Millisecond || Elapsed > 2*time.Second {
+		t.Fatalf("got %d bytes in %v, %v. Want about 500ms at 20000 bytes/s", len(Data), Elapsed, err)
+	}
+}
+
+func TestRateLimitedTransferCancelledAtOnce(t *testing.T) {
+
+	Srv := &Server{}
+	Addr := StartTestServer(t, Srv)
+	PutFile("slow", bytes.Repeat([]byte("s"), 20000))
+	for _, Case := range []struct {
+		Name    string
+		Options []string
+		Message string
+	}{
+		{"cancel", []string{"blksize", "8192", "ratelimit", "1"}, CANCELLEDMSG}, //first block alone takes 8s at minimum rate
+		{"deadline", []string{"blksize", "8192", "ratelimit", "1", "deadline", "1"}, DEADLINEMSG},
+	} {
+		t.Run(Case.Name, func(t *testing.T) {
+			Client := NewTestClient(t, Addr)
+			Client.Request(RRQ, "slow", Case.Options...)
+			if Options := ParseOACK(Client.Expect(OACK, 0)); Options["ratelimit"] != strconv.Itoa(MINRATELIMIT) {
+				t.Fatalf("ratelimit %q accepted, want minimum %d", Options["ratelimit"], MINRATELIMIT)
+			}
+			Client.Send(MakeACKPacket(0))
+			Active := WaitTransfers(t, Srv, 1)
+			Start := time.Now()
+			if Case.Name == "cancel" {
+				time.Sleep(100 * time.Millisecond) //waiting for rate limit
+				Srv.CancelTransfer(Active[0].ID)
+			}
+			Pkt := Client.Expect(ERROR, UNKNOWNERROR) //no data is sent after cancel
+			if err := ReplyError(Pkt); err.(*ErrorReply).Message != Case.Message {
+				t.Fatalf("got %v, want %q", err, Case.Message)
+			}
+			if Elapsed := time.Since(Start); Elapsed > 1500*time.Millisecond {
+				t.Fatalf("transfer ended after %v", Elapsed)
+			}
+			WaitTransfers(t, Srv, 0)
+		})
+	}
+}
+
+func TestSubnetAliasServesPerSubnet(t *testing.T) {
+
+	var Lab SubnetAliases
+	if err := Lab.Set("fw.bin=127.0.0.2/32:fw-lab.bin"); err != nil {
+		t.Fatal(err)
+	}
+	Addr := StartTestServer(t, &Server{ResolveFilename: Lab.Resolve})
+	PutFile("fw.bin", []byte("production"))
+	PutFile("fw-lab.bin", []byte("lab build"))
+	if Data, _, err := NewTestClient(t, Addr).Get("fw.bin"); err != nil || string(Data) != "production" {
+		t.Fatalf("127.0.0.1 got %q, %v", Data, err)
+	}
+	if Data, _, err := NewTestClientFrom(t, Addr, net.IPv4(127, 0, 0, 2)).Get("fw.bin"); err != nil || string(Data) != "lab build" {
+		t.Fatalf("127.0.0.2 got %q, %v", Data, err)
+	}
+}
+
+func TestDedupStoresOneCopy(t *testing.T) {
+
+	SetFlag(t, Dedup, true)
+	Addr := StartTestServer(t, &Server{})
+	Data := bytes.Repeat([]byte("same"), 300)
+	for _, Name := range []string{"copy1", "copy2"} {
+		if _, err := NewTestClient(t, Addr).Put(Name, Data); err != nil {
+			t.Fatal(err)
+		}
+		WaitStored(t, Name)
+	}
+	FileMapLock.RLock()
+	defer FileMapLock.RUnlock()
+	if len(Contents) != 1 || FileMap["copy1"].Blocks != FileMap["copy2"].Blocks {
+		t.Fatalf("%d contents stored for identical files", len(Contents))
+	}
+	for _, Content := range Contents {
+		if Content.Refs != 2 {
+			t.Fatalf("content has %d references", Content.Refs)
+		}
+	}
+}
+
+// net.Conn of transfer tests. Packets or errors put in Incoming are read in order and
+// written packets are recorded. Read fails with timeout error at read deadline.
+type FakeConn struct {
+	Lock     sync.Mutex
+	Incoming chan any // []byte or error
+	Written  [][]byte
+	Deadline time.Time
+	Wake     chan struct{} // deadline changed
+}
+
+func NewFakeConn() *FakeConn {
+	return &FakeConn{Incoming: make(chan any, 16), Wake: make(chan struct{}, 1)}
+}
+
+func (Conn *FakeConn) Read(Buf []byte) (int, error) {
+
+	for {
+		Conn.Lock.Lock()
+		Deadline := Conn.Deadline
+		Conn.Lock.Unlock()
+		var Timer <-chan time.Time
+		if !Deadline.IsZero() {
+			Timer = time.After(time.Until(Deadline))
+		}
+		select {
+		case Item := <-Conn.Incoming:
+			if err, ok := Item.(error); ok {
+				return 0, err
+			}
+			return copy(Buf, Item.([]byte)), nil
+		case <-Timer:
+			return 0, os.ErrDeadlineExceeded
+		case <-Conn.Wake:
+		}
+	}
+}
+
+func (Conn *FakeConn) Write(Pkt []byte) (int, error) {
+
+	Conn.Lock.Lock()
+	defer Conn.Lock.Unlock()
+	Conn.Written = append(Conn.Written, append([]byte(nil), Pkt...))
+	return len(Pkt), nil
+}
+
+func (Conn *FakeConn) SetReadDeadline(Deadline time.Time) error {
+
+	Conn.Lock.Lock()
+	Conn.Deadline = Deadline
+	Conn.Lock.Unlock()
+	select {
+	case Conn.Wake <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// Sent gives copy of packets written so far
+func (Conn *FakeConn) Sent() [][]byte {
+
+	Conn.Lock.Lock()
+	defer Conn.Lock.Unlock()
+	return append([][]byte(nil), Conn.Written...)
+}
+
+func (Conn *FakeConn) Close() error        { return nil }
+func (Conn *FakeConn) LocalAddr() net.Addr { return &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 69} }
+func (Conn *FakeConn) RemoteAddr() net.Addr {
+	return &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1000}
+}
+func (Conn *FakeConn) SetDeadline(Deadline time.Time) error { return Conn.SetReadDeadline(Deadline) }
+func (Conn *FakeConn) SetWriteDeadline(time.Time) error     { return nil }
+
+func TestTransferStateMachine(t *testing.T) {
+
+	Finish := func(Pkt []byte) ([]byte, bool, error) { //final ACK ends transfer
+		Block, ok := DecodeACKPacket(Pkt)
+		if !ok {
+			return nil, false, fmt.Errorf("unexpected % x", Pkt)
+		}
+		return nil, Block == 1, nil
+	}
+	t.Run("answered", func(t *testing.T) {
+		Conn := NewFakeConn()
+		Conn.Incoming <- MakeACKPacket(0) //ignored by handler
+		Conn.Incoming <- MakeACKPacket(1)
+		T := (&Server{}).NewTransfer(context.Background(), Conn, 516, time.Second)
+		if err := T.Run(DataPacket(1, nil), Finish); err != nil || len(Conn.Sent()) != 1 || T.Retransmits != 0 {
+			t.Fatalf("%v, %d packets sent, %d retransmits", err, len(Conn.Sent()), T.Retransmits)
+		}
+	})
+	t.Run("timeout", func(t *testing.T) {
+		Conn := NewFakeConn()
+		T := (&Server{}).NewTransfer(context.Background(), Conn, 516, 10*time.Millisecond)
+		err := T.Run(DataPacket(1, nil), Finish)
+		if err != ErrTransferTimeout || len(Conn.Sent()) != 4 || T.Retransmits != 3 || T.Awaited() != "ACK of block 1" {
+			t.Fatalf("%v, %d packets sent, %d retransmits", err, len(Conn.Sent()), T.Retransmits)
+		}
+	})
+	t.Run("resent after timeout", func(t *testing.T) {
+		Conn := NewFakeConn()
+		T := (&Server{}).NewTransfer(context.Background(), Conn, 516, 20*time.Millisecond)
+		go func() {
+			time.Sleep(30 * time.Millisecond)
+			Conn.Incoming <- MakeACKPacket(1)
+		}()
+		if err := T.Run(DataPacket(1, nil), Finish); err != nil || T.Retransmits != 1 {
+			t.Fatalf("%v, %d retransmits", err, T.Retransmits)
+		}
+	})
+	t.Run("client error", func(t *testing.T) {
+		Conn := NewFakeConn()
+		Conn.Incoming <- MakeErrorPacket(UNKNOWNERROR, "stop")
+		T := (&Server{}).NewTransfer(context.Background(), Conn, 516, time.Second)
+		if err := T.Run(DataPacket(1, nil), Finish); err != ErrClientError {
+			t.Fatal(err)
+		}
+	})
+	t.Run("handler error", func(t *testing.T) {
+		Conn := NewFakeConn()
+		Conn.Incoming <- DataPacket(1, nil)
+		T := (&Server{}).NewTransfer(context.Background(), Conn, 516, time.Second)
+		if err := T.Run(DataPacket(1, nil), Finish); err == nil {
+			t.Fatal("DATA accepted as ACK")
+		}
+	})
+	t.Run("cancelled", func(t *testing.T) {
+		Conn := NewFakeConn()
+		Ctx, Cancel := context.WithCancel(context.Background())
+		T := (&Server{}).NewTransfer(Ctx, Conn, 516, time.Minute)
+		time.AfterFunc(10*time.Millisecond, Cancel)
+		err := T.Run(DataPacket(1, nil), Finish)
+		Sent := Conn.Sent()
+		if err != ErrTransferCancelled || ReplyError(Sent[len(Sent)-1]) == nil {
+			t.Fatalf("%v, last packet % x", err, Sent[len(Sent)-1])
+		}
+	})
+}
+
+func TestCompletionHookReportsNegotiatedBlksize(t *testing.T) {
+
+	SetFlag(t, MaxUnfragmentedBlksize, 1400)
+	Summaries := make(chan TransferSummary, 1)
+	Addr := StartTestServer(t, &Server{OnReadComplete: func(Summary TransferSummary) { Summaries <- Summary }})
+	PutFile("hooked", bytes.Repeat([]byte("h"), 3000))
+	_, Options, err := NewTestClient(t, Addr).Get("hooked", "blksize", "4000")
+	if err != nil || Options["blksize"] != "1400" {
+		t.Fatalf("OACK %v, %v", Options, err)
+	}
+	select {
+	case Summary := <-Summaries:
+		if Summary.Options["blksize"] != Options["blksize"] || Summary.Size != 3000 {
+			t.Fatalf("hook got %+v", Summary)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatal("hook not called")
+	}
+}
+
+func TestRequestLongerThan516Bytes(t *testing.T) {
+
+	Addr := StartTestServer(t, &Server{})
+	Name := strings.Repeat("n", 300)
+	PutFile(Name, []byte("long request"))
+	Options := []string{"blksize", "1024", "tsize", "0", "timeout", "1"}
+	for i := 0; i < 10; i++ { //unknown options are ignored
+		Options = append(Options, fmt.Sprint("vendor-option-", i), strings.Repeat("v", 5))
+	}
+	Pkt := binary.BigEndian.AppendUint16(nil, RRQ)
+	Pkt = append(Pkt, Name+"\x00octet\x00"+strings.Join(Options, "\x00")+"\x00"...)
+	if len(Pkt) <= 516 {
+		t.Fatalf("request is only %d bytes", len(Pkt))
+	}
+	Req := &RequestData{}
+	if err := ParseRequest(Pkt, uint16(len(Pkt)), Req); err != nil || Req.FileName != Name || len(Req.Options) != 13 || Req.Options["blksize"] != "1024" {
+		t.Fatalf("parsed %d options, %v", len(Req.Options), err)
+	}
+	Data, Accepted, err := NewTestClient(t, Addr).Get(Name, Options...)
+	if err != nil || string(Data) != "long request" || Accepted["blksize"] != "1024" {
+		t.Fatalf("OACK %v, got %q, %v", Accepted, Data, err)
+	}
+}
+
+func TestReadOnlyRejectsWrite(t *testing.T) {
+
+	Addr := StartTestServer(t, &Server{ReadOnly: true})
+	Client := NewTestClient(t, Addr)
+	Start := time.Now()
+	Client.Request(WRQ, "upload")
+	Pkt := Client.Expect(ERROR, ACCESSVIOLATION)
+	if ReplyError(Pkt).(*ErrorReply).Message != READONLYMSG || Client.Server.Port != Addr.Port || time.Since(Start) > time.Second {
+		t.Fatalf("got %v from %v", ReplyError(Pkt), Client.Server)
+	}
+}
+
+func TestRetransmitCountOfLossyLink(t *testing.T) {
+
+	Clock := NewFakeClock()
+	Summaries := make(chan TransferSummary, 1)
+	Addr := StartTestServer(t, &Server{Clock: Clock, OnReadComplete: func(Summary TransferSummary) { Summaries <- Summary }})
+	PutFile("lossy", bytes.Repeat([]byte("l"), 2000))
+	Client := NewTestClient(t, Addr)
+	Client.Request(RRQ, "lossy")
+	for Block := uint16(1); Block <= 4; Block++ {
+		Client.Expect(DATA, Block)
+		if Block%2 == 0 { //even blocks are lost once
+			Clock.WaitTimer(t)
+			Clock.Advance(TIMEOUT * time.Second)
+			Client.Expect(DATA, Block)
+		}
+		Client.Send(MakeACKPacket(Block))
+	}
+	select {
+	case Summary := <-Summaries:
+		if Summary.Retransmits != 2 {
+			t.Fatalf("%d retransmits counted, 2 blocks were lost", Summary.Retransmits)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatal("read not completed")
+	}
+}
+
+func TestZeroByteFileRoundTrip(t *testing.T) {
+
+	Addr := StartTestServer(t, &Server{})
+	if _, err := NewTestClient(t, Addr).Put("empty", nil); err != nil {
+		t.Fatal(err)
+	}
+	if Data := WaitStored(t, "empty"); len(Data) != 0 {
+		t.Fatalf("stored %q", Data)
+	}
+	Client := NewTestClient(t, Addr)
+	Client.Request(RRQ, "empty")
+	if Pkt := Client.Expect(DATA, 1); len(Pkt) != 4 {
+		t.Fatalf("DATA(1) of empty file has %d bytes", len(Pkt)-4)
+	}
+	Client.Send(MakeACKPacket(1))
+	for _, Size := range []int{512, 1024} { //multiple of block size ends with empty block
+		Data := bytes.Repeat([]byte("z"), Size)
+		Name := fmt.Sprint("full", Size)
+		if _, err := NewTestClient(t, Addr).Put(Name, Data); err != nil {
+			t.Fatal(err)
+		}
+		WaitStored(t, Name)
+		if Received, _, err := NewTestClient(t, Addr).Get(Name); err != nil || !bytes.Equal(Received, Data) {
+			t.Fatalf("%s got %d bytes, %v", Name, len(Received), err)
+		}
+	}
+}
+
+func TestHTTPGatewayServesUpload(t *testing.T) {
+
+	SetFlag(t, HTTPGateway, true)
+	Addr := StartTestServer(t, &Server{})
+	Data := bytes.Repeat([]byte{0, 1, 2, 0xff}, 700)
+	if _, err := NewTestClient(t, Addr).Put("gw.bin", Data); err != nil {
+		t.Fatal(err)
+	}
+	WaitStored(t, "gw.bin")
+	Recorder := httptest.NewRecorder()
+	HandleFile(Recorder, httptest.NewRequest(http.MethodGet, "/files/gw.bin", nil))
+	if Recorder.Code != http.StatusOK || !bytes.Equal(Recorder.Body.Bytes(), Data) {
+		t.Fatalf("HTTP %d, %d bytes", Recorder.Code, Recorder.Body.Len())
+	}
+}
+
+func TestTransferPortRange(t *testing.T) {
+
+	Low, High, err := ParsePortRange("41000-41009")
+	if err != nil {
+		t.Fatal(err)
+	}
+	SetFlag(t, &TransferPortLow, Low)
+	SetFlag(t, &TransferPortHigh, High)
+	Addr := StartTestServer(t, &Server{})
+	PutFile("ranged", []byte("x"))
+	for i := 0; i < 3; i++ {
+		Client := NewTestClient(t, Addr)
+		Client.Request(RRQ, "ranged")
+		Client.Expect(DATA, 1)
+		if Client.Server.Port < Low || Client.Server.Port > High {
+			t.Fatalf("transfer from port %d", Client.Server.Port)
+		}
+		Client.Send(MakeACKPacket(1))
+	}
+}
+
+func TestUnreachableClientAbortsFast(t *testing.T) {
+
+	if runtime.GOOS != "linux" {
+		t.Skip("ICMP errors are not reported to UDP sockets on this platform")
+	}
+	Srv := &Server{}
+	Addr := StartTestServer(t, Srv)
+	PutFile("gone", bytes.Repeat([]byte("g"), 2000))
+	Client := NewTestClient(t, Addr)
+	Client.Request(RRQ, "gone")
+	Client.Conn.Close()                //DATA(1) gets port unreachable
+	time.Sleep(300 * time.Millisecond) //much shorter than first timeout
+	if Active := Srv.ActiveTransfers(); len(Active) > 0 {
+		t.Fatalf("transfer still waiting for unreachable client: %+v", Active)
+	}
+}
+
+func TestMtimeNewerWinsStaleRejected(t *testing.T) {
+
+	Addr := StartTestServer(t, &Server{})
+	Upload := func(Data string, Options ...string) error {
+		_, err := NewTestClient(t, Addr).Put("cfg", []byte(Data), Options...)
+		return err
+	}
+	WaitContent := func(Want string) {
+		for Start := time.Now(); time.Since(Start) < 3*time.Second; time.Sleep(time.Millisecond) {
+			if Data, _ := StoredData("cfg"); string(Data) == Want {
+				return
+			}
+		}
+		t.Fatalf("stored content is not %q", Want)
+	}
+	if err := Upload("v1", "mtime", "1000"); err != nil {
+		t.Fatal(err)
+	}
+	WaitContent("v1")
+	if err := Upload("v2", "mtime", "2000"); err != nil { //newer wins
+		t.Fatal(err)
+	}
+	WaitContent("v2")
+	err := Upload("stale", "mtime", "1500")
+	if Reply, ok := err.(*ErrorReply); !ok || Reply.Code != FILEEXISTS || Reply.Message != STALEFILEMSG {
+		t.Fatalf("stale upload got %v", err)
+	}
+	if err := Upload("locked", "mtime", "3000", "pw", "secret"); err != nil {
+		t.Fatal(err)
+	}
+	WaitContent("locked")
+	err = Upload("newer without password", "mtime", "4000")
+	if Reply, ok := err.(*ErrorReply); !ok || Reply.Code != ACCESSVIOLATION {
+		t.Fatalf("upload without password got %v", err)
+	}
+	WaitContent("locked")
+}
+
+// WaitTransfers waits until server has given number of transfers in progress
+func WaitTransfers(t *testing.T, Srv *Server, Count int) []TransferInfo {
+
+	t.Helper()
+	for Start := time.Now(); time.Since(Start) < 3*time.Second; time.Sleep(time.Millisecond) {
+		if Active := Srv.ActiveTransfers(); len(Active) == Count {
+			return Active
+		}
+	}
+	t.Fatalf("%d transfers in progress, want %d", len(Srv.ActiveTransfers()), Count)
+	return nil
+}
+
+func TestActiveTransfersList(t *testing.T) {
+
+	Srv := &Server{}
+	Addr := StartTestServer(t, Srv)
+	PutFile("listed", bytes.Repeat([]byte("l"), 1000))
+	Client := NewTestClient(t, Addr)
+	Client.Request(RRQ, "listed")
+	Client.Expect(DATA, 1)
+	Client.Send(MakeACKPacket(1))
+	Client.Expect(DATA, 2)
+	Active := WaitTransfers(t, Srv, 1)
+	if Info := Active[0]; Info.FileName != "listed" || Info.Direction != "read" || Info.Client != Client.Conn.LocalAddr().String() || Info.Bytes != 512 {
+		t.Fatalf("transfer %+v", Info)
+	}
+	Client.Send(MakeACKPacket(2))
+	WaitTransfers(t, Srv, 0)
+}
+
+func TestCancelTransfer(t *testing.T) {
+
+	Srv := &Server{}
+	Addr := StartTestServer(t, Srv)
+	PutFile("cancelled", bytes.Repeat([]byte("c"), 2000))
+	Client := NewTestClient(t, Addr)
+	Client.Request(RRQ, "cancelled")
+	Client.Expect(DATA, 1) //not acknowledged so transfer waits for client
+	Active := WaitTransfers(t, Srv, 1)
+	if !Srv.CancelTransfer(Active[0].ID) {
+		t.Fatal("transfer not found")
+	}
+	Pkt := Client.Expect(ERROR, UNKNOWNERROR)
+	if ReplyError(Pkt).(*ErrorReply).Message != CANCELLEDMSG {
+		t.Fatalf("got %v", ReplyError(Pkt))
+	}
+	WaitTransfers(t, Srv, 0)
+	if Srv.CancelTransfer(Active[0].ID) {
+		t.Fatal("ended transfer cancelled")
+	}
+}
+
+func TestClientPrefixedUploadNames(t *testing.T) {
+
+	Addr := StartTestServer(t, &Server{RewriteWriteName: ClientPrefixedName})
+	for _, IP := range []net.IP{net.IPv4(127, 0, 0, 1), net.IPv4(127, 0, 0, 2)} {
+		if _, err := NewTestClientFrom(t, Addr, IP).Put("data", []byte("from "+IP.String())); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, IP := range []string{"127.0.0.1", "127.0.0.2"} {
+		if Data := WaitStored(t, IP+"-data"); string(Data) != "from "+IP {
+			t.Fatalf("%s-data has %q", IP, Data)
+		}
+	}
+	if _, ok := StoredData("data"); ok {
+		t.Fatal("upload stored under requested name")
+	}
+}
+
+func TestWriteBlockGapAndDuplicate(t *testing.T) {
+
+	Addr := StartTestServer(t, &Server{})
+	Block := bytes.Repeat([]byte("b"), 512)
+	t.Run("duplicate", func(t *testing.T) {
+		Client := NewTestClient(t, Addr)
+		Client.Request(WRQ, "dup")
+		Client.Expect(ACK, 0)
+		Client.Send(DataPacket(1, Block))
+		Client.Expect(ACK, 1)
+		Client.Send(DataPacket(1, Block)) //re-ACKed and not stored twice
+		Client.Expect(ACK, 1)
+		Client.Send(DataPacket(2, nil))
+		Client.Expect(ACK, 2)
+		if Data := WaitStored(t, "dup"); !bytes.Equal(Data, Block) {
+			t.Fatalf("stored %d bytes", len(Data))
+		}
+	})
+	t.Run("gap", func(t *testing.T) {
+		Client := NewTestClient(t, Addr)
+		Client.Request(WRQ, "gap")
+		Client.Expect(ACK, 0)
+		Client.Send(DataPacket(1, Block))
+		Client.Expect(ACK, 1)
+		Client.Send(DataPacket(3, []byte("end"))) //block 2 is lost
+		if Pkt := Client.Expect(ERROR, ILLEGALOP); ReplyError(Pkt).(*ErrorReply).Message != FUTUREDATAMSG {
+			t.Fatalf("got %v", ReplyError(Pkt))
+		}
+		time.Sleep(50 * time.Millisecond)
+		if _, ok := StoredData("gap"); ok {
+			t.Fatal("file with missing block stored")
+		}
+	})
+}
+
+func TestAbusiveOptionsRejected(t *testing.T) {
+
+	Addr := StartTestServer(t, &Server{})
+	PutFile("f", []byte("x"))
+	var Many []string
+	for i := 0; i < 20; i++ { //more than -max-options
+		Many = append(Many, fmt.Sprint("o", i), "1")
+	}
+	Long := []string{"blksize", "1024", "x", strings.Repeat("v", 600)} //longer than -max-options-length
+	for _, Options := range [][]string{Many, Long} {
+		_, _, err := NewTestClient(t, Addr).Get("f", Options...)
+		if Reply, ok := err.(*ErrorReply); !ok || Reply.Code != ILLEGALOP {
+			t.Fatalf("%d options got %v", len(Options)/2, err)
+		}
+	}
+}
+
+func TestVirtualFileComputedContent(t *testing.T) {
+
+	Srv := &Server{}
+	Srv.RegisterVirtualFile("whoami", func(Client net.Addr) ([]byte, error) {
+		return []byte("you are " + Client.String()), nil
+	})
+	Addr := StartTestServer(t, Srv)
+	Client := NewTestClient(t, Addr)
+	Data, _, err := Client.Get("whoami")
+	if err != nil || string(Data) != "you are "+Client.Conn.LocalAddr().String() {
+		t.Fatalf("got %q, %v", Data, err)
+	}
+}
+
+func TestRequestDuringDrainGetsShutdownError(t *testing.T) {
+
+	ResetStore(t)
+	PutFile("drain", bytes.Repeat([]byte("d"), 2000))
+	Conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	Srv := &Server{}
+	Ctx, Cancel := context.WithCancel(context.Background())
+	Done := make(chan error)
+	go func() { Done <- Srv.ServeConn(Ctx, Conn) }()
+	Addr := Conn.LocalAddr().(*net.UDPAddr)
+	Reader := NewTestClient(t, Addr)
+	Reader.Request(RRQ, "drain")
+	Reader.Expect(DATA, 1) //transfer in progress keeps server draining
+	Cancel()
+	for !Srv.Stopping.Load() {
+		time.Sleep(time.Millisecond)
+	}
+	Late := NewTestClient(t, Addr)
+	Late.Request(RRQ, "drain")
+	if Pkt := Late.Expect(ERROR, UNKNOWNERROR); ReplyError(Pkt).(*ErrorReply).Message != SHUTDOWNMSG {
+		t.Fatalf("got %v", ReplyError(Pkt))
+	}
+	for Block := uint16(1); Block <= 4; Block++ { //transfer in progress is completed
+		Reader.Send(MakeACKPacket(Block))
+		if Block < 4 {
+			Reader.Expect(DATA, Block+1)
+		}
+	}
+	if err := <-Done; err != nil {
+		t.Fatal(err)
+	}
+}
+
+// StartMainServer runs server with command line arguments in child process until test ends.
+// It gives listening address reported by JSON banner
+func StartMainServer(t *testing.T, Args ...string) *net.UDPAddr {
+
+	t.Helper()
+	Child := exec.Command(os.Args[0], "-test.run=^TestMainHelper$")
+	Child.Env = append(os.Environ(), "TFTP_TEST_MAIN_ARGS="+strings.Join(append([]string{"-banner", "json"}, Args...), "\n"))
+	Stdout, err := Child.StdoutPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := Child.Start(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		Child.Process.Kill()
+		Child.Wait()
+	})
+	var Banner struct {
+		Addr string `json:"addr"`
+	}
+	Scanner := bufio.NewScanner(Stdout)
+	for Banner.Addr == "" && Scanner.Scan() {
+		json.Unmarshal(Scanner.Bytes(), &Banner) //other lines are not JSON
+	}
+	go io.Copy(io.Discard, Stdout) //server must not block on full pipe
+	Addr, err := net.ResolveUDPAddr("udp", Banner.Addr)
+	if err != nil || Addr.Port == 0 {
+		t.Fatalf("banner address %q, %v", Banner.Addr, err)
+	}
+	return Addr
+}
+
+func TestJSONBannerGivesBoundAddress(t *testing.T) {
+
+	Addr := StartMainServer(t, "-max-uptime", "5s", "127.0.0.1:0")
+	_, _, err := NewTestClient(t, Addr).Get("missing") //server answers on reported address
+	if Reply, ok := err.(*ErrorReply); !ok || Reply.Code != FILENOTFOUND {
+		t.Fatalf("got %v", err)
+	}
+}
+
+func BenchmarkLargeUpload(b *testing.B) {
+
+	Addr := StartTestServer(b, &Server{})
+	Data := bytes.Repeat([]byte("0123456789abcdef"), 1<<16) //1 MiB
+	b.ReportAllocs()
+	b.SetBytes(int64(len(Data)))
+	for i := 0; b.Loop(); i++ {
+		Name := fmt.Sprint("large", i)
+		if _, err := NewTestClient(b, Addr).Put(Name, Data, "blksize", "1428"); err != nil {
+			b.Fatal(err)
+		}
+		for Stored := false; !Stored; { //file is stored after final ACK is sent
+			FileMapLock.Lock()
+			_, Stored = FileMap[Name]
+			RemoveFile(Name)
+			FileMapLock.Unlock()
+		}
+	}
+}
+
+func TestHugeBlksizeClampedInOACK(t *testing.T) {
+
+	SetFlag(t, MaxUnfragmentedBlksize, 1468)
+	Addr := StartTestServer(t, &Server{})
+	PutFile("huge", bytes.Repeat([]byte("h"), 5000))
+	Data, Options, err := NewTestClient(t, Addr).Get("huge", "blksize", "65464")
+	if err != nil || Options["blksize"] != "1468" || len(Data) != 5000 {
+		t.Fatalf("OACK %v, got %d bytes, %v", Options, len(Data), err)
+	}
+}
+
+func TestTemporaryReadErrorSurvived(t *testing.T) {
+
+	Conn := NewFakeConn()
+	Conn.Incoming <- &net.OpError{Op: "read", Net: "udp", Err: os.NewSyscallError("recvfrom", syscall.EAGAIN)}
+	Conn.Incoming <- &net.OpError{Op: "read", Net: "udp", Err: os.NewSyscallError("recvfrom", syscall.EINTR)}
+	Conn.Incoming <- MakeACKPacket(1)
+	T := (&Server{}).NewTransfer(context.Background(), Conn, 516, time.Second)
+	err := T.Run(DataPacket(1, nil), func(Pkt []byte) ([]byte, bool, error) { return nil, true, nil })
+	if err != nil || len(Conn.Sent()) != 1 {
+		t.Fatalf("%v, %d packets sent", err, len(Conn.Sent()))
+	}
+	Conn = NewFakeConn()
+	Conn.Incoming <- errors.New("socket broken") //other errors end transfer
+	T = (&Server{}).NewTransfer(context.Background(), Conn, 516, time.Second)
+	if err = T.Run(DataPacket(1, nil), func(Pkt []byte) ([]byte, bool, error) { return nil, true, nil }); err == nil {
+		t.Fatal("transfer survived permanent error")
+	}
+}
+
+func TestContentTypeServedByGateway(t *testing.T) {
+
+	SetFlag(t, HTTPGateway, true)
+	Addr := StartTestServer(t, &Server{})
+	if _, err := NewTestClient(t, Addr).Put("page", []byte("<html></html>"), "contenttype", "text/html"); err != nil {
+		t.Fatal(err)
+	}
+	WaitStored(t, "page")
+	Recorder := httptest.NewRecorder()
+	HandleFile(Recorder, httptest.NewRequest(http.MethodGet, "/files/page", nil))
+	if Type := Recorder.Header().Get("Content-Type"); Recorder.Code != http.StatusOK || Type != "text/html" {
+		t.Fatalf("HTTP %d, Content-Type %q", Recorder.Code, Type)
+	}
+}
+
+func FuzzParseRequest(f *testing.F) {
+
+	Seeds := []string{
+		"\x00\x01file\x00octet\x00",
+		"\x00\x02file\x00netascii\x00blksize\x001428\x00tsize\x000\x00",
+		"\x00\x01file\x00octet\x00blksize\x00",
+		"\x00\x01\x00octet\x00",
+		"\x00\x01file\x00octet",
+		"\x00\x01file",
+		"\x00\x01",
+		"\x00",
+		"",
+		"\x00\x03\x00\x01data",
+		"\x00\x04\x00\x01",
+		"\x00\x05\x00\x01oops\x00",
+		"\x00\x00file\x00octet\x00",
+		"\x00\x63file\x00octet\x00",
+		"\xff\xff\xff\xff",
+	}
+	for _, Seed := range Seeds {
+		f.Add([]byte(Seed))
+	}
+	f.Fuzz(func(t *testing.T, Pkt []byte) {
+		Req := &RequestData{}
+		err := ParseRequest(Pkt, uint16(min(len(Pkt), 0xffff)), Req)
+		if err != nil {
+			var ParseErr *ParseError
+			if !errors.As(err, &ParseErr) || ParseErr.Reason == "" || ParseErr.Offset < 0 || ParseErr.Offset > len(Pkt) {
+				t.Fatalf("malformed error %#v", err)
+			}
+			return
+		}
+		if Req.OPcode == 0 || Req.OPcode > ERROR {
+			t.Fatalf("opcode %d accepted", Req.OPcode)
+		}
+		if (Req.OPcode == RRQ || Req.OPcode == WRQ) && (Req.Options == nil || len(Req.FileName)+len(Req.Mode)+4 > len(Pkt)) {
+			t.Fatalf("request parsed inconsistently: %+v", Req)
+		}
+	})
+}
+
+func FuzzDecodeDataPacket(f *testing.F) {
+
+	f.Add([]byte("\x00\x03\x00\x01data"), 512)
+	f.Add([]byte("\x00\x03\xff\xff"), 8)
+	f.Add([]byte("\x00\x03\x00\x02"+strings.Repeat("x", 600)), 512)
+	f.Add([]byte("\x00\x04\x00\x01"), 512)
+	f.Add([]byte("\x00\x03\x00"), 512)
+	f.Add([]byte{}, 512)
+	f.Fuzz(func(t *testing.T, Pkt []byte, BlockSize int) {
+		if BlockSize < MINBLKSIZE || BlockSize > MAXBLKSIZE { //only negotiated sizes are used
+			return
+		}
+		Block, Payload, err := DecodeDataPacket(Pkt, BlockSize)
+		if err != nil {
+			if Payload != nil || Block != 0 {
+				t.Fatalf("error %v with block %d and %d bytes", err, Block, len(Payload))
+			}
+			return
+		}
+		if len(Pkt) < 4 || binary.BigEndian.Uint16(Pkt) != DATA || binary.BigEndian.Uint16(Pkt[2:]) != Block {
+			t.Fatalf("% x decoded as block %d", Pkt, Block)
+		}
+		if len(Payload) > BlockSize || !bytes.Equal(Payload, Pkt[4:4+len(Payload)]) || len(Payload) != min(len(Pkt)-4, BlockSize) {
+			t.Fatalf("payload of %d bytes from %d byte packet", len(Payload), len(Pkt))
+		}
+	})
+}
+
+func BenchmarkRead(b *testing.B) {
+
+	Addr := StartTestServer(b, &Server{})
+	Data := bytes.Repeat([]byte("0123456789abcdef"), 1<<16) //1 MiB
+	PutFile("bench", Data)
+	b.SetBytes(int64(len(Data)))
+	for b.Loop() {
+		if Received, _, err := NewTestClient(b, Addr).Get("bench", "blksize", "1428"); err != nil || len(Received) != len(Data) {
+			b.Fatalf("got %d bytes, %v", len(Received), err)
+		}
+	}
+}
+
+func BenchmarkWrite(b *testing.B) {
+
+	Addr := StartTestServer(b, &Server{})
+	Data := bytes.Repeat([]byte("0123456789abcdef"), 1<<16) //1 MiB
+	b.SetBytes(int64(len(Data)))
+	for i := 0; b.Loop(); i++ {
+		if _, err := NewTestClient(b, Addr).Put(fmt.Sprint("bench", i), Data, "blksize", "1428"); err != nil {
+			b.Fatal(err)
+		}
+	}
+	b.StopTimer()
+	ResetStore(b)
+}
+
+func BenchmarkConcurrentTransfers(b *testing.B) {
+
+	Addr := StartTestServer(b, &Server{})
+	Data := bytes.Repeat([]byte("0123456789abcdef"), 1<<14) //256 KiB
+	PutFile("bench", Data)
+	const Clients = 16
+	b.SetBytes(int64(len(Data)) * Clients)
+	for b.Loop() {
+		var Readers sync.WaitGroup
+		Failed := make(chan error, Clients)
+		for i := 0; i < Clients; i++ {
+			Readers.Add(1)
+			go func() {
+				defer Readers.Done()
+				if Received, _, err := NewTestClient(b, Addr).Get("bench", "blksize", "1428"); err != nil || len(Received) != len(Data) {
+					Failed <- fmt.Errorf("got %d bytes, %v", len(Received), err)
+				}
+			}()
+		}
+		Readers.Wait()
+		close(Failed)
+		if err := <-Failed; err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestUpstreamServerChain(t *testing.T) {
+
+	Dir := t.TempDir()
+	Data := bytes.Repeat([]byte("upstream "), 500)
+	os.WriteFile(filepath.Join(Dir, "chained"), Data, 0644)
+	First := StartMainServer(t, "-preload-dir", Dir, "-max-uptime", "10s", "127.0.0.1:0") //own process so store is not shared
+	SetFlag(t, Upstream, First.String())
+	Second := StartTestServer(t, &Server{})
+	if Received, _, err := NewTestClient(t, Second).Get("chained"); err != nil || !bytes.Equal(Received, Data) {
+		t.Fatalf("got %d bytes, %v", len(Received), err)
+	}
+	if Stored := WaitStored(t, "chained"); !bytes.Equal(Stored, Data) {
+		t.Fatalf("second server kept %d bytes", len(Stored))
+	}
+	_, _, err := NewTestClient(t, Second).Get("absent")
+	if Reply, ok := err.(*ErrorReply); !ok || Reply.Code != FILENOTFOUND {
+		t.Fatalf("file missing on both servers got %v", err)
+	}
+}
+
+func TestReadAtSmallerBlksizeThanUpload(t *testing.T) {
+
+	Addr := StartTestServer(t, &Server{})
+	Data := make([]byte, 5000)
+	for i := range Data {
+		Data[i] = byte(i * 7)
+	}
+	if _, err := NewTestClient(t, Addr).Put("reblocked", Data, "blksize", "1428"); err != nil {
+		t.Fatal(err)
+	}
+	WaitStored(t, "reblocked")
+	for _, Size := range []string{"8", "512", "1000"} {
+		Received, Options, err := NewTestClient(t, Addr).Get("reblocked", "blksize", Size)
+		if err != nil || Options["blksize"] != Size || !bytes.Equal(Received, Data) {
+			t.Fatalf("blksize %s: OACK %v, got %d bytes, %v", Size, Options, len(Received), err)
+		}
+	}
+}
+
+func TestSnapshotAcrossRestart(t *testing.T) {
+
+	SetFlag(t, SnapshotFile, filepath.Join(t.TempDir(), "store.snap"))
+	ResetStore(t)
+	Conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	Ctx, Cancel := context.WithCancel(context.Background())
+	Done := make(chan error)
+	go func() { Done <- (&Server{}).ServeConn(Ctx, Conn) }()
+	Addr := Conn.LocalAddr().(*net.UDPAddr)
+	NewTestClient(t, Addr).Put("plain", []byte("kept"), "mtime", "1700000000")
+	NewTestClient(t, Addr).Put("locked", []byte("kept too"), "pw", "secret")
+	NewTestClient(t, Addr).Put("quota", []byte("two reads"), "maxreads", "2")
+	NewTestClient(t, Addr).Put("used", []byte("one read"), "maxreads", "1")
+	NewTestClient(t, Addr).Put("boot", []byte("pinned"), "pinned", "1")
+	WaitStored(t, "boot")
+	WaitStored(t, "plain")
+	WaitStored(t, "locked")
+	WaitStored(t, "quota")
+	WaitStored(t, "used")
+	for _, Name := range []string{"quota", "used"} { //quota used before restart
+		if _, _, err := NewTestClient(t, Addr).Get(Name); err != nil {
+			t.Fatal(err)
+		}
+	}
+	Cancel()
+	<-Done
+	SaveSnapshotOnStop()
+
+	Srv := &Server{}
+	Addr = StartTestServer(t, Srv) //restart with empty store
+	if Count, err := LoadSnapshot(*SnapshotFile); err != nil || Count != 5 {
+		t.Fatalf("restored %d files, %v", Count, err)
+	}
+	if Data, Options, err := NewTestClient(t, Addr).Get("plain", "stat", "1"); err != nil || Options["mtime"] != "1700000000" || Options["size"] != "4" || len(Data) != 0 {
+		t.Fatalf("plain stat %v, %v", Options, err)
+	}
+	if Data, _, err := NewTestClient(t, Addr).Get("locked", "pw", "secret"); err != nil || string(Data) != "kept too" {
+		t.Fatalf("locked got %q, %v", Data, err)
+	}
+	if _, _, err := NewTestClient(t, Addr).Get("locked"); err == nil {
+		t.Fatal("password protection lost by restore")
+	}
+	Pinned := make(map[string]bool)
+	for _, Info := range Srv.ListFiles() {
+		Pinned[Info.Name] = Info.Pinned
+	}
+	if !Pinned["boot"] || Pinned["plain"] {
+		t.Fatalf("pinned flags after restore %v", Pinned)
+	}
+	if _, Options, err := NewTestClient(t, Addr).Get("quota", "stat", "1"); err != nil || Options["reads"] != "1" {
+		t.Fatalf("quota stat %v, %v", Options, err)
+	}
+	QuotaError := func(err error) bool {
+		Reply, ok := err.(*ErrorReply)
+		return ok && Reply.Message == READQUOTAMSG
+	}
+	if Data, _, err := NewTestClient(t, Addr).Get("quota"); err != nil || string(Data) != "two reads" { //second of two reads
+		t.Fatalf("quota got %q, %v", Data, err)
+	}
+	for _, Name := range []string{"quota", "used"} {
+		if _, _, err := NewTestClient(t, Addr).Get(Name); !QuotaError(err) {
+			t.Fatalf("%s read over quota got %v", Name, err)
+		}
+	}
+
+	//snapshot of older version has no maxreads and reads fields
+	var Old bytes.Buffer
+	Writer := bufio.NewWriter(&Old)
+	Writer.WriteString(SNAPSHOTMAGICV1)
+	for _, Field := range [][]byte{[]byte("old"), []byte("text/plain"), nil, binary.BigEndian.AppendUint64(nil, uint64(time.Unix(1700000000, 0).UnixNano()))} {
+		WriteSnapshotField(Writer, Field)
+	}
+	WriteSnapshotField(Writer, []byte("old data"))
+	Writer.Flush()
+	OldPath := filepath.Join(t.TempDir(), "old.snap")
+	if err := os.WriteFile(OldPath, Old.Bytes(), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if Count, err := LoadSnapshot(OldPath); err != nil || Count != 1 {
+		t.Fatalf("restored %d files of old snapshot, %v", Count, err)
+	}
+	if Data, _, err := NewTestClient(t, Addr).Get("old"); err != nil || string(Data) != "old data" {
+		t.Fatalf("old got %q, %v", Data, err)
+	}
+}
+
+func TestUpstreamFetchNegotiatesBlksize(t *testing.T) {
+
+	Data := bytes.Repeat([]byte("blksize!"), 625) //5000 bytes
+	t.Run("option aware server", func(t *testing.T) {
+		Addr := StartTestServer(t, &Server{})
+		PutFile("big", Data)
+		var Sizes []int
+		var Got []byte
+		err := FetchFromUpstream(Addr.String(), "big", 1428, func(Block []byte) {
+			Sizes = append(Sizes, len(Block))
+			Got = append(Got, Block...)
+		})
+		if err != nil || !bytes.Equal(Got, Data) {
+			t.Fatalf("fetched %d bytes, %v", len(Got), err)
+		}
+		if fmt.Sprint(Sizes) != "[1428 1428 1428 716]" {
+			t.Fatalf("block sizes %v, want 1428 byte blocks", Sizes)
+		}
+	})
+	t.Run("server without options", func(t *testing.T) {
+		Release := make(chan struct{})
+		close(Release)
+		Addr := StartFakeUpstream(t, Data[:1600], Release) //replies DATA to request with blksize
+		var Got []byte
+		err := FetchFromUpstream(Addr.String(), "big", 1428, func(Block []byte) { Got = append(Got, Block...) })
+		if err != nil || !bytes.Equal(Got, Data[:1600]) {
+			t.Fatalf("fetched %d bytes, %v", len(Got), err)
+		}
+	})
+}
+
+// LossyConn loses packets written to wrapped socket, as a lossy link would
+type LossyConn struct {
+	net.PacketConn
+	DropNth   int        // Nth written packet is lost, counted from 1 (disabled if 0)
+	DropFirst int        // this many first written packets are lost (ex. whole first attempt of transfer)
+	Fraction  float64    // fraction of written packets lost at random
+	Rand      *rand.Rand // source of random loss. Seeded so loss is repeatable
+
+	Lock    sync.Mutex
+	Written int
+	Dropped [][]byte // lost packets in order
+}
+
+func NewLossyConn(Conn net.PacketConn, DropNth int, Fraction float64) *LossyConn {
+
+	return &LossyConn{PacketConn: Conn, DropNth: DropNth, Fraction: Fraction, Rand: rand.New(rand.NewSource(1))}
+}
+
+func (Conn *LossyConn) WriteTo(Pkt []byte, Addr net.Addr) (int, error) {
+
+	Conn.Lock.Lock()
+	Conn.Written++
+	Lost := Conn.Written == Conn.DropNth || Conn.Written <= Conn.DropFirst || (Conn.Fraction > 0 && Conn.Rand.Float64() < Conn.Fraction)
+	if Lost {
+		Conn.Dropped = append(Conn.Dropped, append([]byte(nil), Pkt...))
+	}
+	Conn.Lock.Unlock()
+	if Lost { //sender can not tell lost packet from sent one
+		return len(Pkt), nil
+	}
+	return Conn.PacketConn.WriteTo(Pkt, Addr)
+}
+
+// LostPackets returns copy of packets lost so far
+func (Conn *LossyConn) LostPackets() [][]byte {
+
+	Conn.Lock.Lock()
+	defer Conn.Lock.Unlock()
+	return append([][]byte(nil), Conn.Dropped...)
+}
+
+func TestLostDataPacketRetransmitted(t *testing.T) {
+
+	SetFlag(t, SinglePort, true) //DATA is written to listening socket so it goes through LossyConn
+	Conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	Lossy := NewLossyConn(Conn, 2, 0) //DATA(2) is lost
+	Clock := NewFakeClock()
+	Addr := StartTestServerConn(t, &Server{Clock: Clock}, Lossy)
+	Data := bytes.Repeat([]byte("r"), 1200)
+	PutFile("lost", Data)
+	Client := NewTestClient(t, Addr)
+	Client.Request(RRQ, "lost")
+	Client.Expect(DATA, 1)
+	Client.Send(MakeACKPacket(1))
+	if Pkt, ok := Client.Recv(200 * time.Millisecond); ok {
+		t.Fatalf("received %v while DATA(2) was lost", Pkt[:4])
+	}
+	Clock.WaitTimer(t)
+	Clock.Advance(TIMEOUT * time.Second)
+	Client.Expect(DATA, 2) //retransmitted
+	Client.Send(MakeACKPacket(2))
+	Last := Client.Expect(DATA, 3)
+	Client.Send(MakeACKPacket(3))
+	if !bytes.Equal(Last[4:], Data[1024:]) {
+		t.Fatal("last block has wrong content")
+	}
+	if Lost := Lossy.LostPackets(); len(Lost) != 1 || !bytes.Equal(Lost[0][:4], DataPacket(2, nil)) {
+		t.Fatalf("lost packets %v", Lost)
+	}
+}
+
+func TestTruncatedDataBlockNotAcknowledged(t *testing.T) {
+
+	Clock := NewFakeClock()
+	Addr := StartTestServer(t, &Server{Clock: Clock})
+	Data := bytes.Repeat([]byte("t"), 1000)
+	Client := NewTestClient(t, Addr)
+	Client.Request(WRQ, "frag", "tsize", "1000")
+	Client.Expect(OACK, 0)
+	Client.Send(DataPacket(1, Data[:300])) //tail of block lost in reassembly
+	if Pkt, ok := Client.Recv(200 * time.Millisecond); ok {
+		t.Fatalf("truncated block answered with %v", Pkt[:4])
+	}
+	Clock.WaitTimer(t)
+	Clock.Advance(TIMEOUT * time.Second)
+	Client.Expect(OACK, 0) //last reply resent, client sends block 1 again
+	Client.Send(DataPacket(1, Data[:512]))
+	Client.Expect(ACK, 1)
+	Client.Send(DataPacket(2, Data[512:]))
+	Client.Expect(ACK, 2)
+	if Stored := WaitStored(t, "frag"); !bytes.Equal(Stored, Data) {
+		t.Fatalf("stored %d bytes, want %d", len(Stored), len(Data))
+	}
+}
+
+func TestReadCounter(t *testing.T) {
+
+	Completed := make(chan TransferSummary, 4)
+	Srv := &Server{OnReadComplete: func(Summary TransferSummary) { Completed <- Summary }}
+	Addr := StartTestServer(t, Srv)
+	PutFile("popular", []byte("read me"))
+	PutFile("other", []byte("not me"))
+	for i := 0; i < 3; i++ {
+		if _, _, err := NewTestClient(t, Addr).Get("popular"); err != nil {
+			t.Fatal(err)
+		}
+		select {
+		case <-Completed:
+		case <-time.After(3 * time.Second):
+			t.Fatal("read not completed")
+		}
+	}
+	Reads := make(map[string]int64)
+	for _, Info := range Srv.ListFiles() {
+		Reads[Info.Name] = Info.Reads
+	}
+	if Reads["popular"] != 3 || Reads["other"] != 0 {
+		t.Fatalf("listing reports reads %v", Reads)
+	}
+	if _, Options, err := NewTestClient(t, Addr).Get("popular", "stat", "1"); err != nil || Options["reads"] != "3" {
+		t.Fatalf("stat reports %v, %v", Options, err)
+	}
+}
+
+func TestShutdownMidWritePolicies(t *testing.T) {
+
+	Data := bytes.Repeat([]byte("s"), 700) //2 blocks
+	for _, Policy := range []string{"wait", "abort", "commit"} {
+		t.Run(Policy, func(t *testing.T) {
+			SetFlag(t, ShutdownWrites, Policy)
+			ResetStore(t)
+			Conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+			if err != nil {
+				t.Fatal(err)
+			}
+			Ctx, Cancel := context.WithCancel(context.Background())
+			Done := make(chan error)
+			go func() { Done <- (&Server{}).ServeConn(Ctx, Conn) }()
+			Client := NewTestClient(t, Conn.LocalAddr().(*net.UDPAddr))
+			Client.Request(WRQ, "partial")
+			Client.Expect(ACK, 0)
+			Client.Send(DataPacket(1, Data[:512]))
+			Client.Expect(ACK, 1)
+			Cancel() //stop with upload in progress
+			if Policy == "wait" {
+				Client.Send(DataPacket(2, Data[512:]))
+				Client.Expect(ACK, 2)
+			} else if Pkt := Client.Expect(ERROR, UNKNOWNERROR); !strings.Contains(string(Pkt), CANCELLEDMSG) {
+				t.Fatalf("client got %v", ReplyError(Pkt))
+			}
+			select {
+			case <-Done:
+			case <-time.After(3 * time.Second):
+				t.Fatal("server not stopped")
+			}
+			Stored, ok := StoredData("partial")
+			switch Policy {
+			case "wait":
+				if !bytes.Equal(Stored, Data) {
+					t.Fatalf("stored %d bytes, want whole upload", len(Stored))
+				}
+			case "abort":
+				if ok {
+					t.Fatalf("aborted upload stored %d bytes", len(Stored))
+				}
+			case "commit":
+				if !bytes.Equal(Stored, Data[:512]) {
+					t.Fatalf("stored %d bytes, want 512 received before stop", len(Stored))
+				}
+			}
+		})
+	}
+}
+
+func TestRoundTripAtRandomBlksizes(t *testing.T) {
+
+	Addr := StartTestServer(t, &Server{})
+	Random := rand.New(rand.NewSource(163))
+	for i := 0; i < 25; i++ {
+		PutBlock, GetBlock := MINBLKSIZE+Random.Intn(3000), MINBLKSIZE+Random.Intn(3000)
+		Data := make([]byte, Random.Intn(40000))
+		Random.Read(Data)
+		if i%5 == 0 { //size of whole upload blocks so last block is empty
+			Data = Data[:len(Data)/PutBlock*PutBlock]
+		}
+		Name := "random" + strconv.Itoa(i)
+		PutSize, GetSize := strconv.Itoa(PutBlock), strconv.Itoa(GetBlock)
+		if _, err := NewTestClient(t, Addr).Put(Name, Data, "blksize", PutSize); err != nil {
+			t.Fatalf("%s upload at blksize %s: %v", Name, PutSize, err)
+		}
+		WaitStored(t, Name)
+		Got, _, err := NewTestClient(t, Addr).Get(Name, "blksize", GetSize)
+		if err != nil || !bytes.Equal(Got, Data) {
+			t.Fatalf("%s of %d bytes uploaded at blksize %s read back at %s as %d bytes, %v", Name, len(Data), PutSize, GetSize, len(Got), err)
+		}
+	}
+}
+
+func TestPinnedFileSurvivesOneShot(t *testing.T) {
+
+	SetFlag(t, OneShot, true) //files are removed after first read unless pinned
+	Srv := &Server{}
+	Addr := StartTestServer(t, Srv)
+	if _, err := NewTestClient(t, Addr).Put("boot", []byte("bootfile"), "pinned", "1"); err != nil {
+		t.Fatal(err)
+	}
+	WaitStored(t, "boot")
+	PutFile("admin-pinned", []byte("pinned by admin"))
+	PutFile("plain", []byte("removed"))
+	Recorder := httptest.NewRecorder()
+	HandleFile(Recorder, httptest.NewRequest(http.MethodPost, "/files/admin-pinned?pinned=true", nil))
+	if Recorder.Code != http.StatusNoContent {
+		t.Fatalf("pin request got status %d", Recorder.Code)
+	}
+	for _, Name := range []string{"boot", "admin-pinned", "plain"} {
+		if _, _, err := NewTestClient(t, Addr).Get(Name); err != nil {
+			t.Fatalf("%s: %v", Name, err)
+		}
+	}
+	WaitTransfers(t, Srv, 0) //one-shot removal is done before transfer ends
+	Stored := make(map[string]bool)
+	for _, Info := range Srv.ListFiles() {
+		Stored[Info.Name] = Info.Pinned
+	}
+	if len(Stored) != 2 || !Stored["boot"] || !Stored["admin-pinned"] {
+		t.Fatalf("stored files after reads %v, want only pinned ones", Stored)
+	}
+}
+
+func TestCapabilitiesReflectFlags(t *testing.T) {
+
+	Listener, err := net.Listen("tcp", "127.0.0.1:0") //free port for admin endpoint
+	if err != nil {
+		t.Fatal(err)
+	}
+	AdminAddr := Listener.Addr().String()
+	Listener.Close()
+	StartMainServer(t, "-admin-addr", AdminAddr, "-read-only", "-min-blksize", "64", "-max-unfragmented-blksize", "1400",
+		"-workers", "7", "-one-shot", "-rate-limit-bps", "9000", "-resume-ttl", "1m", "-single-port", "127.0.0.1:0")
+	var Caps Capabilities
+	for Start := time.Now(); ; time.Sleep(10 * time.Millisecond) { //admin server may start after banner
+		Resp, err := http.Get("http://" + AdminAddr + "/capabilities")
+		if err == nil {
+			defer Resp.Body.Close()
+			if err := json.NewDecoder(Resp.Body).Decode(&Caps); err != nil {
+				t.Fatal(err)
+			}
+			break
+		}
+		if time.Since(Start) > 3*time.Second {
+			t.Fatal(err)
+		}
+	}
+	if !Caps.ReadOnly || Caps.MinBlksize != 64 || Caps.MaxBlksize != 1400 || Caps.Workers != 7 || !Caps.OneShot ||
+		Caps.RateLimitBps != 9000 || Caps.ResumeTTL != "1m0s" || !Caps.SinglePort || Caps.Dedup {
+		t.Fatalf("capabilities do not match flags: %+v", Caps)
+	}
+	if !strings.Contains(strings.Join(Caps.Options, " "), "resume") {
+		t.Fatalf("resume option not listed with -resume-ttl: %v", Caps.Options)
+	}
+}
+
+func TestReadDalliesAfterFinalACK(t *testing.T) {
+
+	Addr := StartTestServer(t, &Server{})
+	Data := bytes.Repeat([]byte("d"), 700)
+	PutFile("dally", Data)
+	Client := NewTestClient(t, Addr)
+	Client.Request(RRQ, "dally")
+	Client.Expect(DATA, 1)
+	Client.Send(MakeACKPacket(1))
+	Final := Client.Expect(DATA, 2)
+	Client.Send(MakeACKPacket(2))
+	Client.Send(MakeACKPacket(1)) //ACK(1) retransmitted by client which did not get final block
+	if Pkt := Client.Expect(DATA, 2); !bytes.Equal(Pkt, Final) {
+		t.Fatalf("resent final block % x", Pkt[:4])
+	}
+	Client.Send(MakeACKPacket(2)) //other packets are not answered
+	if Pkt, ok := Client.Recv(200 * time.Millisecond); ok {
+		t.Fatalf("got % x after final ACK", Pkt[:4])
+	}
+}
+
+func TestDallyingReadDoesNotHoldWorker(t *testing.T) {
+
+	SetFlag(t, Workers, 1)
+	Addr := StartTestServer(t, &Server{})
+	PutFile("first", bytes.Repeat([]byte("f"), 700))
+	PutFile("second", []byte("second"))
+	First := NewTestClient(t, Addr)
+	First.Request(RRQ, "first")
+	First.Expect(DATA, 1)
+	First.Send(MakeACKPacket(1))
+	Final := First.Expect(DATA, 2)
+	First.Send(MakeACKPacket(2))
+	Start := time.Now()
+	if Data, _, err := NewTestClient(t, Addr).Get("second"); err != nil || string(Data) != "second" {
+		t.Fatalf("read while first one dallies: %q %v", Data, err)
+	}
+	if Elapsed := time.Since(Start); Elapsed > time.Second {
+		t.Fatalf("second read waited %v for worker", Elapsed)
+	}
+	First.Send(MakeACKPacket(1)) //first read is still dallying
+	if Pkt := First.Expect(DATA, 2); !bytes.Equal(Pkt, Final) {
+		t.Fatalf("resent final block % x", Pkt[:4])
+	}
+}
+
+func TestWriteOfVirtualFileName(t *testing.T) {
+
+	for _, Policy := range []string{"reject", "shadow"} {
+		t.Run(Policy, func(t *testing.T) {
+			SetFlag(t, VirtualWrites, Policy)
+			Srv := &Server{}
+			Srv.RegisterVirtualFile("motd", func(Client net.Addr) ([]byte, error) { return []byte("computed"), nil })
+			Addr := StartTestServer(t, Srv)
+			_, err := NewTestClient(t, Addr).Put("motd", []byte("uploaded"))
+			Want := "uploaded"
+			if Policy == "reject" {
+				if Reply, ok := err.(*ErrorReply); !ok || Reply.Code != ACCESSVIOLATION {
+					t.Fatalf("upload got %v, want access violation", err)
+				}
+				Want = "computed"
+			} else {
+				if err != nil {
+					t.Fatal(err)
+				}
+				WaitStored(t, "motd")
+			}
+			if Data, _, err := NewTestClient(t, Addr).Get("motd"); err != nil || string(Data) != Want {
+				t.Fatalf("read got %q, %v, want %q", Data, err, Want)
+			}
+		})
+	}
+}
+
+func TestLogNegotiationDumpsFields(t *testing.T) {
+
+	SetFlag(t, MaxUnfragmentedBlksize, 1400)
+	SetFlag(t, RateLimitBps, 5000)
+	Req := &RequestData{OPcode: RRQ, FileName: "boot.img", Mode: "octet", ClientAddr: &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1},
+		Options: map[string]string{"blksize": "8192", "windowsize": "4", "ratelimit": "90000", "foo": "bar", "tsize": "0"}}
+	Negotiated, _ := Negotiate(Req, FlagNegotiationConfig())
+	Log := CaptureOutput(t, func() { LogNegotiation(Req, Negotiated) })
+	for _, Want := range []string{
+		"Negotiation for :[ boot.img ] client :[ 127.0.0.1:1 ] mode :[ octet ]",
+		`option blksize : requested "8192" accepted "1400" : lowered to -max-unfragmented-blksize`,
+		`option windowsize : requested "4" accepted "4" : accepted`,
+		`option ratelimit : requested "90000" accepted "5000" : lowered to -rate-limit-bps`,
+		`option foo : requested "bar" accepted "" : ignored (not supported)`,
+		"effective blksize : 1400 timeout : 2s windowsize : 4 ratelimit : 5000",
+	} {
+		if !strings.Contains(Log, Want) {
+			t.Errorf("log lacks %q", Want)
+		}
+	}
+	if t.Failed() {
+		t.Log(Log)
+	}
+}
+
+func TestMaxFilesLimitsDistinctNames(t *testing.T) {
+
+	SetFlag(t, MaxFiles, 3)
+	Addr := StartTestServer(t, &Server{})
+	for i := 0; i < 3; i++ {
+		Name := "tiny" + strconv.Itoa(i)
+		if _, err := NewTestClient(t, Addr).Put(Name, []byte("x")); err != nil {
+			t.Fatalf("%s: %v", Name, err)
+		}
+		WaitStored(t, Name)
+	}
+	_, err := NewTestClient(t, Addr).Put("tiny3", []byte("x"))
+	if Reply, ok := err.(*ErrorReply); !ok || Reply.Code != DISKFULL || Reply.Message != MAXFILESMSG {
+		t.Fatalf("upload over limit got %v", err)
+	}
+	Mtime := strconv.FormatInt(time.Now().Add(time.Hour).Unix(), 10) //newer file may overwrite
+	if _, err := NewTestClient(t, Addr).Put("tiny0", []byte("new"), "mtime", Mtime); err != nil {
+		t.Fatalf("overwrite at limit: %v", err)
+	}
+	for Start := time.Now(); time.Since(Start) < 3*time.Second; time.Sleep(time.Millisecond) {
+		if Data, _ := StoredData("tiny0"); string(Data) == "new" {
+			return
+		}
+	}
+	t.Fatal("overwrite not stored")
+}
+
+// ReadDiscard reads file without keeping its data so only server allocations are left to measure
+func (Client *TestClient) ReadDiscard(Name string, BlockSize int) (int, error) {
+
+	Client.T.Helper()
+	Client.Request(RRQ, Name, "blksize", strconv.Itoa(BlockSize))
+	Buf, ACKPkt := make([]byte, BlockSize+4), make([]byte, 4)
+	binary.BigEndian.PutUint16(ACKPkt, ACK)
+	Received := 0
+	for {
+		Client.Conn.SetReadDeadline(time.Now().Add(3 * time.Second))
+		n, From, err := Client.Conn.ReadFromUDP(Buf)
+		if err != nil {
+			return Received, err
+		}
+		switch binary.BigEndian.Uint16(Buf) {
+		case OACK:
+			binary.BigEndian.PutUint16(ACKPkt[2:], 0)
+		case DATA:
+			copy(ACKPkt[2:], Buf[2:4])
+			Received = Received + n - 4
+		default:
+			return Received, ReplyError(Buf[:n])
+		}
+		Client.Conn.WriteToUDP(ACKPkt, From)
+		if binary.BigEndian.Uint16(Buf) == DATA && n-4 < BlockSize {
+			return Received, nil
+		}
+	}
+}
+
+func BenchmarkConcurrentReadersOfOneFile(b *testing.B) {
+
+	Addr := StartTestServer(b, &Server{})
+	Data := bytes.Repeat([]byte("0123456789abcdef"), 1<<16) //1 MiB shared by all readers
+	PutFile("popular", Data)
+	Parent := b //client sockets are kept till end so ports of dallying reads are not reused
+	for _, Readers := range []int{1, 8, 32} {
+		b.Run("readers="+strconv.Itoa(Readers), func(b *testing.B) {
+			b.SetBytes(int64(len(Data) * Readers))
+			var Before, After runtime.MemStats
+			runtime.ReadMemStats(&Before)
+			for b.Loop() {
+				var Wait sync.WaitGroup
+				Failed := make(chan error, Readers)
+				for i := 0; i < Readers; i++ {
+					Client := NewTestClient(Parent, Addr) //new port as previous read of same client may still be dallying
+					Wait.Add(1)
+					go func() {
+						defer Wait.Done()
+						if n, err := Client.ReadDiscard("popular", 1428); err != nil || n != len(Data) {
+							Failed <- fmt.Errorf("got %d bytes, %v", n, err)
+						}
+					}()
+				}
+				Wait.Wait()
+				close(Failed)
+				if err := <-Failed; err != nil {
+					b.Fatal(err)
+				}
+			}
+			runtime.ReadMemStats(&After)
+			//stored blocks are shared so each reader allocates far less than file size
+			b.ReportMetric(float64(After.TotalAlloc-Before.TotalAlloc)/float64(b.N*Readers), "B/reader")
+		})
+	}
+}
+
+func TestInterPacketDelaySpacesData(t *testing.T) {
+
+	SetFlag(t, InterPacketDelay, 50*time.Millisecond)
+	Addr := StartTestServer(t, &Server{})
+	PutFile("spaced", bytes.Repeat([]byte("s"), 4000)) //8 blocks, 2 windows
+	Client := NewTestClient(t, Addr)
+	Client.Request(RRQ, "spaced", "windowsize", "4")
+	if Options := ParseOACK(Client.Expect(OACK, 0)); Options["windowsize"] != "4" {
+		t.Fatalf("OACK %v", Options)
+	}
+	Client.Send(MakeACKPacket(0))
+	for Window := uint16(0); Window < 2; Window++ {
+		var Previous time.Time
+		for Block := Window*4 + 1; Block <= Window*4+4; Block++ { //window is sent without waiting for ACK
+			Client.Expect(DATA, Block)
+			Now := time.Now()
+			if Gap := Now.Sub(Previous); Block > Window*4+1 && Gap < 45*time.Millisecond {
+				t.Fatalf("DATA(%d) %v after previous one in window", Block, Gap)
+			}
+			Previous = Now
+		}
+		if Pkt, ok := Client.Recv(150 * time.Millisecond); ok {
+			t.Fatalf("DATA beyond window sent before ACK: % x", Pkt[:4])
+		}
+		Client.Send(MakeACKPacket(Window*4 + 4))
+	}
+}
+
+func TestInterPacketDelayEndsOnCancel(t *testing.T) {
+
+	SetFlag(t, InterPacketDelay, time.Hour)
+	Srv := &Server{}
+	Addr := StartTestServer(t, Srv)
+	PutFile("stuck", bytes.Repeat([]byte("s"), 2000))
+	Client := NewTestClient(t, Addr)
+	Client.Request(RRQ, "stuck", "windowsize", "4")
+	Client.Expect(OACK, 0)
+	Client.Send(MakeACKPacket(0))
+	Client.Expect(DATA, 1) //next block waits for gap
+	Start := time.Now()
+	Srv.CancelTransfer(WaitTransfers(t, Srv, 1)[0].ID)
+	if err := ReplyError(Client.Expect(ERROR, UNKNOWNERROR)); err.(*ErrorReply).Message != CANCELLEDMSG {
+		t.Fatalf("got %v", err)
+	}
+	if Elapsed := time.Since(Start); Elapsed > time.Second {
+		t.Fatalf("cancel took %v", Elapsed)
+	}
+	WaitTransfers(t, Srv, 0)
+}
+
+func TestWindowedRead(t *testing.T) {
+
+	Addr := StartTestServer(t, &Server{})
+	Data := make([]byte, 20*512+100)
+	rand.New(rand.NewSource(171)).Read(Data)
+	PutFile("windowed", Data)
+	if Got, Options, err := NewTestClient(t, Addr).Get("windowed", "windowsize", "8"); err != nil || Options["windowsize"] != "8" || !bytes.Equal(Got, Data) {
+		t.Fatalf("windowed read: %d bytes, options %v, %v", len(Got), Options, err)
+	}
+
+	//ACK in middle of window means rest of window is lost so window is sent again from there
+	Client := NewTestClient(t, Addr)
+	Client.Request(RRQ, "windowed", "windowsize", "4")
+	Client.Expect(OACK, 0)
+	Client.Send(MakeACKPacket(0))
+	for Block := uint16(1); Block <= 4; Block++ {
+		Client.Expect(DATA, Block)
+	}
+	Client.Send(MakeACKPacket(2))
+	for Block := uint16(3); Block <= 6; Block++ {
+		Client.Expect(DATA, Block)
+	}
+	Client.Send(MakeACKPacket(2)) //duplicate ACK is ignored
+	if Pkt, ok := Client.Recv(100 * time.Millisecond); ok {
+		t.Fatalf("duplicate ACK answered with % x", Pkt[:4])
+	}
+	Client.Send(MakeACKPacket(7)) //not sent yet
+	Client.Expect(ERROR, ILLEGALOP)
+}
+
+func TestStorageErrorsMappedToTFTPCodes(t *testing.T) {
+
+	Cases := []struct {
+		Name string
+		Err  error
+		Code uint16
+	}{
+		{"full", &fs.PathError{Op: "read", Path: "/store/full", Err: syscall.ENOSPC}, DISKFULL},
+		{"denied", &fs.PathError{Op: "open", Path: "/store/denied", Err: syscall.EACCES}, ACCESSVIOLATION},
+		{"missing", &fs.PathError{Op: "open", Path: "/store/missing", Err: syscall.ENOENT}, FILENOTFOUND},
+		{"broken", &fs.PathError{Op: "read", Path: "/store/broken", Err: syscall.EIO}, UNKNOWNERROR},
+	}
+	Srv := &Server{}
+	for _, Case := range Cases { //virtual files stand in for store failing with each error
+		Srv.RegisterVirtualFile(Case.Name, func(Client net.Addr) ([]byte, error) { return nil, Case.Err })
+	}
+	Addr := StartTestServer(t, Srv)
+	for _, Case := range Cases {
+		_, _, err := NewTestClient(t, Addr).Get(Case.Name)
+		if Reply, ok := err.(*ErrorReply); !ok || Reply.Code != Case.Code || Reply.Message != Case.Err.Error() {
+			t.Errorf("%s: got %v, want error %d: %v", Case.Name, err, Case.Code, Case.Err)
+		}
+	}
+}
+
+func TestMaxReadsRejectsThirdRead(t *testing.T) {
+
+	Srv := &Server{}
+	Addr := StartTestServer(t, Srv)
+	if _, err := NewTestClient(t, Addr).Put("twice", []byte("limited"), "maxreads", "2"); err != nil {
+		t.Fatal(err)
+	}
+	WaitStored(t, "twice")
+	for i := 0; i < 2; i++ {
+		if Data, _, err := NewTestClient(t, Addr).Get("twice"); err != nil || string(Data) != "limited" {
+			t.Fatalf("read %d got %q, %v", i+1, Data, err)
+		}
+	}
+	_, _, err := NewTestClient(t, Addr).Get("twice")
+	if Reply, ok := err.(*ErrorReply); !ok || Reply.Code != FILENOTFOUND || Reply.Message != READQUOTAMSG {
+		t.Fatalf("third read got %v", err)
+	}
+	if Files := Srv.ListFiles(); len(Files) != 1 || Files[0].MaxReads != 2 {
+		t.Fatalf("listing %+v", Files)
+	}
+}
+
+func TestUploadMustMatchTsize(t *testing.T) {
+
+	Srv := &Server{}
+	Addr := StartTestServer(t, Srv)
+	Data := bytes.Repeat([]byte("z"), 1000)
+	t.Run("match", func(t *testing.T) {
+		if _, err := NewTestClient(t, Addr).Put("exact", Data, "tsize", "1000"); err != nil {
+			t.Fatal(err)
+		}
+		if Stored := WaitStored(t, "exact"); !bytes.Equal(Stored, Data) {
+			t.Fatalf("stored %d bytes", len(Stored))
+		}
+	})
+	t.Run("short", func(t *testing.T) {
+		Client := NewTestClient(t, Addr)
+		Client.Request(WRQ, "short", "tsize", "1000")
+		Client.Expect(OACK, 0)
+		Client.Send(DataPacket(1, Data[:512]))
+		Client.Expect(ACK, 1)
+		Client.Send(DataPacket(2, Data[:100])) //ignored once as possibly truncated
+		Client.Send(DataPacket(2, Data[:100]))
+		if Reply := ReplyError(Client.Expect(ERROR, ILLEGALOP)); Reply.(*ErrorReply).Message != TSIZEUNDERMSG {
+			t.Fatalf("got %v", Reply)
+		}
+	})
+	t.Run("long", func(t *testing.T) {
+		_, err := NewTestClient(t, Addr).Put("long", Data, "tsize", "600")
+		if Reply, ok := err.(*ErrorReply); !ok || Reply.Code != ILLEGALOP || Reply.Message != TSIZEOVERMSG {
+			t.Fatalf("got %v", err)
+		}
+	})
+	WaitTransfers(t, Srv, 0)
+	for _, Name := range []string{"short", "long"} {
+		if _, ok := StoredData(Name); ok {
+			t.Errorf("upload %s not matching tsize stored", Name)
+		}
+	}
+}
+
+func TestSinglePortConcurrentTransfers(t *testing.T) {
+
+	SetFlag(t, SinglePort, true)
+	Addr := StartTestServer(t, &Server{})
+	const Clients = 8
+	Data := make([][]byte, Clients)
+	for i := range Data {
+		Data[i] = bytes.Repeat([]byte{byte('a' + i)}, 3000+i*700)
+		if i%2 == 0 { //even clients read, odd ones upload
+			PutFile("file"+strconv.Itoa(i), Data[i])
+		}
+	}
+	var Wait sync.WaitGroup
+	Failed := make(chan error, Clients)
+	for i := 0; i < Clients; i++ {
+		Client := NewTestClient(t, Addr)
+		Wait.Add(1)
+		go func() {
+			defer Wait.Done()
+			Name := "file" + strconv.Itoa(i)
+			var err error
+			if i%2 == 0 {
+				var Got []byte
+				if Got, _, err = Client.Get(Name, "blksize", "1024"); err == nil && !bytes.Equal(Got, Data[i]) {
+					err = fmt.Errorf("got %d bytes", len(Got))
+				}
+			} else {
+				_, err = Client.Put(Name, Data[i])
+			}
+			if err == nil && Client.Server.Port != Addr.Port {
+				err = fmt.Errorf("transfer from port %d", Client.Server.Port)
+			}
+			if err != nil {
+				Failed <- fmt.Errorf("%s: %v", Name, err)
+			}
+		}()
+	}
+	Wait.Wait()
+	close(Failed)
+	for err := range Failed {
+		t.Error(err)
+	}
+	for i := 1; i < Clients; i = i + 2 {
+		if Stored := WaitStored(t, "file"+strconv.Itoa(i)); !bytes.Equal(Stored, Data[i]) {
+			t.Errorf("file%d stored %d bytes", i, len(Stored))
+		}
+	}
+	Stray := NewTestClient(t, Addr) //ACK of client without transfer
+	Stray.Send(MakeACKPacket(1))
+	Stray.Expect(ERROR, UNKNOWNID)
+}
+
+func TestMinFileAgeHidesNewFile(t *testing.T) {
+
+	SetFlag(t, MinFileAge, 30*time.Second)
+	Clock := NewFakeClock()
+	Addr := StartTestServer(t, &Server{Clock: Clock})
+	PutFile("preloaded", []byte("served at once")) //only uploads wait for -min-file-age
+	if Data, _, err := NewTestClient(t, Addr).Get("preloaded"); err != nil || string(Data) != "served at once" {
+		t.Fatalf("read of preloaded file got %q, %v", Data, err)
+	}
+	if _, err := NewTestClient(t, Addr).Put("fresh", []byte("settling")); err != nil {
+		t.Fatal(err)
+	}
+	WaitStored(t, "fresh")
+	Clock.Advance(29 * time.Second)
+	_, _, err := NewTestClient(t, Addr).Get("fresh")
+	if Reply, ok := err.(*ErrorReply); !ok || Reply.Code != FILENOTFOUND {
+		t.Fatalf("read of just uploaded file got %v", err)
+	}
+	Clock.Advance(time.Second)
+	if Data, _, err := NewTestClient(t, Addr).Get("fresh"); err != nil || string(Data) != "settling" {
+		t.Fatalf("read after -min-file-age got %q, %v", Data, err)
+	}
+}
+
+func TestWindowedUploadCoalescesACKs(t *testing.T) {
+
+	Addr := StartTestServer(t, &Server{})
+	Data := make([]byte, 100*512+100) //101 blocks
+	rand.New(rand.NewSource(178)).Read(Data)
+	Blocks := (len(Data) + 512) / 512
+	Client := NewTestClient(t, Addr)
+	Client.Request(WRQ, "windowed", "windowsize", "8")
+	if Options := ParseOACK(Client.Expect(OACK, 0)); Options["windowsize"] != "8" {
+		t.Fatalf("OACK %v", Options)
+	}
+	ACKs, Next, Dropped, Rewound := 0, 1, false, false
+	for Next <= Blocks {
+		for Block := Next; Block < Next+8 && Block <= Blocks; Block++ {
+			if Block == 20 && !Dropped { //lost in middle of window
+				Dropped = true
+				continue
+			}
+			Client.Send(DataPacket(uint16(Block), Data[(Block-1)*512:min(Block*512, len(Data))]))
+		}
+		Pkt, ok := Client.Recv(3 * time.Second)
+		if !ok || binary.BigEndian.Uint16(Pkt) != ACK {
+			t.Fatalf("no ACK for window from block %d", Next)
+		}
+		ACKs = ACKs + 1
+		Acked := int(binary.BigEndian.Uint16(Pkt[2:]))
+		Rewound = Rewound || Acked == 19
+		Next = Acked + 1 //window restarts after last block received in order
+	}
+	if Stored := WaitStored(t, "windowed"); !bytes.Equal(Stored, Data) {
+		t.Fatalf("stored %d bytes, want %d", len(Stored), len(Data))
+	}
+	if !Rewound {
+		t.Fatal("block before lost one not acknowledged")
+	}
+	if ACKs > 15 { //13 windows and one rewind after lost block, instead of 101 ACKs
+		t.Fatalf("%d ACKs for %d blocks with windowsize 8", ACKs, Blocks)
+	}
+}
+
+func TestFilenamePatternAllowlist(t *testing.T) {
+
+	SetFlag(t, &FilenameRegexp, regexp.MustCompile(`^[a-z0-9._-]+$`))
+	Addr := StartTestServer(t, &Server{})
+	PutFile("pxelinux.0", []byte("boot"))
+	PutFile("Secret.TXT", []byte("hidden"))
+	if Data, _, err := NewTestClient(t, Addr).Get("pxelinux.0"); err != nil || string(Data) != "boot" {
+		t.Fatalf("matching name got %q, %v", Data, err)
+	}
+	_, _, ReadErr := NewTestClient(t, Addr).Get("Secret.TXT")
+	_, WriteErr := NewTestClient(t, Addr).Put("../etc/passwd", []byte("x"))
+	for _, err := range []error{ReadErr, WriteErr} {
+		if Reply, ok := err.(*ErrorReply); !ok || Reply.Code != ACCESSVIOLATION || Reply.Message != FILENAMEMSG {
+			t.Fatalf("not matching name got %v", err)
+		}
+	}
+}
+
+func TestTimeToFirstByteReported(t *testing.T) {
+
+	Summaries := make(chan TransferSummary, 1)
+	Addr := StartTestServer(t, &Server{OnReadComplete: func(Summary TransferSummary) { Summaries <- Summary }})
+	PutFile("ttfb", []byte("first byte"))
+	Count := Stats.FirstByteCount.Load()
+	Client := NewTestClient(t, Addr)
+	Start := time.Now()
+	Client.Request(RRQ, "ttfb")
+	Client.Expect(DATA, 1)
+	Seen := time.Since(Start) //first byte as seen by client, network delay included
+	Client.Send(MakeACKPacket(1))
+	select {
+	case Summary := <-Summaries:
+		if Summary.FirstByte <= 0 || Summary.FirstByte > Seen {
+			t.Fatalf("first byte %v, client got it after %v", Summary.FirstByte, Seen)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatal("read not completed")
+	}
+	if Stats.FirstByteCount.Load() <= Count || Stats.FirstByteNanos.Load() <= 0 {
+		t.Fatal("first byte not added to statistics")
+	}
+}
+
+func TestKeepAliveWhileFileProduced(t *testing.T) {
+
+	SetFlag(t, KeepAliveInterval, 100*time.Millisecond)
+	Release := make(chan struct{})
+	Srv := &Server{}
+	Srv.RegisterVirtualFile("slow", func(Client net.Addr) ([]byte, error) { //store warming up
+		<-Release
+		return []byte("finally"), nil
+	})
+	Addr := StartTestServer(t, Srv)
+	Client := NewTestClient(t, Addr)
+	Client.Request(RRQ, "slow", "blksize", "512")
+	Released := time.After(time.Second)
+	for {
+		Pkt, ok := Client.Recv(300 * time.Millisecond) //client with short timeout keeps waiting only if server talks
+		if !ok {
+			t.Fatal("client timed out before first byte")
+		}
+		switch binary.BigEndian.Uint16(Pkt) {
+		case OACK:
+			Client.Send(MakeACKPacket(0))
+		case DATA:
+			if string(Pkt[4:]) != "finally" {
+				t.Fatalf("got %q", Pkt[4:])
+			}
+			Client.Send(MakeACKPacket(1))
+			return
+		default:
+			t.Fatalf("got % x", Pkt)
+		}
+		select {
+		case <-Released:
+			close(Release)
+		default:
+		}
+	}
+}
+
+func TestParseErrorFields(t *testing.T) {
+
+	SetFlag(t, MaxOptions, 1)
+	Cases := []struct {
+		Pkt    string
+		Offset int
+		Reason string
+	}{
+		{"\x00", 1, "Packet too short"},
+		{"\x00\x09file\x00octet\x00", 0, "Illegal opcode"},
+		{"\x00\x01file", 6, "Malformed request"},           //name not terminated
+		{"\x00\x01file\x00", 7, "Malformed request"},       //no mode
+		{"\x00\x01file\x00octet", 11, "Malformed request"}, //mode not terminated
+		{"\x00\x01f\x00octet\x00a\x001\x00b\x002\x00", 10, "Too many options"},
+	}
+	for _, Case := range Cases {
+		err := ParseRequest([]byte(Case.Pkt), uint16(len(Case.Pkt)), &RequestData{})
+		var ParseErr *ParseError
+		if !errors.As(err, &ParseErr) {
+			t.Errorf("%q: got %v, want *ParseError", Case.Pkt, err)
+			continue
+		}
+		if ParseErr.Offset != Case.Offset || ParseErr.Reason != Case.Reason || ParseErr.Raw != hex.EncodeToString([]byte(Case.Pkt)) {
+			t.Errorf("%q: got %+v, want offset %d reason %q", Case.Pkt, ParseErr, Case.Offset, Case.Reason)
+		}
+	}
+}
+
+func TestMirrorReceivesUpload(t *testing.T) {
+
+	Data := bytes.Repeat([]byte("mirror"), 300)
+	t.Run("callback", func(t *testing.T) {
+		Mirrored := make(chan string, 1)
+		Srv := &Server{Mirror: MirrorFunc(func(Name string, Data []byte) error {
+			Mirrored <- Name + ":" + string(Data)
+			return errors.New("backup offline") //only logged
+		})}
+		Addr := StartTestServer(t, Srv)
+		if _, err := NewTestClient(t, Addr).Put("backup", Data); err != nil {
+			t.Fatal(err)
+		}
+		select {
+		case Got := <-Mirrored:
+			if Got != "backup:"+string(Data) {
+				t.Fatalf("mirrored %d bytes", len(Got))
+			}
+		case <-time.After(3 * time.Second):
+			t.Fatal("upload not mirrored")
+		}
+		if Stored := WaitStored(t, "backup"); !bytes.Equal(Stored, Data) { //failed mirror does not affect upload
+			t.Fatalf("stored %d bytes", len(Stored))
+		}
+	})
+	t.Run("directory", func(t *testing.T) {
+		Dir := t.TempDir()
+		Srv := &Server{Mirror: DirMirror{Dir: Dir}}
+		Addr := StartTestServer(t, Srv)
+		if _, err := NewTestClient(t, Addr).Put("sub/backup", Data); err != nil {
+			t.Fatal(err)
+		}
+		WaitTransfers(t, Srv, 0) //mirror copy is started before upload transfer ends
+		Srv.Mirrors.Wait()
+		if Got, err := os.ReadFile(filepath.Join(Dir, "sub", "backup")); err != nil || !bytes.Equal(Got, Data) {
+			t.Fatalf("mirror file has %d bytes, %v", len(Got), err)
+		}
+	})
+}
+
+func TestDeadlineOptionAbortsSlowTransfer(t *testing.T) {
+
+	Addr := StartTestServer(t, &Server{})
+	PutFile("slow", bytes.Repeat([]byte("s"), 512*20))
+	Client := NewTestClient(t, Addr)
+	Start := time.Now()
+	Client.Request(RRQ, "slow", "deadline", "1")
+	if Options := ParseOACK(Client.Expect(OACK, 0)); Options["deadline"] != "1" {
+		t.Fatalf("OACK %v", Options)
+	}
+	Client.Send(MakeACKPacket(0))
+	for Block := uint16(1); ; Block++ {
+		Pkt, ok := Client.Recv(3 * time.Second)
+		if !ok {
+			t.Fatal("transfer neither continued nor aborted")
+		}
+		if binary.BigEndian.Uint16(Pkt) == ERROR {
+			if Reply := ReplyError(Pkt).(*ErrorReply); Reply.Message != DEADLINEMSG {
+				t.Fatalf("got %v", Reply)
+			}
+			break
+		}
+		time.Sleep(300 * time.Millisecond) //each ACK is within packet timeout but transfer is too slow
+		Client.Send(MakeACKPacket(Block))
+	}
+	if Elapsed := time.Since(Start); Elapsed < time.Second || Elapsed > 1800*time.Millisecond {
+		t.Fatalf("aborted after %v, deadline is 1s", Elapsed)
+	}
+}
+
+func TestSlowLogThresholdLogsOnlySlowTransfer(t *testing.T) {
+
+	SetFlag(t, SlowLogThreshold, time.Second)
+	Fast := &TransferStatus{Info: TransferInfo{FileName: "fast", Direction: "read", Client: "127.0.0.1:1", StartedAt: time.Now()}}
+	Slow := &TransferStatus{Info: TransferInfo{FileName: "slow", Direction: "write", Client: "127.0.0.1:2", StartedAt: time.Now().Add(-3 * time.Second)}}
+	Slow.Block.Store(42)
+	Slow.Bytes.Store(42 * 512)
+	Log := CaptureOutput(t, func() {
+		LogTransfer("\n==== Read Started for :[", "fast", "]")
+		LogCompleted(Fast, "\n==== Read Completed for :[", "fast", "]")
+		LogCompleted(Slow, "\n==== Write Completed for :[", "slow", "]")
+	})
+	if strings.Contains(Log, "fast") || strings.Contains(Log, "Completed") {
+		t.Fatalf("fast transfer logged:\n%s", Log)
+	}
+	Warning := regexp.MustCompile(`Warning: slow write transfer of :\[ slow \] client :\[ 127\.0\.0\.1:2 \] duration : 3(\.\d+)?s blocks : 42 bytes : 21504`)
+	if !Warning.MatchString(Log) {
+		t.Fatalf("no warning for slow transfer:\n%s", Log)
+	}
+}
+
+func TestJunkDatagramsQuarantined(t *testing.T) {
+
+	SetFlag(t, UnknownMode, "reject")
+	Srv := &Server{}
+	Addr := StartTestServer(t, Srv)
+	Client := NewTestClient(t, Addr)
+	Before, Active := Stats.Quarantined.Load(), Stats.ActiveTransfers.Load()
+	for _, Junk := range []string{"\x00", "\x00\x09GET / HTTP/1.1\r\n", "\x00\x01no terminator", "\xff\xff\xff\xff"} {
+		Client.Send([]byte(Junk))
+		Client.Expect(ERROR, ILLEGALOP)
+	}
+	if Count := Stats.Quarantined.Load() - Before; Count != 4 {
+		t.Fatalf("%d packets quarantined, want 4", Count)
+	}
+	Client.Send(append([]byte{0, byte(RRQ)}, "file\x00bogus\x00"...)) //valid packet rejected by policy is not junk
+	Client.Expect(ERROR, ILLEGALOP)
+	if Count := Stats.Quarantined.Load() - Before; Count != 4 {
+		t.Fatalf("rejected request quarantined, count %d", Count)
+	}
+	if Stats.ActiveTransfers.Load() != Active || len(Srv.ActiveTransfers()) != 0 {
+		t.Fatal("junk started transfer")
+	}
+}
+
+func TestUpstreamFetchRetriedAfterFailedAttempt(t *testing.T) {
+
+	if testing.Short() {
+		t.Skip("first attempt fails only after all its timeouts")
+	}
+	Conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { Conn.Close() })
+	Lossy := &LossyConn{PacketConn: Conn, DropFirst: 4} //replies to request and its 3 retransmits are lost
+	go func() {                                         //upstream answering every request with one block file
+		Buf := make([]byte, 1024)
+		for {
+			n, Client, err := Lossy.ReadFrom(Buf)
+			if err != nil {
+				return
+			}
+			if n > 2 && binary.BigEndian.Uint16(Buf) == RRQ {
+				Lossy.WriteTo(DataPacket(1, []byte("second time lucky")), Client)
+			}
+		}
+	}()
+	SetFlag(t, Upstream, Conn.LocalAddr().String())
+	SetFlag(t, UpstreamBlksize, int(FILEBLOCKSIZE)) //plain request without options
+	SetFlag(t, UpstreamRetries, 1)
+	ResetStore(t)
+	Fetch := (&Server{}).FetchUpstream("flaky")
+	if err := Fetch.WaitDone(); err != nil {
+		t.Fatalf("fetch failed after retry: %v", err)
+	}
+	if Data, _ := StoredData("flaky"); string(Data) != "second time lucky" {
+		t.Fatalf("stored %q", Data)
+	}
+	if Lost := Lossy.LostPackets(); len(Lost) != 4 {
+		t.Fatalf("%d packets lost, first attempt should lose 4", len(Lost))
+	}
+}
+
+func TestStoreAsFS(t *testing.T) {
+
+	Srv := &Server{}
+	Addr := StartTestServer(t, Srv)
+	Uploads := map[string]string{"boot.cfg": "timeout 5", "images/kernel": "vmlinuz", "images/initrd": "initramfs"}
+	for Name, Data := range Uploads {
+		if _, err := NewTestClient(t, Addr).Put(Name, []byte(Data)); err != nil {
+			t.Fatal(err)
+		}
+		WaitStored(t, Name)
+	}
+	if _, err := NewTestClient(t, Addr).Put("secret", []byte("x"), "pw", "pass"); err != nil {
+		t.Fatal(err)
+	}
+	WaitStored(t, "secret")
+	FS := Srv.FS()
+	for Name, Want := range Uploads {
+		if Data, err := fs.ReadFile(FS, Name); err != nil || string(Data) != Want {
+			t.Errorf("ReadFile(%s) got %q, %v", Name, Data, err)
+		}
+	}
+	Names := func(Dir string) string {
+		Entries, err := fs.ReadDir(FS, Dir)
+		if err != nil {
+			t.Fatalf("ReadDir(%s): %v", Dir, err)
+		}
+		var List []string
+		for _, Entry := range Entries {
+			List = append(List, Entry.Name()+map[bool]string{true: "/"}[Entry.IsDir()])
+		}
+		return strings.Join(List, " ")
+	}
+	if Root := Names("."); Root != "boot.cfg images/" { //protected file is not visible
+		t.Errorf("root lists %q", Root)
+	}
+	if Images := Names("images"); Images != "initrd kernel" {
+		t.Errorf("images lists %q", Images)
+	}
+	if _, err := fs.ReadFile(FS, "secret"); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("protected file read: %v", err)
+	}
+	if err := fstest.TestFS(FS, "boot.cfg", "images/kernel", "images/initrd"); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestPaddedAndTruncatedACK(t *testing.T) {
+
+	Clock := NewFakeClock()
+	Addr := StartTestServer(t, &Server{Clock: Clock})
+	PutFile("padded", bytes.Repeat([]byte("p"), 1200))
+	Client := NewTestClient(t, Addr)
+	Client.Request(RRQ, "padded")
+	Client.Expect(DATA, 1)
+	Client.Send(append(MakeACKPacket(1), 0, 0, 0, 0, 0, 0)) //padding is ignored
+	Client.Expect(DATA, 2)
+	Client.Send(MakeACKPacket(2)[:3]) //truncated ACK is not taken as ACK(2)
+	if Pkt, ok := Client.Recv(200 * time.Millisecond); ok {
+		t.Fatalf("truncated ACK answered with % x", Pkt[:4])
+	}
+	Clock.WaitTimer(t)
+	Clock.Advance(TIMEOUT * time.Second)
+	Client.Expect(DATA, 2) //still waiting for ACK(2)
+	Client.Send(MakeACKPacket(2))
+	Client.Expect(DATA, 3)
+	Client.Send(MakeACKPacket(3))
+
+	if Block, ok := DecodeACKPacket([]byte{0, 4, 0, 7, 0xff}); !ok || Block != 7 {
+		t.Fatalf("padded ACK decoded as %d, %v", Block, ok)
+	}
+	if _, ok := DecodeACKPacket([]byte{0, 4, 0}); ok {
+		t.Fatal("truncated ACK decoded")
+	}
+}
+
+func TestValidateAddressPorts(t *testing.T) {
+
+	for _, Case := range []struct {
+		Addr string
+		Ok   bool
+	}{
+		{"127.0.0.1:0", true},
+		{"127.0.0.1:1024", true},
+		{"127.0.0.1:65535", true},
+		{"127.0.0.1:65536", false},
+		{"127.0.0.1:1023", false},
+		{"127.0.0.1:tftp", false},
+		{"127.0.0.1:59", false}, //below 1024 like any other privileged port
+	} {
+		err := ValidateAddress(Case.Addr)
+		if (err == nil) != Case.Ok {
+			t.Errorf("%s: got %v", Case.Addr, err)
+		}
+		if err != nil && strings.Contains(err.Error(), "59") {
+			t.Errorf("%s: port 59 still special cased: %v", Case.Addr, err)
+		}
+	}
+
+	//any free port validates and serves
+	Conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	Port := Conn.LocalAddr().(*net.UDPAddr).Port
+	Conn.Close()
+	if err := ValidateAddress(net.JoinHostPort("127.0.0.1", strconv.Itoa(Port))); err != nil {
+		t.Fatal(err)
+	}
+	Addr := StartTestServerOn(t, &Server{}, &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: Port})
+	PutFile("anyport", []byte("served"))
+	if Data, _, err := NewTestClient(t, Addr).Get("anyport"); err != nil || string(Data) != "served" {
+		t.Fatalf("read on port %d: %q %v", Port, Data, err)
+	}
+}
+
+func TestPriorityServedFirstWhenSaturated(t *testing.T) {
+
+	SetFlag(t, Workers, 2)
+	Srv := &Server{Clock: NewFakeClock()} //held transfers wait for ACK until aborted
+	Srv.Priority = func(OPcode uint16, Name string, Client net.Addr) int {
+		if strings.HasSuffix(Name, ".cfg") {
+			return 10
+		}
+		return 0
+	}
+	Addr := StartTestServer(t, Srv)
+	PutFile("image.bin", []byte("large image"))
+	PutFile("boot.cfg", []byte("small config"))
+	var Held []*TestClient
+	for i := 0; i < 2; i++ { //all workers busy
+		Client := NewTestClient(t, Addr)
+		Client.Request(RRQ, "image.bin")
+		Client.Expect(DATA, 1)
+		Held = append(Held, Client)
+	}
+	Low := NewTestClient(t, Addr)
+	Low.Request(RRQ, "image.bin")
+	time.Sleep(100 * time.Millisecond) //queued before high priority request
+	High := NewTestClient(t, Addr)
+	High.Request(RRQ, "boot.cfg")
+	time.Sleep(100 * time.Millisecond)
+
+	Held[0].Send(MakeErrorPacket(UNKNOWNERROR, "abort")) //frees one worker
+	if Pkt := High.Expect(DATA, 1); string(Pkt[4:]) != "small config" {
+		t.Fatalf("high priority read got %q", Pkt[4:])
+	}
+	if Pkt, ok := Low.Recv(200 * time.Millisecond); ok {
+		t.Fatalf("low priority request served before high priority transfer ended: % x", Pkt[:4])
+	}
+	Held[1].Send(MakeErrorPacket(UNKNOWNERROR, "abort"))
+	Low.Expect(DATA, 1)
+
+	//queue alone keeps arrival order within same priority
+	Queue := NewRequestQueue(4)
+	for i, Priority := range []int{0, 5, 0, 5} {
+		Queue.Put(&RequestData{FileName: strconv.Itoa(i)}, Priority, time.Second)
+	}
+	Order := ""
+	for i := 0; i < 4; i++ {
+		Req, _ := Queue.Get()
+		Order = Order + Req.FileName
+	}
+	if Order != "1302" {
+		t.Fatalf("queue order %s, want 1302", Order)
+	}
+}
+
+func TestMaxReadersPerFileRejectsExcess(t *testing.T) {
+
+	SetFlag(t, MaxReadersPerFile, 2)
+	Addr := StartTestServer(t, &Server{Clock: NewFakeClock()}) //held reads wait for ACK until released
+	PutFile("popular", []byte("popular file"))
+	PutFile("other", []byte("other file"))
+	var Held []*TestClient
+	for i := 0; i < 2; i++ {
+		Client := NewTestClient(t, Addr)
+		Client.Request(RRQ, "popular")
+		Client.Expect(DATA, 1)
+		Held = append(Held, Client)
+	}
+	Excess := NewTestClient(t, Addr)
+	Excess.Request(RRQ, "popular")
+	if err := ReplyError(Excess.Expect(ERROR, UNKNOWNERROR)); err.(*ErrorReply).Message != SERVERBUSYMSG {
+		t.Fatalf("excess reader got %v", err)
+	}
+	if Data, _, err := NewTestClient(t, Addr).Get("other"); err != nil || string(Data) != "other file" { //cap is per file
+		t.Fatalf("read of other file: %q %v", Data, err)
+	}
+
+	Held[0].Send(MakeACKPacket(1)) //completed read gives up its place before dallying
+	for Start := time.Now(); ; time.Sleep(time.Millisecond) {
+		FileMapLock.RLock()
+		Readers := FileMap["popular"].Readers
+		FileMapLock.RUnlock()
+		if Readers == 1 {
+			break
+		}
+		if time.Since(Start) > 3*time.Second {
+			t.Fatalf("%d readers after read completed", Readers)
+		}
+	}
+	if Data, _, err := NewTestClient(t, Addr).Get("popular"); err != nil || string(Data) != "popular file" {
+		t.Fatalf("read after release: %q %v", Data, err)
+	}
+}
+
+func TestNegotiate(t *testing.T) {
+
+	Default := NegotiationConfig{MinBlksize: 8, MaxWindowsize: 16}
+	for _, Case := range []struct {
+		Name      string
+		OPcode    uint16
+		Options   map[string]string
+		Config    NegotiationConfig
+		Want      NegotiatedOptions // Accepted compared with OACK, Timeout always TIMEOUT
+		Malformed string
+	}{
+		{"no options", RRQ, nil, Default,
+			NegotiatedOptions{Blksize: 512, Windowsize: 1, Tsize: -1, Accepted: map[string]string{}}, ""},
+		{"blksize", RRQ, map[string]string{"blksize": "1428"}, Default,
+			NegotiatedOptions{Blksize: 1428, Windowsize: 1, Tsize: -1, Accepted: map[string]string{"blksize": "1428"}}, ""},
+		{"blksize above maximum", RRQ, map[string]string{"blksize": "100000"}, Default,
+			NegotiatedOptions{Blksize: MAXBLKSIZE, Windowsize: 1, Tsize: -1, Accepted: map[string]string{"blksize": strconv.Itoa(MAXBLKSIZE)}}, ""},
+		{"blksize above unfragmented", RRQ, map[string]string{"blksize": "8192"}, NegotiationConfig{MinBlksize: 8, MaxUnfragmentedBlksize: 1400},
+			NegotiatedOptions{Blksize: 1400, Windowsize: 1, Tsize: -1, Accepted: map[string]string{"blksize": "1400"}}, ""},
+		{"blksize raised to minimum", WRQ, map[string]string{"blksize": "8"}, NegotiationConfig{MinBlksize: 256},
+			NegotiatedOptions{Blksize: 256, Windowsize: 1, Tsize: -1, Accepted: map[string]string{"blksize": "256"}}, ""},
+		{"blksize below range", RRQ, map[string]string{"blksize": "7"}, Default,
+			NegotiatedOptions{Blksize: 512, Windowsize: 1, Tsize: -1, Accepted: map[string]string{}}, "blksize"},
+		{"blksize not number", RRQ, map[string]string{"blksize": "big"}, Default,
+			NegotiatedOptions{Blksize: 512, Windowsize: 1, Tsize: -1, Accepted: map[string]string{}}, "blksize"},
+		{"windowsize of read", RRQ, map[string]string{"windowsize": "8"}, Default,
+			NegotiatedOptions{Blksize: 512, Windowsize: 8, Tsize: -1, Accepted: map[string]string{"windowsize": "8"}}, ""},
+		{"windowsize of write", WRQ, map[string]string{"windowsize": "8"}, Default,
+			NegotiatedOptions{Blksize: 512, Windowsize: 8, Tsize: -1, Accepted: map[string]string{"windowsize": "8"}}, ""},
+		{"windowsize above maximum", WRQ, map[string]string{"windowsize": "64"}, Default,
+			NegotiatedOptions{Blksize: 512, Windowsize: 16, Tsize: -1, Accepted: map[string]string{"windowsize": "16"}}, ""},
+		{"windowsize zero", WRQ, map[string]string{"windowsize": "0"}, Default,
+			NegotiatedOptions{Blksize: 512, Windowsize: 1, Tsize: -1, Accepted: map[string]string{}}, "windowsize"},
+		{"ratelimit below server limit", RRQ, map[string]string{"ratelimit": "2000"}, NegotiationConfig{RateLimitBps: 5000},
+			NegotiatedOptions{Blksize: 512, Windowsize: 1, Tsize: -1, RateLimit: 2000, Accepted: map[string]string{"ratelimit": "2000"}}, ""},
+		{"ratelimit below minimum", RRQ, map[string]string{"ratelimit": "1"}, Default,
+			NegotiatedOptions{Blksize: 512, Windowsize: 1, Tsize: -1, RateLimit: MINRATELIMIT, Accepted: map[string]string{"ratelimit": strconv.Itoa(MINRATELIMIT)}}, ""},
+		{"ratelimit above server limit", RRQ, map[string]string{"ratelimit": "9000"}, NegotiationConfig{RateLimitBps: 5000},
+			NegotiatedOptions{Blksize: 512, Windowsize: 1, Tsize: -1, RateLimit: 5000, Accepted: map[string]string{"ratelimit": "5000"}}, ""},
+		{"server ratelimit without option", RRQ, nil, NegotiationConfig{RateLimitBps: 5000},
+			NegotiatedOptions{Blksize: 512, Windowsize: 1, Tsize: -1, RateLimit: 5000, Accepted: map[string]string{}}, ""},
+		{"deadline", RRQ, map[string]string{"deadline": "30"}, Default,
+			NegotiatedOptions{Blksize: 512, Windowsize: 1, Tsize: -1, Deadline: 30 * time.Second, Accepted: map[string]string{"deadline": "30"}}, ""},
+		{"deadline negative", RRQ, map[string]string{"deadline": "-1"}, Default,
+			NegotiatedOptions{Blksize: 512, Windowsize: 1, Tsize: -1, Accepted: map[string]string{}}, "deadline"},
+		{"compress of read", RRQ, map[string]string{"compress": "GZIP"}, Default,
+			NegotiatedOptions{Blksize: 512, Windowsize: 1, Tsize: -1, Compress: "gzip", Accepted: map[string]string{"compress": "gzip"}}, ""},
+		{"compress of write ignored", WRQ, map[string]string{"compress": "gzip"}, Default,
+			NegotiatedOptions{Blksize: 512, Windowsize: 1, Tsize: -1, Accepted: map[string]string{}}, ""},
+		{"compress unknown", RRQ, map[string]string{"compress": "zstd"}, Default,
+			NegotiatedOptions{Blksize: 512, Windowsize: 1, Tsize: -1, Accepted: map[string]string{}}, "compress"},
+		{"tsize of write", WRQ, map[string]string{"tsize": "4096"}, Default,
+			NegotiatedOptions{Blksize: 512, Windowsize: 1, Tsize: 4096, Accepted: map[string]string{"tsize": "4096"}}, ""},
+		{"tsize negative", WRQ, map[string]string{"tsize": "-5"}, Default,
+			NegotiatedOptions{Blksize: 512, Windowsize: 1, Tsize: -1, Accepted: map[string]string{}}, "tsize"},
+		{"upload options", WRQ, map[string]string{"pw": "secret", "pinned": "yes", "mtime": "1700000000", "maxreads": "3", "contenttype": "text/plain"}, Default,
+			NegotiatedOptions{Blksize: 512, Windowsize: 1, Tsize: -1,
+				Accepted: map[string]string{"pw": "1", "pinned": "1", "mtime": "1700000000", "maxreads": "3", "contenttype": "text/plain"}}, ""},
+		{"upload options of read ignored", RRQ, map[string]string{"pw": "secret", "mtime": "1700000000", "maxreads": "3"}, Default,
+			NegotiatedOptions{Blksize: 512, Windowsize: 1, Tsize: -1, Accepted: map[string]string{}}, ""},
+		{"maxreads zero", WRQ, map[string]string{"maxreads": "0"}, Default,
+			NegotiatedOptions{Blksize: 512, Windowsize: 1, Tsize: -1, Accepted: map[string]string{}}, "maxreads"},
+		{"mtime not number", WRQ, map[string]string{"mtime": "yesterday"}, Default,
+			NegotiatedOptions{Blksize: 512, Windowsize: 1, Tsize: -1, Accepted: map[string]string{}}, "mtime"},
+		{"unknown option", RRQ, map[string]string{"foo": "bar"}, Default,
+			NegotiatedOptions{Blksize: 512, Windowsize: 1, Tsize: -1, Accepted: map[string]string{}}, ""},
+	} {
+		t.Run(Case.Name, func(t *testing.T) {
+			Req := &RequestData{OPcode: Case.OPcode, FileName: "f", Mode: "octet", Options: Case.Options}
+			if Req.Options == nil {
+				Req.Options = map[string]string{}
+			}
+			Negotiated, OACK := Negotiate(Req, Case.Config)
+			Case.Want.Timeout = TIMEOUT * time.Second
+			Malformed := strings.Join(Negotiated.Malformed, ",")
+			Accepted, Want := Negotiated.Accepted, Case.Want
+			Negotiated.Accepted, Negotiated.Malformed, Want.Accepted = nil, nil, nil //compared separately
+			if !reflect.DeepEqual(Negotiated, Want) {
+				t.Errorf("got %+v, want %+v", Negotiated, Want)
+			}
+			if !reflect.DeepEqual(Accepted, Case.Want.Accepted) {
+				t.Errorf("accepted %v, want %v", Accepted, Case.Want.Accepted)
+			}
+			if Malformed != Case.Malformed {
+				t.Errorf("malformed %q, want %q", Malformed, Case.Malformed)
+			}
+			switch {
+			case len(Case.Want.Accepted) == 0 && OACK != nil:
+				t.Errorf("OACK % x sent without accepted option", OACK)
+			case len(Case.Want.Accepted) > 0 && !reflect.DeepEqual(ParseOACK(OACK), Case.Want.Accepted):
+				t.Errorf("OACK options %v, want %v", ParseOACK(OACK), Case.Want.Accepted)
+			}
+		})
+	}
+}
+
+func TestWriteWithoutDataNotStored(t *testing.T) {
+
+	t.Run("timeout", func(t *testing.T) {
+		Clock := NewFakeClock()
+		Srv := &Server{Clock: Clock}
+		Addr := StartTestServer(t, Srv)
+		Errors := Stats.Errors.Load()
+		Client := NewTestClient(t, Addr)
+		Client.Request(WRQ, "idle")
+		Client.Expect(ACK, 0)
+		for i := 0; i < 3; i++ {
+			Clock.WaitTimer(t)
+			Clock.Advance(TIMEOUT * time.Second)
+			Client.Expect(ACK, 0)
+		}
+		Clock.WaitTimer(t)
+		Clock.Advance(TIMEOUT * time.Second) //retries used up, handler gives up
+		WaitTransfers(t, Srv, 0)
+		for Start := time.Now(); Stats.Errors.Load() == Errors; time.Sleep(time.Millisecond) {
+			if time.Since(Start) > 3*time.Second {
+				t.Fatal("abandoned write not counted as error")
+			}
+		}
+		if Stored, ok := StoredData("idle"); ok {
+			t.Fatalf("abandoned write stored %d bytes", len(Stored))
+		}
+		if _, err := NewTestClient(t, Addr).Put("idle", []byte("later")); err != nil { //name is free
+			t.Fatal(err)
+		}
+		if Data := WaitStored(t, "idle"); string(Data) != "later" {
+			t.Fatalf("stored %q", Data)
+		}
+	})
+
+	t.Run("commit at stop", func(t *testing.T) {
+		SetFlag(t, ShutdownWrites, "commit")
+		ResetStore(t)
+		Conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		Ctx, Cancel := context.WithCancel(context.Background())
+		Done := make(chan error)
+		go func() { Done <- (&Server{}).ServeConn(Ctx, Conn) }()
+		Client := NewTestClient(t, Conn.LocalAddr().(*net.UDPAddr))
+		Client.Request(WRQ, "empty")
+		Client.Expect(ACK, 0)
+		Cancel() //stop before first DATA
+		select {
+		case <-Done:
+		case <-time.After(3 * time.Second):
+			t.Fatal("server not stopped")
+		}
+		if _, ok := StoredData("empty"); ok {
+			t.Fatal("write without DATA stored as empty file")
+		}
+	})
+}
+
+func TestUploadQuotaPerClientIP(t *testing.T) {
+
+	SetFlag(t, UploadQuota, 1000)
+	SetFlag(t, QuotaWindow, time.Hour)
+	t.Cleanup(func() {
+		UploadUsageLock.Lock()
+		clear(UploadUsages)
+		UploadUsageLock.Unlock()
+	})
+	Clock := NewFakeClock()
+	Addr := StartTestServer(t, &Server{Clock: Clock})
+	Data := bytes.Repeat([]byte("q"), 600)
+	QuotaError := func(err error) bool {
+		Reply, ok := err.(*ErrorReply)
+		return ok && Reply.Code == DISKFULL && Reply.Message == UPLOADQUOTAMSG
+	}
+
+	if _, err := NewTestClient(t, Addr).Put("first", Data); err != nil {
+		t.Fatal(err)
+	}
+	WaitStored(t, "first")
+	if _, err := NewTestClient(t, Addr).Put("second", Data); !QuotaError(err) { //600 more goes over 1000
+		t.Fatalf("upload over quota got %v", err)
+	}
+	if _, err := NewTestClient(t, Addr).Put("announced", []byte("x"), "tsize", "500"); !QuotaError(err) {
+		t.Fatalf("upload announcing tsize over quota left got %v", err)
+	}
+	if _, err := NewTestClientFrom(t, Addr, net.IPv4(127, 0, 0, 2)).Put("other ip", Data); err != nil { //quota is per IP
+		t.Fatal(err)
+	}
+	WaitStored(t, "other ip")
+	if _, ok := StoredData("second"); ok {
+		t.Fatal("upload over quota stored")
+	}
+
+	Clock.Advance(time.Hour) //new window
+	if _, err := NewTestClient(t, Addr).Put("second", Data); err != nil {
+		t.Fatal(err)
+	}
+	WaitStored(t, "second")
+}
+
+func TestCompressedReadRoundTrip(t *testing.T) {
+
+	Addr := StartTestServer(t, &Server{})
+	Data := bytes.Repeat([]byte("compressible line of text\n"), 2000)
+	PutFile("text", Data)
+
+	Received, Options, err := NewTestClient(t, Addr).Get("text", "compress", "gzip")
+	if err != nil || Options["compress"] != "gzip" {
+		t.Fatalf("compressed read: %v, options %v", err, Options)
+	}
+	if len(Received) >= len(Data)/10 {
+		t.Fatalf("%d bytes on wire for %d bytes file", len(Received), len(Data))
+	}
+	Reader, err := gzip.NewReader(bytes.NewReader(Received))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if Decompressed, err := io.ReadAll(Reader); err != nil || !bytes.Equal(Decompressed, Data) {
+		t.Fatalf("decompressed %d bytes, %v", len(Decompressed), err)
+	}
+
+	Received, Options, err = NewTestClient(t, Addr).Get("text") //standard client gets data as stored
+	if err != nil || Options != nil || !bytes.Equal(Received, Data) {
+		t.Fatalf("plain read: %d bytes, options %v, %v", len(Received), Options, err)
+	}
+}
+
+func TestTimeoutLogDiagnostics(t *testing.T) {
+
+	for _, Case := range []struct {
+		Name    string
+		Request func(Client *TestClient)
+		Want    string
+	}{
+		{"read", func(Client *TestClient) {
+			Client.Request(RRQ, "timeout")
+			Client.Expect(DATA, 1)
+		}, "awaiting : ACK of block 1 retries : 3 timeout : 2s silent for : 8s elapsed : 8s"},
+		{"write", func(Client *TestClient) {
+			Client.Request(WRQ, "upload")
+			Client.Expect(ACK, 0)
+		}, "awaiting : DATA block 1 retries : 3 timeout : 2s silent for : 8s elapsed : 8s"},
+		{"write with options", func(Client *TestClient) {
+			Client.Request(WRQ, "upload", "blksize", "1024")
+			Client.Expect(OACK, 0)
+		}, "awaiting : answer to OACK retries : 3"},
+	} {
+		t.Run(Case.Name, func(t *testing.T) {
+			ResetStore(t)
+			PutFile("timeout", []byte("never acknowledged"))
+			//server runs only while output is captured so it does not race with swap of stdout
+			Log := CaptureOutput(t, func() {
+				Conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+				if err != nil {
+					t.Fatal(err)
+				}
+				Clock := NewFakeClock()
+				Srv := &Server{Clock: Clock}
+				Ctx, Cancel := context.WithCancel(context.Background())
+				Done := make(chan error)
+				go func() { Done <- Srv.ServeConn(Ctx, Conn) }()
+				defer func() {
+					Cancel()
+					<-Done
+				}()
+				Client := NewTestClient(t, Conn.LocalAddr().(*net.UDPAddr))
+				Case.Request(Client)
+				for i := 0; i < 3; i++ {
+					Clock.WaitTimer(t)
+					Clock.Advance(TIMEOUT * time.Second)
+					Client.Recv(time.Second) //retransmission
+				}
+				Clock.WaitTimer(t)
+				Clock.Advance(TIMEOUT * time.Second) //retries used up
+				WaitTransfers(t, Srv, 0)
+			})
+			Line := ""
+			for _, Line = range strings.Split(Log, "\n") {
+				if strings.HasPrefix(Line, "==== TIMEOUT") {
+					break
+				}
+			}
+			if !strings.Contains(Line, Case.Want) || !strings.Contains(Line, "client :[ 127.0.0.1:") {
+				t.Fatalf("timeout log %q, want %q", Line, Case.Want)
+			}
+		})
+	}
+}
+
+// StartWebhookReceiver serves webhook whose first Failures POSTs get error status. Bodies of
+// accepted POSTs are sent to returned channel
+func StartWebhookReceiver(t *testing.T, Failures int) (string, chan []byte) {
+
+	Bodies := make(chan []byte, 10)
+	var Lock sync.Mutex
+	Receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		Body, _ := io.ReadAll(r.Body)
+		Lock.Lock()
+		defer Lock.Unlock()
+		if r.Method != http.MethodPost || r.Header.Get("Content-Type") != "application/json" {
+			t.Errorf("webhook got %s with content type %q", r.Method, r.Header.Get("Content-Type"))
+		}
+		if Failures > 0 {
+			Failures = Failures - 1
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		Bodies <- Body
+	}))
+	t.Cleanup(Receiver.Close)
+	return Receiver.URL, Bodies
+}
+
+func TestWriteWebhookReceivesUpload(t *testing.T) {
+
+	URL, Bodies := StartWebhookReceiver(t, 1) //first POST is tried again
+	Hook := &Webhook{URL: URL, Client: &http.Client{Timeout: 5 * time.Second}}
+	Srv := &Server{OnWriteComplete: Hook.NotifyWrite}
+	Addr := StartTestServer(t, Srv)
+	Data := bytes.Repeat([]byte("w"), 1500)
+	Client := NewTestClient(t, Addr)
+	if _, err := Client.Put("hooked", Data); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case Body := <-Bodies:
+		var Event WriteEvent
+		if err := json.Unmarshal(Body, &Event); err != nil {
+			t.Fatal(err)
+		}
+		Hash := sha256.Sum256(Data)
+		Want := WriteEvent{FileName: "hooked", Size: len(Data), Client: Client.Conn.LocalAddr().String(), SHA256: hex.EncodeToString(Hash[:])}
+		if Event != Want {
+			t.Fatalf("webhook got %+v, want %+v", Event, Want)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("webhook not called")
+	}
+	Hook.Pending.Wait()
+}
+
+func TestReadWebhookReceivesDelivery(t *testing.T) {
+
+	SetFlag(t, ResumeTTL, time.Minute)
+	URL, Bodies := StartWebhookReceiver(t, 0)
+	Hook := &Webhook{URL: URL, Client: &http.Client{Timeout: 5 * time.Second}}
+	Srv := &Server{OnReadComplete: Hook.NotifyRead}
+	Addr := StartTestServer(t, Srv)
+	Data := bytes.Repeat([]byte("r"), 1300)
+	PutFile("delivered", Data)
+	Expect := func(Client *TestClient, Bytes int) {
+		t.Helper()
+		select {
+		case Body := <-Bodies:
+			var Event ReadEvent
+			if err := json.Unmarshal(Body, &Event); err != nil {
+				t.Fatal(err)
+			}
+			Want := ReadEvent{FileName: "delivered", Client: Client.Conn.LocalAddr().String(), Bytes: Bytes}
+			if Event != Want {
+				t.Fatalf("webhook got %+v, want %+v", Event, Want)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("webhook not called")
+		}
+	}
+	Client := NewTestClient(t, Addr)
+	if Received, _, err := Client.Get("delivered"); err != nil || !bytes.Equal(Received, Data) {
+		t.Fatalf("read: %d bytes, %v", len(Received), err)
+	}
+	Expect(Client, len(Data))
+
+	//file bytes are reported, not smaller gzip data sent on wire
+	Client = NewTestClient(t, Addr)
+	if Received, Options, err := Client.Get("delivered", "compress", "gzip"); err != nil || Options["compress"] != "gzip" || len(Received) >= len(Data) {
+		t.Fatalf("compressed read: %d bytes, options %v, %v", len(Received), Options, err)
+	}
+	Expect(Client, len(Data))
+
+	//resumed read reports only rest of file sent by it
+	Client = NewTestClient(t, Addr)
+	Client.Request(RRQ, "delivered")
+	Client.Expect(DATA, 1)
+	Client.Send(MakeACKPacket(1))
+	Client.Expect(DATA, 2)
+	Client.Send(MakeErrorPacket(UNKNOWNERROR, "interrupted"))
+	WaitTransfers(t, Srv, 0) //checkpoint is saved before transfer ends
+	if Rest, Options, err := Client.Get("delivered", "resume", "1"); err != nil || Options["resume"] != "512" || !bytes.Equal(Rest, Data[512:]) {
+		t.Fatalf("resumed read: %d bytes, options %v, %v", len(Rest), Options, err)
+	}
+	Expect(Client, len(Data)-512)
+	Hook.Pending.Wait()
+
+	//failing webhook does not affect read. Its retries go on in background
+	FailingURL, _ := StartWebhookReceiver(t, 1000)
+	Failing := &Webhook{URL: FailingURL, Client: &http.Client{Timeout: 5 * time.Second}}
+	Addr = StartTestServer(t, &Server{OnReadComplete: Failing.NotifyRead})
+	PutFile("delivered", Data)
+	if Received, _, err := NewTestClient(t, Addr).Get("delivered"); err != nil || !bytes.Equal(Received, Data) {
+		t.Fatalf("read with failing webhook: %d bytes, %v", len(Received), err)
+	}
+}
+
+func TestStrictNegotiationRejectsMalformedOption(t *testing.T) {
+
+	NegotiationError := func(err error, Options string) bool {
+		Reply, ok := err.(*ErrorReply)
+		return ok && Reply.Code == OPTIONNEGFAILED && Reply.Message == OPTIONNEGMSG+": "+Options
+	}
+
+	t.Run("lenient", func(t *testing.T) {
+		Addr := StartTestServer(t, &Server{})
+		PutFile("strict", []byte("strict data"))
+		if Data, Options, err := NewTestClient(t, Addr).Get("strict", "blksize", "abc"); err != nil || Options != nil || string(Data) != "strict data" { //invalid value ignored
+			t.Fatalf("read: %q, options %v, %v", Data, Options, err)
+		}
+	})
+
+	t.Run("strict", func(t *testing.T) {
+		SetFlag(t, StrictNegotiation, true)
+		Addr := StartTestServer(t, &Server{})
+		PutFile("strict", []byte("strict data"))
+		if _, _, err := NewTestClient(t, Addr).Get("strict", "blksize", "abc"); !NegotiationError(err, "blksize") {
+			t.Fatalf("read with malformed blksize got %v", err)
+		}
+		if _, err := NewTestClient(t, Addr).Put("rejected", []byte("x"), "windowsize", "0", "tsize", "-1"); !NegotiationError(err, "windowsize, tsize") {
+			t.Fatalf("write with malformed options got %v", err)
+		}
+		if _, ok := StoredData("rejected"); ok {
+			t.Fatal("rejected upload stored")
+		}
+		if Data, _, err := NewTestClient(t, Addr).Get("strict", "unknown", "value"); err != nil || string(Data) != "strict data" { //unknown options stay ignored
+			t.Fatalf("read with unknown option: %q, %v", Data, err)
+		}
+	})
+}
@@ -0,0 +1,20 @@
+//go:build !unix
+
+package main
+
+import (
+	"errors"
+	"syscall"
+)
+
+// setting TOS byte of socket is not supported on this platform
+const TOSSupported = false
+
+/**
+* @brief : Function to set TOS byte of socket. Not supported on this platform.
+ */
+
+func SetSocketTOS(Network string, RawConn syscall.RawConn, TOS int) error {
+
+	return errors.New("TOS marking is not supported on this platform")
+}
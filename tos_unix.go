@@ -0,0 +1,31 @@
+//go:build unix
+
+package main
+
+import "syscall"
+
+// setting IP_TOS / IPV6_TCLASS is supported on unix platforms
+const TOSSupported = true
+
+/**
+* @brief : Function to set TOS (IPv4) or traffic class (IPv6) byte of socket.
+* @param : Network : network of socket "udp4" or "udp6"
+* @param : RawConn : socket
+* @param : TOS : value of TOS byte
+ */
+
+func SetSocketTOS(Network string, RawConn syscall.RawConn, TOS int) error {
+
+	var SockErr error
+	err := RawConn.Control(func(fd uintptr) {
+		if Network == "udp6" {
+			SockErr = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IPV6, syscall.IPV6_TCLASS, TOS)
+		} else {
+			SockErr = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IP, syscall.IP_TOS, TOS)
+		}
+	})
+	if err != nil {
+		return err
+	}
+	return SockErr
+}
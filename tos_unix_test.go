@@ -0,0 +1,31 @@
+//go:build unix
+
+package main
+
+import (
+	"net"
+	"syscall"
+	"testing"
+)
+
+func TestTransferSocketDSCP(t *testing.T) {
+
+	SetFlag(t, DSCP, 46)
+	Conn, err := NewTransferConn(&net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 9})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer Conn.Close()
+	RawConn, err := Conn.SyscallConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var TOS int
+	var SockErr error
+	RawConn.Control(func(fd uintptr) {
+		TOS, SockErr = syscall.GetsockoptInt(int(fd), syscall.IPPROTO_IP, syscall.IP_TOS)
+	})
+	if SockErr != nil || TOS != 46<<2 {
+		t.Fatalf("TOS %d, %v", TOS, SockErr)
+	}
+}